@@ -283,4 +283,264 @@ var (
 
 	ClusterName = env.RegisterStringVar("CLUSTER_ID", "Kubernetes",
 		"Defines the cluster and service registry that this Istiod instance is belongs to")
+
+	UpstreamTLSMinProtocolVersion = env.RegisterStringVar(
+		"PILOT_UPSTREAM_TLS_MIN_PROTOCOL_VERSION",
+		"",
+		"Minimum TLS protocol version (TLSV1_0, TLSV1_1, TLSV1_2 or TLSV1_3) used when originating SIMPLE or MUTUAL "+
+			"TLS to an upstream cluster. If unset, Envoy defaults are used.",
+	)
+
+	UpstreamTLSMaxProtocolVersion = env.RegisterStringVar(
+		"PILOT_UPSTREAM_TLS_MAX_PROTOCOL_VERSION",
+		"",
+		"Maximum TLS protocol version (TLSV1_0, TLSV1_1, TLSV1_2 or TLSV1_3) used when originating SIMPLE or MUTUAL "+
+			"TLS to an upstream cluster. If unset, Envoy defaults are used.",
+	)
+
+	UpstreamTLSCipherSuites = env.RegisterStringVar(
+		"PILOT_UPSTREAM_TLS_CIPHER_SUITES",
+		"",
+		"Comma separated list of cipher suites used when originating SIMPLE or MUTUAL TLS to an upstream cluster. "+
+			"Unrecognized cipher suites are ignored. If unset, Envoy defaults are used.",
+	)
+
+	OutlierBaseEjectionTimeJitter = env.RegisterDurationVar(
+		"PILOT_OUTLIER_BASE_EJECTION_TIME_JITTER",
+		0,
+		"If set, a per cluster offset up to this duration is added to the outlier detection base ejection time, "+
+			"so that hosts ejected from different clusters are not re-admitted at the same time. "+
+			"The offset is derived from the cluster name, so it is stable across pushes.",
+	)
+
+	ConnectTimeoutJitter = env.RegisterDurationVar(
+		"PILOT_CONNECT_TIMEOUT_JITTER",
+		0,
+		"If set, a per cluster offset up to this duration is added to the connect timeout of clusters, so that "+
+			"connection attempts that time out together, e.g. after a restart, are not retried in lock step. "+
+			"The offset is derived from the cluster name, so it is stable across pushes.",
+	)
+
+	UpstreamTLSEcdhCurves = env.RegisterStringVar(
+		"PILOT_UPSTREAM_TLS_ECDH_CURVES",
+		"",
+		"Comma separated list of ECDH curves used when originating SIMPLE or MUTUAL TLS to an upstream cluster. "+
+			"If unset, Envoy defaults are used.",
+	)
+
+	ClusterUpdateMergeWindow = env.RegisterDurationVar(
+		"PILOT_CLUSTER_UPDATE_MERGE_WINDOW",
+		0,
+		"If set, Envoy merges endpoint health and weight updates of a cluster that arrive within this window "+
+			"into a single load balancer rebuild. If unset, Envoy's default of 1s is used.",
+	)
+
+	DNSFailureRefreshBaseInterval = env.RegisterDurationVar(
+		"PILOT_DNS_FAILURE_REFRESH_BASE_INTERVAL",
+		0,
+		"If set, DNS clusters retry a failed resolution with an exponential backoff starting at this interval, "+
+			"instead of waiting for the regular DNS refresh rate.",
+	)
+
+	DNSFailureRefreshMaxInterval = env.RegisterDurationVar(
+		"PILOT_DNS_FAILURE_REFRESH_MAX_INTERVAL",
+		0,
+		"Maximum backoff interval between retries of a failed DNS resolution. Only used together with "+
+			"PILOT_DNS_FAILURE_REFRESH_BASE_INTERVAL. If unset, Envoy defaults to 10 times the base interval.",
+	)
+
+	DefaultDNSRefreshRate = env.RegisterDurationVar(
+		"PILOT_DEFAULT_DNS_REFRESH_RATE",
+		5*time.Second,
+		"The DNS refresh rate of DNS clusters when the mesh config does not set dnsRefreshRate. "+
+			"If set to 0, Envoy's default refresh rate is used instead.",
+	)
+
+	EnableHeadlessServicePodClusters = env.RegisterBoolVar(
+		"PILOT_ENABLE_HEADLESS_SERVICE_POD_CLUSTERS",
+		false,
+		"If enabled, an additional outbound cluster is generated for every pod of a headless service, named after "+
+			"the pod DNS name (<pod>.<service hostname>). This allows clients, such as StatefulSet peers, to address "+
+			"individual pods.",
+	)
+
+	EnableDynamicForwardProxyClusters = env.RegisterBoolVar(
+		"PILOT_ENABLE_DYNAMIC_FORWARD_PROXY_CLUSTERS",
+		false,
+		"If enabled, outbound clusters for wildcard ServiceEntry hosts without resolution are built as dynamic "+
+			"forward proxy clusters, which resolve the requested host with a shared DNS cache. The listeners have to "+
+			"be patched with the matching dynamic forward proxy HTTP filter.",
+	)
+
+	StripEndpointMetadata = env.RegisterBoolVar(
+		"PILOT_STRIP_ENDPOINT_METADATA",
+		false,
+		"If enabled, endpoint metadata is reduced to the keys Envoy needs to route to the endpoint, the TLS mode "+
+			"and the network. Other keys, such as the workload UID used by Mixer, are dropped to shrink large EDS "+
+			"responses.",
+	)
+
+	DisableInboundPassthroughClusters = env.RegisterBoolVar(
+		"PILOT_DISABLE_INBOUND_PASSTHROUGH_CLUSTERS",
+		false,
+		"If enabled, inbound traffic to ports of a workload that are not declared by a service is dropped, instead "+
+			"of being forwarded to its original destination. The inbound passthrough clusters are replaced by clusters "+
+			"without endpoints.",
+	)
+
+	OutlierDefaultMaxEjectionPercent = env.RegisterIntVar(
+		"PILOT_OUTLIER_DEFAULT_MAX_EJECTION_PERCENT",
+		0,
+		"If set, the maximum percentage of hosts of a cluster that outlier detection can eject, when the "+
+			"DestinationRule does not set maxEjectionPercent. If unset, Envoy's default of 10% is used.",
+	)
+
+	EnforceStrictMTLSForClusters = env.RegisterBoolVar(
+		"PILOT_ENFORCE_STRICT_MTLS_FOR_CLUSTERS",
+		false,
+		"If enabled, a DestinationRule that disables TLS for a host that requires strict mTLS is overridden with "+
+			"ISTIO_MUTUAL, instead of sending plaintext that the host would reject.",
+	)
+
+	FallbackForMissingSubsets = env.RegisterBoolVar(
+		"PILOT_FALLBACK_FOR_MISSING_SUBSETS",
+		false,
+		"If enabled, virtual service destinations that route to a subset that no destination rule defines are "+
+			"routed to all endpoints of the host, instead of to a cluster that does not exist.",
+	)
+
+	InboundDefaultMaxConnections = env.RegisterIntVar(
+		"PILOT_INBOUND_DEFAULT_MAX_CONNECTIONS",
+		0,
+		"If set, the default maximum number of connections of inbound clusters, protecting the application from "+
+			"the traffic it receives. A DestinationRule connection pool for the host takes precedence. If unset, "+
+			"inbound clusters are not limited.",
+	)
+
+	InboundDefaultMaxRequests = env.RegisterIntVar(
+		"PILOT_INBOUND_DEFAULT_MAX_REQUESTS",
+		0,
+		"If set, the default maximum number of concurrent requests of inbound clusters. A DestinationRule "+
+			"connection pool for the host takes precedence. If unset, inbound clusters are not limited.",
+	)
+
+	DefaultLbPolicy = env.RegisterStringVar(
+		"PILOT_DEFAULT_LB_POLICY",
+		"",
+		"If set, the load balancing policy of clusters whose DestinationRule does not specify one, instead of "+
+			"ROUND_ROBIN. The value is one of the simple load balancer names of a DestinationRule, such as LEAST_CONN.",
+	)
+
+	EnableEndpointDebugMetadata = env.RegisterBoolVar(
+		"PILOT_ENABLE_ENDPOINT_DEBUG_METADATA",
+		false,
+		"If enabled, the workload UID, which holds the pod name, is added to the metadata of each endpoint under "+
+			"the istio.debug key, e.g. to tell which pod sticky sessions land on. It is sent independently of Mixer and "+
+			"PILOT_STRIP_ENDPOINT_METADATA, and grows EDS responses.",
+	)
+
+	NodeNameAsSubzone = env.RegisterBoolVar(
+		"PILOT_NODE_NAME_AS_SUBZONE",
+		false,
+		"If enabled, Kubernetes pods on nodes without the topology.istio.io/subzone label get the name of their node "+
+			"as subzone of their locality. With locality failover, proxies then prefer endpoints on their own node, "+
+			"followed by endpoints in their zone.",
+	)
+
+	DefaultCircuitBreakerMaxRetries = env.RegisterIntVar(
+		"PILOT_DEFAULT_CIRCUIT_BREAKER_MAX_RETRIES",
+		0,
+		"If set, the default maximum number of parallel retries of clusters, instead of disabling the limit. "+
+			"The max retries of a DestinationRule connection pool take precedence.",
+	)
+
+	OutlierDefaultInterval = env.RegisterDurationVar(
+		"PILOT_OUTLIER_DEFAULT_INTERVAL",
+		0,
+		"If set, the time between outlier detection sweeps of a cluster, when the DestinationRule does not set "+
+			"an interval. If unset, Envoy's default of 10s is used.",
+	)
+
+	DefaultCircuitBreakerMaxPendingRequests = env.RegisterIntVar(
+		"PILOT_DEFAULT_CIRCUIT_BREAKER_MAX_PENDING_REQUESTS",
+		0,
+		"If set, the default maximum number of requests of clusters that are queued while waiting for a "+
+			"connection, instead of disabling the limit. The http1MaxPendingRequests of a DestinationRule "+
+			"connection pool take precedence.",
+	)
+
+	EnableEndpointServiceAccountMetadata = env.RegisterBoolVar(
+		"PILOT_ENABLE_ENDPOINT_SERVICE_ACCOUNT_METADATA",
+		false,
+		"If enabled, the service account of the workload is added to the istio metadata of each endpoint, so that "+
+			"upstream RBAC and telemetry can match the principal of an endpoint. It is not sent when "+
+			"PILOT_STRIP_ENDPOINT_METADATA is enabled, and grows EDS responses.",
+	)
+
+	DefaultH2UpgradePolicy = env.RegisterStringVar(
+		"PILOT_DEFAULT_H2_UPGRADE_POLICY",
+		"",
+		"If set to UPGRADE, HTTP/1.1 connections of outbound clusters are upgraded to HTTP/2 unless their "+
+			"DestinationRule sets h2UpgradePolicy to DO_NOT_UPGRADE. If unset, connections are not upgraded.",
+	)
+
+	ExternalClusterStatName = env.RegisterStringVar(
+		"PILOT_EXTERNAL_CLUSTER_STAT_NAME",
+		"",
+		"If set, the stat name pattern of the outbound clusters of services external to the mesh, such as "+
+			"ServiceEntries with MESH_EXTERNAL location. It supports the same patterns as outboundClusterStatName "+
+			"of the mesh config, which is used for them if unset.",
+	)
+
+	EndpointDrainingGracePeriod = env.RegisterDurationVar(
+		"PILOT_ENDPOINT_DRAINING_GRACE_PERIOD",
+		0,
+		"If set, endpoints of workloads with the networking.istio.io/drainingSince label, holding the Unix time "+
+			"at which they started shutting down, are marked as draining for this period and removed once it has "+
+			"passed. If unset, the label is ignored.",
+	)
+
+	OutlierDefaultBaseEjectionTime = env.RegisterDurationVar(
+		"PILOT_OUTLIER_DEFAULT_BASE_EJECTION_TIME",
+		0,
+		"If set, the base ejection time of outlier detection, when the DestinationRule does not set one. "+
+			"If unset, Envoy's default of 30s is used.",
+	)
+
+	EnableDefaultOutlierDetection = env.RegisterBoolVar(
+		"PILOT_ENABLE_DEFAULT_OUTLIER_DETECTION",
+		false,
+		"If enabled, outbound EDS clusters eject endpoints after 5 consecutive gateway errors, when the "+
+			"DestinationRule does not configure outlier detection. A DestinationRule can disable it by setting an "+
+			"outlier detection interval of 0s.",
+	)
+
+	OutlierMaxEjectionPercentCeiling = env.RegisterIntVar(
+		"PILOT_OUTLIER_MAX_EJECTION_PERCENT_CEILING",
+		0,
+		"If set to a value below 100, the highest max ejection percent of outlier detection. DestinationRules "+
+			"asking for more are clamped to it, so that outlier detection can not eject all endpoints of a cluster.",
+	)
+
+	EnableTimeoutBudgetStats = env.RegisterBoolVar(
+		"PILOT_ENABLE_TIMEOUT_BUDGET_STATS",
+		false,
+		"If enabled, clusters emit the upstream_rq_timeout_budget_percent_used and "+
+			"upstream_rq_timeout_budget_per_try_percent_used histograms. The request and response size "+
+			"histograms of Envoy's track_cluster_stats are not available with the v2 cluster API.",
+	)
+
+	EnableSourceLabelsClusterMetadata = env.RegisterBoolVar(
+		"PILOT_ENABLE_SOURCE_LABELS_CLUSTER_METADATA",
+		false,
+		"If enabled, the workload labels of a proxy are added to the istio metadata of its outbound clusters "+
+			"as sourceLabels, so that telemetry can correlate the source and destination of requests.",
+	)
+
+	EnableAutoMtlsClusterMetadata = env.RegisterBoolVar(
+		"PILOT_ENABLE_AUTO_MTLS_CLUSTER_METADATA",
+		false,
+		"If enabled, the istio metadata of outbound clusters that originate TLS records as autoMtls whether "+
+			"the TLS comes from automatic mTLS (true) or from a DestinationRule (false). Plaintext clusters have no autoMtls.",
+	)
 )
@@ -366,6 +366,21 @@ type NodeMetadata struct {
 	// Alpha in 1.1, based on feedback may be turned into an API or change. Set to "1" to enable.
 	HTTP10 string `json:"HTTP10,omitempty"`
 
+	// OutboundLbPolicy overrides the load balancing policy of all outbound clusters of the proxy, allowing to try a
+	// load balancing policy on a single proxy. The value is one of the simple load balancer names of a
+	// DestinationRule, such as LEAST_CONN.
+	OutboundLbPolicy string `json:"OUTBOUND_LB_POLICY,omitempty"`
+
+	// InboundClusterAddress is the address the inbound clusters of the proxy send traffic to, instead of localhost.
+	// It is meant for network setups where the application does not accept traffic on localhost and has to be
+	// reached on the pod IP, e.g. by setting it to $(INSTANCE_IP).
+	InboundClusterAddress string `json:"INBOUND_CLUSTER_ADDRESS,omitempty"`
+
+	// PassthroughUseHTTPHeader makes the passthrough cluster of the proxy read the original destination of HTTP
+	// requests from the x-envoy-original-dst-host header, e.g. for proxies that forward traffic on behalf of other
+	// workloads. Requests without the header are sent to the original destination of the downstream connection.
+	PassthroughUseHTTPHeader StringBool `json:"PASSTHROUGH_USE_HTTP_HEADER,omitempty"`
+
 	// Contains a copy of the raw metadata. This is needed to lookup arbitrary values.
 	// If a value is known ahead of time it should be added to the struct rather than reading from here,
 	Raw map[string]interface{} `json:"-"`
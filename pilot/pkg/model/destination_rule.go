@@ -16,12 +16,378 @@ package model
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/hashicorp/go-multierror"
 
 	networking "istio.io/api/networking/v1alpha3"
 
 	"istio.io/istio/pkg/config/host"
 )
 
+// Annotations of a DestinationRule that configure cluster settings which are not part of the DestinationRule API
+// yet. They are parsed by ParseDestinationRuleAnnotations.
+const (
+	// ALPNProtocolsAnnotation is a comma separated list of the ALPN protocols advertised with SIMPLE or MUTUAL TLS.
+	ALPNProtocolsAnnotation = "networking.istio.io/alpnProtocols"
+	// ClientCredentialNameAnnotation is the secret of the client certificate fetched over SDS with MUTUAL TLS.
+	ClientCredentialNameAnnotation = "networking.istio.io/clientCredentialName"
+	// SubsetClientCredentialNamesAnnotation is a comma separated list of <subset>=<secret> client credential overrides.
+	SubsetClientCredentialNamesAnnotation = "networking.istio.io/subsetClientCredentialNames"
+	// CloseConnectionsOnHostHealthFailureAnnotation closes the connections to a host once it is marked unhealthy.
+	CloseConnectionsOnHostHealthFailureAnnotation = "networking.istio.io/closeConnectionsOnHostHealthFailure"
+	// ConsistentHashKeysAnnotation is an ordered, comma separated list of header:, cookie:, queryParameter: or
+	// sourceIP hash keys.
+	ConsistentHashKeysAnnotation = "networking.istio.io/consistentHashKeys"
+	// DefaultPerTryTimeoutAnnotation is the per try timeout of retries of routes to the host that do not set one.
+	DefaultPerTryTimeoutAnnotation = "networking.istio.io/defaultPerTryTimeout"
+	// DefaultRequestTimeoutAnnotation is the timeout of routes to the host that do not set a timeout of their own.
+	DefaultRequestTimeoutAnnotation = "networking.istio.io/defaultRequestTimeout"
+	// DefaultSubsetAnnotation is the subset that requests to the default cluster of the host fall back to.
+	DefaultSubsetAnnotation = "networking.istio.io/defaultSubset"
+	// EdsInitialFetchTimeoutAnnotation is how long EDS clusters wait for their endpoints while warming.
+	EdsInitialFetchTimeoutAnnotation = "networking.istio.io/edsInitialFetchTimeout"
+	// EndpointPortsAnnotation is a comma separated list of <service port>=<endpoint port> remappings of the ports of
+	// the endpoints of the host.
+	EndpointPortsAnnotation = "networking.istio.io/endpointPorts"
+	// HealthCheckHostAnnotation is the host that HTTP health checks send.
+	HealthCheckHostAnnotation = "networking.istio.io/healthCheckHost"
+	// LoadBalancerExtensionAnnotation names a custom Envoy load balancer that the clusters delegate to.
+	LoadBalancerExtensionAnnotation = "networking.istio.io/loadBalancerExtension"
+	// LoadBalancerExtensionConfigAnnotation is the JSON config of the load balancer extension.
+	LoadBalancerExtensionConfigAnnotation = "networking.istio.io/loadBalancerExtensionConfig"
+	// MaxConcurrentStreamsAnnotation bounds the concurrent streams per HTTP/2 connection.
+	MaxConcurrentStreamsAnnotation = "networking.istio.io/maxConcurrentStreams"
+	// HTTP2InitialStreamWindowSizeAnnotation is the initial HTTP/2 stream window size in bytes.
+	HTTP2InitialStreamWindowSizeAnnotation = "networking.istio.io/http2InitialStreamWindowSize"
+	// HTTP2InitialConnectionWindowSizeAnnotation is the initial HTTP/2 connection window size in bytes.
+	HTTP2InitialConnectionWindowSizeAnnotation = "networking.istio.io/http2InitialConnectionWindowSize"
+	// MaxConnectionsPerHostAnnotation limits the connections to each host of the clusters.
+	MaxConnectionsPerHostAnnotation = "networking.istio.io/maxConnectionsPerHost"
+	// OutlierEnforcingConsecutive5xxAnnotation is the percentage of consecutive 5xx outliers that are ejected.
+	OutlierEnforcingConsecutive5xxAnnotation = "networking.istio.io/outlierEnforcingConsecutive5xx"
+	// OutlierEnforcingConsecutiveGatewayErrorsAnnotation is the percentage of consecutive gateway error outliers that
+	// are ejected.
+	OutlierEnforcingConsecutiveGatewayErrorsAnnotation = "networking.istio.io/outlierEnforcingConsecutiveGatewayErrors"
+	// OutlierEnforcingSuccessRateAnnotation is the percentage of success rate outliers that are ejected.
+	OutlierEnforcingSuccessRateAnnotation = "networking.istio.io/outlierEnforcingSuccessRate"
+	// OutlierDetectionOnlyAnnotation records outliers in the stats without ever ejecting them.
+	OutlierDetectionOnlyAnnotation = "networking.istio.io/outlierDetectionOnly"
+	// OutlierFailurePercentageThresholdAnnotation is the failure percentage at which a host is ejected.
+	OutlierFailurePercentageThresholdAnnotation = "networking.istio.io/outlierFailurePercentageThreshold"
+	// OutlierFailurePercentageMinimumHostsAnnotation is the minimum number of hosts for failure percentage ejection.
+	OutlierFailurePercentageMinimumHostsAnnotation = "networking.istio.io/outlierFailurePercentageMinimumHosts"
+	// OutlierFailurePercentageRequestVolumeAnnotation is the minimum number of requests for failure percentage ejection.
+	OutlierFailurePercentageRequestVolumeAnnotation = "networking.istio.io/outlierFailurePercentageRequestVolume"
+	// OutlierSuccessRateMinimumHostsAnnotation is the minimum number of hosts for success rate ejection.
+	OutlierSuccessRateMinimumHostsAnnotation = "networking.istio.io/outlierSuccessRateMinimumHosts"
+	// OutlierSuccessRateRequestVolumeAnnotation is the minimum number of requests for success rate ejection.
+	OutlierSuccessRateRequestVolumeAnnotation = "networking.istio.io/outlierSuccessRateRequestVolume"
+	// OutlierSuccessRateStdevFactorAnnotation is the factor of the standard deviation for success rate ejection.
+	OutlierSuccessRateStdevFactorAnnotation = "networking.istio.io/outlierSuccessRateStdevFactor"
+	// PlaintextFallbackAnnotation sends plaintext to endpoints without a sidecar with ISTIO_MUTUAL TLS.
+	PlaintextFallbackAnnotation = "networking.istio.io/plaintextFallback"
+	// RetryBudgetAnnotation limits retries to a percentage of the active requests.
+	RetryBudgetAnnotation = "networking.istio.io/retryBudget"
+	// HighPriorityRetryBudgetAnnotation is the retry budget of requests of the high routing priority.
+	HighPriorityRetryBudgetAnnotation = "networking.istio.io/highPriorityRetryBudget"
+	// StatNameAnnotation is the stat name pattern of the clusters.
+	StatNameAnnotation = "networking.istio.io/statName"
+	// StatsHistogramBucketsAnnotation names the histogram bucket set of the clusters.
+	StatsHistogramBucketsAnnotation = "networking.istio.io/statsHistogramBuckets"
+	// StatsTagsAnnotation is a JSON object of custom tags added to the metrics of requests to the host.
+	StatsTagsAnnotation = "networking.istio.io/statsTags"
+	// WasmConfigAnnotation is the JSON config of upstream WASM filters for the host.
+	WasmConfigAnnotation = "networking.istio.io/wasmConfig"
+	// UseHostnameForHashingAnnotation hashes the hostnames of DNS endpoints instead of their IPs.
+	UseHostnameForHashingAnnotation = "networking.istio.io/useHostnameForHashing"
+	// UseDownstreamProtocolAnnotation makes HTTP clusters use the protocol of the downstream connection.
+	UseDownstreamProtocolAnnotation = "networking.istio.io/useDownstreamProtocol"
+)
+
+// DestinationRuleAnnotations holds the parsed cluster settings of the annotations of a DestinationRule. Settings whose
+// annotation is not set, or is invalid, have their zero value.
+type DestinationRuleAnnotations struct {
+	ALPNProtocols                            []string
+	ClientCredentialName                     string
+	SubsetClientCredentialNames              map[string]string
+	CloseConnectionsOnHostHealthFailure      bool
+	ConsistentHashKeys                       []string
+	DefaultPerTryTimeout                     time.Duration
+	DefaultRequestTimeout                    time.Duration
+	DefaultSubset                            string
+	EdsInitialFetchTimeout                   time.Duration
+	EndpointPorts                            map[int]uint32
+	HealthCheckHost                          string
+	LoadBalancerExtension                    string
+	LoadBalancerExtensionConfig              *structpb.Struct
+	MaxConcurrentStreams                     uint32
+	HTTP2InitialStreamWindowSize             uint32
+	HTTP2InitialConnectionWindowSize         uint32
+	MaxConnectionsPerHost                    uint32
+	OutlierEnforcingConsecutive5xx           *wrappers.UInt32Value
+	OutlierEnforcingConsecutiveGatewayErrors *wrappers.UInt32Value
+	OutlierEnforcingSuccessRate              *wrappers.UInt32Value
+	OutlierDetectionOnly                     bool
+	OutlierFailurePercentageThreshold        *wrappers.UInt32Value
+	OutlierFailurePercentageMinimumHosts     *wrappers.UInt32Value
+	OutlierFailurePercentageRequestVolume    *wrappers.UInt32Value
+	OutlierSuccessRateMinimumHosts           *wrappers.UInt32Value
+	OutlierSuccessRateRequestVolume          *wrappers.UInt32Value
+	OutlierSuccessRateStdevFactor            float64
+	PlaintextFallback                        bool
+	RetryBudget                              float64
+	HighPriorityRetryBudget                  float64
+	StatName                                 string
+	StatsHistogramBuckets                    string
+	StatsTags                                *structpb.Struct
+	WasmConfig                               *structpb.Struct
+	UseHostnameForHashing                    bool
+	UseDownstreamProtocol                    bool
+}
+
+// GetDestinationRuleAnnotations returns the parsed annotations of the destination rule, logging the invalid ones.
+func GetDestinationRuleAnnotations(destRule *Config) *DestinationRuleAnnotations {
+	if destRule == nil {
+		return &DestinationRuleAnnotations{}
+	}
+	out, err := ParseDestinationRuleAnnotations(destRule.Annotations)
+	if err != nil {
+		log.Warnf("ignoring invalid annotations on destination rule %s/%s: %v", destRule.Namespace, destRule.Name, err)
+	}
+	return out
+}
+
+// ParseDestinationRuleAnnotations parses the cluster settings of the annotations of a DestinationRule. Invalid
+// annotations are left unset, and reported in the returned error.
+func ParseDestinationRuleAnnotations(annotations map[string]string) (*DestinationRuleAnnotations, error) {
+	p := &annotationParser{annotations: annotations}
+	out := &DestinationRuleAnnotations{
+		ALPNProtocols:                            p.listValue(ALPNProtocolsAnnotation),
+		ClientCredentialName:                     p.stringValue(ClientCredentialNameAnnotation),
+		SubsetClientCredentialNames:              p.subsetClientCredentialNames(),
+		CloseConnectionsOnHostHealthFailure:      p.boolValue(CloseConnectionsOnHostHealthFailureAnnotation),
+		ConsistentHashKeys:                       p.consistentHashKeys(),
+		DefaultPerTryTimeout:                     p.durationValue(DefaultPerTryTimeoutAnnotation),
+		DefaultRequestTimeout:                    p.durationValue(DefaultRequestTimeoutAnnotation),
+		DefaultSubset:                            p.stringValue(DefaultSubsetAnnotation),
+		EdsInitialFetchTimeout:                   p.durationValue(EdsInitialFetchTimeoutAnnotation),
+		EndpointPorts:                            p.endpointPorts(),
+		HealthCheckHost:                          p.stringValue(HealthCheckHostAnnotation),
+		LoadBalancerExtension:                    p.stringValue(LoadBalancerExtensionAnnotation),
+		LoadBalancerExtensionConfig:              p.jsonValue(LoadBalancerExtensionConfigAnnotation),
+		MaxConcurrentStreams:                     p.uint32Value(MaxConcurrentStreamsAnnotation, 1, math.MaxUint32).GetValue(),
+		HTTP2InitialStreamWindowSize:             p.uint32Value(HTTP2InitialStreamWindowSizeAnnotation, 65535, math.MaxInt32).GetValue(),
+		HTTP2InitialConnectionWindowSize:         p.uint32Value(HTTP2InitialConnectionWindowSizeAnnotation, 65535, math.MaxInt32).GetValue(),
+		MaxConnectionsPerHost:                    p.uint32Value(MaxConnectionsPerHostAnnotation, 1, math.MaxUint32).GetValue(),
+		OutlierEnforcingConsecutive5xx:           p.uint32Value(OutlierEnforcingConsecutive5xxAnnotation, 0, 100),
+		OutlierEnforcingConsecutiveGatewayErrors: p.uint32Value(OutlierEnforcingConsecutiveGatewayErrorsAnnotation, 0, 100),
+		OutlierEnforcingSuccessRate:              p.uint32Value(OutlierEnforcingSuccessRateAnnotation, 0, 100),
+		OutlierDetectionOnly:                     p.boolValue(OutlierDetectionOnlyAnnotation),
+		OutlierFailurePercentageThreshold:        p.uint32Value(OutlierFailurePercentageThresholdAnnotation, 0, 100),
+		OutlierFailurePercentageMinimumHosts:     p.uint32Value(OutlierFailurePercentageMinimumHostsAnnotation, 0, math.MaxUint32),
+		OutlierFailurePercentageRequestVolume:    p.uint32Value(OutlierFailurePercentageRequestVolumeAnnotation, 0, math.MaxUint32),
+		OutlierSuccessRateMinimumHosts:           p.uint32Value(OutlierSuccessRateMinimumHostsAnnotation, 0, math.MaxUint32),
+		OutlierSuccessRateRequestVolume:          p.uint32Value(OutlierSuccessRateRequestVolumeAnnotation, 0, math.MaxUint32),
+		OutlierSuccessRateStdevFactor:            p.floatValue(OutlierSuccessRateStdevFactorAnnotation, math.MaxFloat64),
+		PlaintextFallback:                        p.boolValue(PlaintextFallbackAnnotation),
+		RetryBudget:                              p.floatValue(RetryBudgetAnnotation, 100),
+		HighPriorityRetryBudget:                  p.floatValue(HighPriorityRetryBudgetAnnotation, 100),
+		StatName:                                 p.stringValue(StatNameAnnotation),
+		StatsHistogramBuckets:                    p.stringValue(StatsHistogramBucketsAnnotation),
+		StatsTags:                                p.jsonValue(StatsTagsAnnotation),
+		WasmConfig:                               p.jsonValue(WasmConfigAnnotation),
+		UseHostnameForHashing:                    p.boolValue(UseHostnameForHashingAnnotation),
+		UseDownstreamProtocol:                    p.boolValue(UseDownstreamProtocolAnnotation),
+	}
+	if value, ok := annotations[DefaultSubsetAnnotation]; ok && out.DefaultSubset == "" {
+		p.invalid(DefaultSubsetAnnotation, value, "empty subset name")
+	}
+	if value, ok := annotations[LoadBalancerExtensionAnnotation]; ok && out.LoadBalancerExtension == "" {
+		p.invalid(LoadBalancerExtensionAnnotation, value, "empty extension name")
+	}
+	if _, ok := annotations[LoadBalancerExtensionConfigAnnotation]; ok {
+		if out.LoadBalancerExtension == "" {
+			p.errs = multierror.Append(p.errs, fmt.Errorf("%s annotation requires the %s annotation",
+				LoadBalancerExtensionConfigAnnotation, LoadBalancerExtensionAnnotation))
+		}
+		// The extension is not used without its config.
+		if out.LoadBalancerExtension == "" || out.LoadBalancerExtensionConfig == nil {
+			out.LoadBalancerExtension = ""
+			out.LoadBalancerExtensionConfig = nil
+		}
+	}
+	return out, p.errs
+}
+
+// annotationParser parses the values of annotations, collecting an error for each invalid one.
+type annotationParser struct {
+	annotations map[string]string
+	errs        error
+}
+
+func (p *annotationParser) invalid(annotation, value, reason string) {
+	p.errs = multierror.Append(p.errs, fmt.Errorf("invalid %s annotation %q: %s", annotation, value, reason))
+}
+
+func (p *annotationParser) stringValue(annotation string) string {
+	return strings.TrimSpace(p.annotations[annotation])
+}
+
+func (p *annotationParser) listValue(annotation string) []string {
+	var out []string
+	for _, item := range strings.Split(p.annotations[annotation], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func (p *annotationParser) boolValue(annotation string) bool {
+	value, ok := p.annotations[annotation]
+	if !ok {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.invalid(annotation, value, "not a boolean")
+		return false
+	}
+	return b
+}
+
+// uint32Value parses an unsigned integer in [min, max]. It returns nil if the annotation is not set or invalid.
+func (p *annotationParser) uint32Value(annotation string, min, max uint64) *wrappers.UInt32Value {
+	value, ok := p.annotations[annotation]
+	if !ok {
+		return nil
+	}
+	v, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || v < min || v > max {
+		p.invalid(annotation, value, fmt.Sprintf("not an integer from %d to %d", min, max))
+		return nil
+	}
+	return &wrappers.UInt32Value{Value: uint32(v)}
+}
+
+// floatValue parses a number in (0, max]. It returns 0 if the annotation is not set or invalid.
+func (p *annotationParser) floatValue(annotation string, max float64) float64 {
+	value, ok := p.annotations[annotation]
+	if !ok {
+		return 0
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v <= 0 || v > max {
+		p.invalid(annotation, value, "not a positive number in range")
+		return 0
+	}
+	return v
+}
+
+func (p *annotationParser) durationValue(annotation string) time.Duration {
+	value, ok := p.annotations[annotation]
+	if !ok {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		p.invalid(annotation, value, "not a positive duration")
+		return 0
+	}
+	return d
+}
+
+func (p *annotationParser) jsonValue(annotation string) *structpb.Struct {
+	value, ok := p.annotations[annotation]
+	if !ok {
+		return nil
+	}
+	pbs := &structpb.Struct{}
+	if err := jsonpb.UnmarshalString(value, pbs); err != nil {
+		p.invalid(annotation, value, err.Error())
+		return nil
+	}
+	return pbs
+}
+
+// subsetClientCredentialNames parses the <subset>=<secret> entries of the subsetClientCredentialNames annotation.
+func (p *annotationParser) subsetClientCredentialNames() map[string]string {
+	value, ok := p.annotations[SubsetClientCredentialNamesAnnotation]
+	if !ok {
+		return nil
+	}
+	out := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			p.invalid(SubsetClientCredentialNamesAnnotation, value, fmt.Sprintf("invalid entry %q", entry))
+			continue
+		}
+		out[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return out
+}
+
+// endpointPorts parses the <service port>=<endpoint port> entries of the endpointPorts annotation.
+func (p *annotationParser) endpointPorts() map[int]uint32 {
+	value, ok := p.annotations[EndpointPortsAnnotation]
+	if !ok {
+		return nil
+	}
+	out := make(map[int]uint32)
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			p.invalid(EndpointPortsAnnotation, value, fmt.Sprintf("invalid entry %q", entry))
+			continue
+		}
+		from, fromErr := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+		to, toErr := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+		if fromErr != nil || toErr != nil || from == 0 || to == 0 {
+			p.invalid(EndpointPortsAnnotation, value, fmt.Sprintf("invalid entry %q", entry))
+			continue
+		}
+		out[int(from)] = uint32(to)
+	}
+	return out
+}
+
+// consistentHashKeys parses the hash keys of the consistentHashKeys annotation, keeping their order.
+func (p *annotationParser) consistentHashKeys() []string {
+	value, ok := p.annotations[ConsistentHashKeysAnnotation]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0)
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "sourceIP" {
+			keys = append(keys, key)
+			continue
+		}
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			p.invalid(ConsistentHashKeysAnnotation, value, fmt.Sprintf("invalid hash key %q", key))
+			return nil
+		}
+		switch parts[0] {
+		case "header", "cookie", "queryParameter":
+			keys = append(keys, key)
+		default:
+			p.invalid(ConsistentHashKeysAnnotation, value, fmt.Sprintf("invalid hash key %q", key))
+			return nil
+		}
+	}
+	return keys
+}
+
 // This function merges one or more destination rules for a given host string
 // into a single destination rule. Note that it does not perform inheritance style merging.
 // IOW, given three dest rules (*.foo.com, *.foo.com, *.com), calling this function for
@@ -48,10 +414,9 @@ func (ps *PushContext) combineSingleDestinationRule(
 			}
 		}
 		// If there is no top level policy and the incoming rule has top level
-		// traffic policy, use the one from the incoming rule.
-		if combinedRule.TrafficPolicy == nil && rule.TrafficPolicy != nil {
-			combinedRule.TrafficPolicy = rule.TrafficPolicy
-		}
+		// traffic policy, use the one from the incoming rule. If both have one,
+		// the settings left unset by the existing policy are taken from the incoming rule.
+		combinedRule.TrafficPolicy = mergeTrafficPolicy(combinedRule.TrafficPolicy, rule.TrafficPolicy)
 		return combinedDestRuleHosts
 	}
 
@@ -76,3 +441,31 @@ func (ps *PushContext) combineSingleDestinationRule(
 
 	return combinedDestRuleHosts
 }
+
+// mergeTrafficPolicy merges two traffic policies field by field. Settings of the base policy take
+// precedence, settings it leaves unset are taken from the incoming policy. Neither input is modified.
+func mergeTrafficPolicy(base, incoming *networking.TrafficPolicy) *networking.TrafficPolicy {
+	if base == nil {
+		return incoming
+	}
+	if incoming == nil {
+		return base
+	}
+	merged := *base
+	if merged.ConnectionPool == nil {
+		merged.ConnectionPool = incoming.ConnectionPool
+	}
+	if merged.LoadBalancer == nil {
+		merged.LoadBalancer = incoming.LoadBalancer
+	}
+	if merged.OutlierDetection == nil {
+		merged.OutlierDetection = incoming.OutlierDetection
+	}
+	if merged.Tls == nil {
+		merged.Tls = incoming.Tls
+	}
+	if len(merged.PortLevelSettings) == 0 {
+		merged.PortLevelSettings = incoming.PortLevelSettings
+	}
+	return &merged
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func TestParseDestinationRuleAnnotations(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		expected    *DestinationRuleAnnotations
+		expectedErr bool
+	}{
+		{
+			name:     "no annotations",
+			expected: &DestinationRuleAnnotations{},
+		},
+		{
+			name: "valid annotations",
+			annotations: map[string]string{
+				ALPNProtocolsAnnotation:                  "h2, http/1.1",
+				SubsetClientCredentialNamesAnnotation:    "v1=foo-v1, v2 = foo-v2",
+				ConsistentHashKeysAnnotation:             "header:x-user, sourceIP",
+				DefaultPerTryTimeoutAnnotation:           "2s",
+				DefaultRequestTimeoutAnnotation:          "5s",
+				DefaultSubsetAnnotation:                  "v1",
+				EdsInitialFetchTimeoutAnnotation:         "5s",
+				EndpointPortsAnnotation:                  "9090=9091, 8080 = 15001",
+				HTTP2InitialStreamWindowSizeAnnotation:   "65535",
+				OutlierEnforcingConsecutive5xxAnnotation: "0",
+				OutlierSuccessRateStdevFactorAnnotation:  "1.5",
+				RetryBudgetAnnotation:                    "20",
+				StatsTagsAnnotation:                      `{"team": "payments"}`,
+				UseDownstreamProtocolAnnotation:          "true",
+			},
+			expected: &DestinationRuleAnnotations{
+				ALPNProtocols:                  []string{"h2", "http/1.1"},
+				SubsetClientCredentialNames:    map[string]string{"v1": "foo-v1", "v2": "foo-v2"},
+				ConsistentHashKeys:             []string{"header:x-user", "sourceIP"},
+				DefaultPerTryTimeout:           2 * time.Second,
+				DefaultRequestTimeout:          5 * time.Second,
+				DefaultSubset:                  "v1",
+				EdsInitialFetchTimeout:         5 * time.Second,
+				EndpointPorts:                  map[int]uint32{9090: 9091, 8080: 15001},
+				HTTP2InitialStreamWindowSize:   65535,
+				OutlierEnforcingConsecutive5xx: &wrappers.UInt32Value{Value: 0},
+				OutlierSuccessRateStdevFactor:  1.5,
+				RetryBudget:                    20,
+				StatsTags: &structpb.Struct{Fields: map[string]*structpb.Value{
+					"team": {Kind: &structpb.Value_StringValue{StringValue: "payments"}},
+				}},
+				UseDownstreamProtocol: true,
+			},
+		},
+		{
+			name: "invalid annotations",
+			annotations: map[string]string{
+				ConsistentHashKeysAnnotation:             "header:x-user,body",
+				DefaultPerTryTimeoutAnnotation:           "-1s",
+				DefaultRequestTimeoutAnnotation:          "0s",
+				DefaultSubsetAnnotation:                  "",
+				EdsInitialFetchTimeoutAnnotation:         "soon",
+				HTTP2InitialStreamWindowSizeAnnotation:   "1024",
+				OutlierEnforcingConsecutive5xxAnnotation: "150",
+				RetryBudgetAnnotation:                    "0",
+				StatsTagsAnnotation:                      "team=payments",
+				UseDownstreamProtocolAnnotation:          "yes",
+			},
+			expected:    &DestinationRuleAnnotations{},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid subset client credential entries are skipped",
+			annotations: map[string]string{SubsetClientCredentialNamesAnnotation: "v1=foo-v1,v2"},
+			expected: &DestinationRuleAnnotations{
+				SubsetClientCredentialNames: map[string]string{"v1": "foo-v1"},
+			},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid endpoint port entries are skipped",
+			annotations: map[string]string{EndpointPortsAnnotation: "9090=9091,8080=http,0=80"},
+			expected: &DestinationRuleAnnotations{
+				EndpointPorts: map[int]uint32{9090: 9091},
+			},
+			expectedErr: true,
+		},
+		{
+			name:        "load balancer extension config without extension",
+			annotations: map[string]string{LoadBalancerExtensionConfigAnnotation: `{"mode": "sticky"}`},
+			expected:    &DestinationRuleAnnotations{},
+			expectedErr: true,
+		},
+		{
+			name: "load balancer extension with invalid config",
+			annotations: map[string]string{
+				LoadBalancerExtensionAnnotation:       "envoy.lb.custom",
+				LoadBalancerExtensionConfigAnnotation: "mode=sticky",
+			},
+			expected:    &DestinationRuleAnnotations{},
+			expectedErr: true,
+		},
+		{
+			name:        "empty load balancer extension",
+			annotations: map[string]string{LoadBalancerExtensionAnnotation: " "},
+			expected:    &DestinationRuleAnnotations{},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDestinationRuleAnnotations(tt.annotations)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Unexpected error %v, expected error: %v", err, tt.expectedErr)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Unexpected annotations, got: %+v, want: %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetDestinationRuleAnnotations(t *testing.T) {
+	if got := GetDestinationRuleAnnotations(nil); !reflect.DeepEqual(got, &DestinationRuleAnnotations{}) {
+		t.Errorf("Unexpected annotations of a nil destination rule: %+v", got)
+	}
+	destRule := &Config{ConfigMeta: ConfigMeta{
+		Name:        "foo",
+		Namespace:   "default",
+		Annotations: map[string]string{PlaintextFallbackAnnotation: "true", MaxConnectionsPerHostAnnotation: "0"},
+	}}
+	expected := &DestinationRuleAnnotations{PlaintextFallback: true}
+	if got := GetDestinationRuleAnnotations(destRule); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected annotations, got: %+v, want: %+v", got, expected)
+	}
+}
@@ -343,6 +343,9 @@ func (ps *PushContext) AddMetric(metric monitoring.Metric, key string, proxy *Pr
 	ps.proxyStatusMutex.Lock()
 	defer ps.proxyStatusMutex.Unlock()
 
+	if ps.ProxyStatus == nil {
+		ps.ProxyStatus = map[string]map[string]ProxyPushStatus{}
+	}
 	metricMap, f := ps.ProxyStatus[metric.Name()]
 	if !f {
 		metricMap = map[string]ProxyPushStatus{}
@@ -456,6 +459,13 @@ var (
 		"Duplicate subsets across destination rules for same host",
 	)
 
+	// MissingSubsets tracks virtual service destinations that route to a subset not defined by any destination rule
+	// of the host.
+	MissingSubsets = monitoring.NewGauge(
+		"pilot_vservice_missing_subsets",
+		"Virtual service destinations with subsets missing from the destination rules of the host.",
+	)
+
 	// totalVirtualServices tracks the total number of virtual service
 	totalVirtualServices = monitoring.NewGauge(
 		"pilot_virt_services",
@@ -483,6 +493,7 @@ var (
 		ProxyStatusClusterNoInstances,
 		DuplicatedDomains,
 		DuplicatedSubsets,
+		MissingSubsets,
 	}
 )
 
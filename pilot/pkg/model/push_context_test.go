@@ -905,3 +905,114 @@ func TestSetDestinationRule(t *testing.T) {
 		t.Fatalf("want %d, but got %d", 2, subsetsExport)
 	}
 }
+
+func TestSetDestinationRuleMergesTrafficPolicy(t *testing.T) {
+	ps := NewPushContext()
+	ps.defaultDestinationRuleExportTo = map[visibility.Instance]bool{visibility.Public: true}
+	testhost := "test.test-namespace1.svc.cluster.local"
+	connectionPool := &networking.ConnectionPoolSettings{
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+	}
+	outlierDetection := &networking.OutlierDetection{ConsecutiveErrors: 5}
+	destinationRule1 := Config{
+		ConfigMeta: ConfigMeta{
+			Name:      "rule1",
+			Namespace: "test-namespace1",
+		},
+		Spec: &networking.DestinationRule{
+			Host: testhost,
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: connectionPool,
+			},
+		},
+	}
+	destinationRule2 := Config{
+		ConfigMeta: ConfigMeta{
+			Name:      "rule2",
+			Namespace: "test-namespace1",
+		},
+		Spec: &networking.DestinationRule{
+			Host: testhost,
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 20},
+				},
+				OutlierDetection: outlierDetection,
+			},
+		},
+	}
+	ps.SetDestinationRules([]Config{destinationRule1, destinationRule2})
+
+	merged := ps.namespaceLocalDestRules["test-namespace1"].destRule[host.Name(testhost)].config.Spec.(*networking.DestinationRule)
+	if merged.TrafficPolicy.ConnectionPool != connectionPool {
+		t.Errorf("want connection pool of the first rule, got %v", merged.TrafficPolicy.ConnectionPool)
+	}
+	if merged.TrafficPolicy.OutlierDetection != outlierDetection {
+		t.Errorf("want outlier detection of the second rule, got %v", merged.TrafficPolicy.OutlierDetection)
+	}
+	if destinationRule1.Spec.(*networking.DestinationRule).TrafficPolicy.OutlierDetection != nil {
+		t.Errorf("merging must not modify the original destination rule")
+	}
+}
+
+func TestNamespaceWideDestinationRuleConnectionPool(t *testing.T) {
+	ps := NewPushContext()
+	ps.Mesh = &meshconfig.MeshConfig{RootNamespace: "istio-system"}
+	ps.defaultDestinationRuleExportTo = map[visibility.Instance]bool{visibility.Public: true}
+	overrideHost := "override.test-namespace2.svc.cluster.local"
+	namespaceDefault := Config{
+		ConfigMeta: ConfigMeta{
+			Name:      "default",
+			Namespace: "test-namespace1",
+		},
+		Spec: &networking.DestinationRule{
+			Host: "*",
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+				},
+			},
+		},
+	}
+	serviceOverride := Config{
+		ConfigMeta: ConfigMeta{
+			Name:      "override",
+			Namespace: "test-namespace1",
+		},
+		Spec: &networking.DestinationRule{
+			Host: overrideHost,
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 20},
+				},
+			},
+		},
+	}
+	ps.SetDestinationRules([]Config{namespaceDefault, serviceOverride})
+
+	proxy := &Proxy{Type: SidecarProxy, ConfigNamespace: "test-namespace1"}
+	cases := []struct {
+		hostname       string
+		maxConnections int32
+	}{
+		// Without a rule for the service, the namespace wide rule of the proxy applies.
+		{hostname: "other.test-namespace2.svc.cluster.local", maxConnections: 10},
+		{hostname: overrideHost, maxConnections: 20},
+	}
+	for _, c := range cases {
+		t.Run(c.hostname, func(t *testing.T) {
+			service := &Service{
+				Hostname:   host.Name(c.hostname),
+				Attributes: ServiceAttributes{Namespace: "test-namespace2"},
+			}
+			cfg := ps.DestinationRule(proxy, service)
+			if cfg == nil {
+				t.Fatalf("expected a destination rule for %s", c.hostname)
+			}
+			got := cfg.Spec.(*networking.DestinationRule).TrafficPolicy.ConnectionPool.Tcp.MaxConnections
+			if got != c.maxConnections {
+				t.Errorf("want max connections %d, got %d", c.maxConnections, got)
+			}
+		})
+	}
+}
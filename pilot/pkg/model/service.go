@@ -313,6 +313,51 @@ type IstioEndpoint struct {
 
 	// TLSMode endpoint is injected with istio sidecar and ready to configure Istio mTLS
 	TLSMode string
+
+	// Draining is set while the workload is shutting down. Draining endpoints are weighted down, so that they
+	// stop receiving new requests while other endpoints are available, instead of being removed abruptly.
+	Draining bool
+}
+
+// DrainingLabel can be set to "true" on a workload that is shutting down, to mark its endpoints as Draining.
+const DrainingLabel = "networking.istio.io/draining"
+
+// DrainingSinceLabel can be set on a workload to the Unix time, in seconds, at which it started shutting down. Its
+// endpoints are draining for the endpoint draining grace period from then on, and removed afterwards.
+const DrainingSinceLabel = "networking.istio.io/drainingSince"
+
+// EndpointDrainingState is the state of an endpoint of a workload that may be shutting down.
+type EndpointDrainingState int
+
+const (
+	// EndpointActive endpoints receive requests as usual.
+	EndpointActive EndpointDrainingState = iota
+	// EndpointDraining endpoints only receive requests while no other endpoints are available.
+	EndpointDraining
+	// EndpointDrained endpoints have been draining for longer than the grace period, and are no longer sent.
+	EndpointDrained
+)
+
+// DrainingState returns the state at the given time of the endpoints of a workload with the given labels, and for
+// workloads within their grace period the time left until they are drained. Workloads with the DrainingLabel are
+// draining. With a grace period, workloads with the DrainingSinceLabel are draining until the grace period has passed
+// since, and drained afterwards. Without one, that label is ignored. Registries set Draining on the endpoints of
+// draining workloads, leave out the endpoints of drained ones, and update them when the grace period ends.
+func DrainingState(workloadLabels labels.Instance, now time.Time, gracePeriod time.Duration) (EndpointDrainingState, time.Duration) {
+	if value, ok := workloadLabels[DrainingSinceLabel]; ok && gracePeriod > 0 {
+		since, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Warnf("ignoring invalid %s label %q", DrainingSinceLabel, value)
+		} else if remaining := time.Unix(since, 0).Add(gracePeriod).Sub(now); remaining <= 0 {
+			return EndpointDrained, 0
+		} else {
+			return EndpointDraining, remaining
+		}
+	}
+	if workloadLabels[DrainingLabel] == "true" {
+		return EndpointDraining, 0
+	}
+	return EndpointActive, 0
 }
 
 // ServiceAttributes represents a group of custom attributes of the service.
@@ -16,6 +16,7 @@ package model
 
 import (
 	"testing"
+	"time"
 
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
@@ -167,6 +168,36 @@ func TestParseSubsetKey(t *testing.T) {
 	}
 }
 
+func TestParseSubsetKeyRoundTrip(t *testing.T) {
+	builders := map[string]func(TrafficDirection, string, host.Name, int) string{
+		"default cluster mode":  BuildSubsetKey,
+		"sni-dnat cluster mode": BuildDNSSrvSubsetKey,
+	}
+	keys := []struct {
+		direction  TrafficDirection
+		subsetName string
+		hostname   host.Name
+		port       int
+	}{
+		{TrafficDirectionOutbound, "", "foo.default.svc.cluster.local", 8080},
+		{TrafficDirectionOutbound, "v1", "foo.default.svc.cluster.local", 8080},
+		{TrafficDirectionOutbound, "v1", "*.example.org", 443},
+		{TrafficDirectionInbound, "", "foo.default.svc.cluster.local", 9090},
+	}
+
+	for name, build := range builders {
+		for _, k := range keys {
+			key := build(k.direction, k.subsetName, k.hostname, k.port)
+			t.Run(name+"/"+key, func(t *testing.T) {
+				d, s, h, p := ParseSubsetKey(key)
+				if d != k.direction || s != k.subsetName || h != k.hostname || p != k.port {
+					t.Errorf("Expected %v, %q, %v, %v got %v, %q, %v, %v", k.direction, k.subsetName, k.hostname, k.port, d, s, h, p)
+				}
+			})
+		}
+	}
+}
+
 func TestIsValidSubsetKey(t *testing.T) {
 	cases := []struct {
 		subsetkey string
@@ -243,3 +274,65 @@ func BenchmarkBuildSubsetKey(b *testing.B) {
 		_ = BuildSubsetKey(TrafficDirectionInbound, "v1", "someHost", 80)
 	}
 }
+
+func TestDrainingState(t *testing.T) {
+	now := time.Unix(1000, 0)
+	gracePeriod := 30 * time.Second
+
+	cases := []struct {
+		name              string
+		labels            labels.Instance
+		gracePeriod       time.Duration
+		expected          EndpointDrainingState
+		expectedRemaining time.Duration
+	}{
+		{
+			name:        "active",
+			gracePeriod: gracePeriod,
+			expected:    EndpointActive,
+		},
+		{
+			name:        "labeled as draining",
+			labels:      labels.Instance{DrainingLabel: "true"},
+			gracePeriod: gracePeriod,
+			expected:    EndpointDraining,
+		},
+		{
+			name:              "within the grace period",
+			labels:            labels.Instance{DrainingSinceLabel: "980"},
+			gracePeriod:       gracePeriod,
+			expected:          EndpointDraining,
+			expectedRemaining: 10 * time.Second,
+		},
+		{
+			name:        "past the grace period",
+			labels:      labels.Instance{DrainingSinceLabel: "970"},
+			gracePeriod: gracePeriod,
+			expected:    EndpointDrained,
+		},
+		{
+			name:        "without a grace period",
+			labels:      labels.Instance{DrainingSinceLabel: "970"},
+			gracePeriod: 0,
+			expected:    EndpointActive,
+		},
+		{
+			name:        "invalid label",
+			labels:      labels.Instance{DrainingSinceLabel: "yesterday"},
+			gracePeriod: gracePeriod,
+			expected:    EndpointActive,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, remaining := DrainingState(tt.labels, now, tt.gracePeriod)
+			if got != tt.expected {
+				t.Errorf("Unexpected draining state, want %v, got %v", tt.expected, got)
+			}
+			if remaining != tt.expectedRemaining {
+				t.Errorf("Unexpected remaining grace period, want %v, got %v", tt.expectedRemaining, remaining)
+			}
+		})
+	}
+}
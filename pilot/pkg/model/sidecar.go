@@ -17,6 +17,7 @@ package model
 import (
 	"sort"
 	"strings"
+	"time"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 
@@ -25,6 +26,19 @@ import (
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/util/gogoprotomarshal"
+)
+
+const (
+	// SidecarOutboundConnectionPoolAnnotation can be set on a Sidecar to the JSON encoded connection pool settings
+	// that the outbound clusters of its workloads use, unless a DestinationRule sets connection pool settings of its
+	// own.
+	SidecarOutboundConnectionPoolAnnotation = "networking.istio.io/outboundConnectionPool"
+
+	// SidecarOutboundConnectTimeoutAnnotation can be set on a Sidecar to the connect timeout of the outbound clusters
+	// of its workloads, e.g. "2s". It replaces the mesh wide connect timeout, and is overridden by the connect timeout
+	// of a DestinationRule.
+	SidecarOutboundConnectTimeoutAnnotation = "networking.istio.io/outboundConnectTimeout"
 )
 
 const (
@@ -93,6 +107,14 @@ type SidecarScope struct {
 	// be forwarded.
 	OutboundTrafficPolicy *networking.OutboundTrafficPolicy
 
+	// OutboundConnectionPool defines the default connection pool settings of the outbound clusters of this sidecar.
+	// It is nil if the Sidecar does not set any.
+	OutboundConnectionPool *networking.ConnectionPoolSettings
+
+	// OutboundConnectTimeout is the connect timeout of the outbound clusters of this sidecar. It is zero if the
+	// Sidecar does not set one.
+	OutboundConnectTimeout time.Duration
+
 	// Set of all namespaces this sidecar depends on. This is determined from the egress config
 	namespaceDependencies map[string]struct{}
 }
@@ -305,6 +327,25 @@ func ConvertToSidecarScope(ps *PushContext, sidecarConfig *Config, configNamespa
 		out.OutboundTrafficPolicy = r.OutboundTrafficPolicy
 	}
 
+	if value, ok := sidecarConfig.Annotations[SidecarOutboundConnectionPoolAnnotation]; ok {
+		connectionPool := &networking.ConnectionPoolSettings{}
+		if err := gogoprotomarshal.ApplyJSON(value, connectionPool); err != nil {
+			log.Warnf("ignoring invalid %s annotation on sidecar %s/%s: %v",
+				SidecarOutboundConnectionPoolAnnotation, sidecarConfig.Namespace, sidecarConfig.Name, err)
+		} else {
+			out.OutboundConnectionPool = connectionPool
+		}
+	}
+
+	if value, ok := sidecarConfig.Annotations[SidecarOutboundConnectTimeoutAnnotation]; ok {
+		if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+			log.Warnf("ignoring invalid %s annotation %q on sidecar %s/%s",
+				SidecarOutboundConnectTimeoutAnnotation, value, sidecarConfig.Namespace, sidecarConfig.Name)
+		} else {
+			out.OutboundConnectTimeout = timeout
+		}
+	}
+
 	out.Config = sidecarConfig
 	if len(r.Ingress) > 0 {
 		out.HasCustomIngressListeners = true
@@ -16,17 +16,26 @@ package v1alpha3
 
 import (
 	"fmt"
+	"hash/fnv"
 	"math"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	v2Cluster "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	dfpcluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/dynamic_forward_proxy/v2alpha"
+	dfpcommon "github.com/envoyproxy/go-control-plane/envoy/config/common/dynamic_forward_proxy/v2alpha"
 	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
 	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
 	structpb "github.com/golang/protobuf/ptypes/struct"
 	"github.com/golang/protobuf/ptypes/wrappers"
 
@@ -47,6 +56,7 @@ import (
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/spiffe"
 	"istio.io/istio/pkg/util/gogo"
 )
 
@@ -54,8 +64,18 @@ const (
 	// DefaultLbType set to round robin
 	DefaultLbType = networking.LoadBalancerSettings_ROUND_ROBIN
 
+	// DynamicForwardProxyDNSCacheName is the name of the DNS cache shared by dynamic forward proxy clusters and the
+	// dynamic forward proxy HTTP filter.
+	DynamicForwardProxyDNSCacheName = "istio_dynamic_forward_proxy"
+
 	// ManagementClusterHostname indicates the hostname used for building inbound clusters for management ports
 	ManagementClusterHostname = "mgmtCluster"
+
+	// defaultBaseEjectionTime is the Envoy default for the outlier detection base ejection time.
+	defaultBaseEjectionTime = 30 * time.Second
+
+	// wasmMetadataKey is the cluster filter metadata key that holds the WASM config of a destination.
+	wasmMetadataKey = "envoy.filters.http.wasm"
 )
 
 var (
@@ -87,9 +107,34 @@ var (
 // getDefaultCircuitBreakerThresholds returns a copy of the default circuit breaker thresholds for the given traffic direction.
 func getDefaultCircuitBreakerThresholds() *v2Cluster.CircuitBreakers_Thresholds {
 	thresholds := defaultCircuitBreakerThresholds
+	if maxRetries := features.DefaultCircuitBreakerMaxRetries.Get(); maxRetries > 0 {
+		thresholds.MaxRetries = &wrappers.UInt32Value{Value: uint32(maxRetries)}
+	}
+	if maxPendingRequests := features.DefaultCircuitBreakerMaxPendingRequests.Get(); maxPendingRequests > 0 {
+		thresholds.MaxPendingRequests = &wrappers.UInt32Value{Value: uint32(maxPendingRequests)}
+	}
 	return &thresholds
 }
 
+// outboundClusterStatName returns the stat name pattern of the outbound clusters of the service. Clusters of services
+// external to the mesh use the external cluster stat name pattern, if one is configured, to keep their stats apart
+// from the ones of the mesh.
+func outboundClusterStatName(push *model.PushContext, service *model.Service) string {
+	if externalStatName := features.ExternalClusterStatName.Get(); service.MeshExternal && externalStatName != "" {
+		return externalStatName
+	}
+	return push.Mesh.OutboundClusterStatName
+}
+
+// destinationRuleStatName returns the stat name pattern of the outbound clusters of the service, as set by the
+// statName annotation of its destination rule, or the default pattern of the service otherwise.
+func destinationRuleStatName(push *model.PushContext, service *model.Service, statName string) string {
+	if statName != "" {
+		return statName
+	}
+	return outboundClusterStatName(push, service)
+}
+
 // BuildClusters returns the list of clusters for the given proxy. This is the CDS output
 // For outbound: Cluster for each service/subset hostname or cidr with SNI set to service hostname
 // Cluster type based on resolution
@@ -105,7 +150,11 @@ func (configgen *ConfigGeneratorImpl) BuildClusters(proxy *model.Proxy, push *mo
 	case model.SidecarProxy:
 		// Add a blackhole and passthrough cluster for catching traffic to unresolved routes
 		// DO NOT CALL PLUGINS for these two clusters.
-		outboundClusters = append(outboundClusters, cb.buildBlackHoleCluster(), cb.buildDefaultPassthroughCluster())
+		outboundClusters = append(outboundClusters, cb.buildBlackHoleCluster())
+		// The passthrough cluster is not referenced when traffic to unknown destinations is blocked.
+		if util.IsAllowAnyOutbound(proxy) {
+			outboundClusters = append(outboundClusters, cb.buildOutboundPassthroughCluster())
+		}
 		outboundClusters = envoyfilter.ApplyClusterPatches(networking.EnvoyFilter_SIDECAR_OUTBOUND, proxy, push, outboundClusters)
 		// Let ServiceDiscovery decide which IP and Port are used for management if
 		// there are multiple IPs
@@ -142,6 +191,7 @@ func normalizeClusters(metrics model.Metrics, proxy *model.Proxy, clusters []*ap
 	out := make([]*apiv2.Cluster, 0, len(clusters))
 	for _, cluster := range clusters {
 		if !have[cluster.Name] {
+			applyHealthCheckLbConfig(cluster)
 			out = append(out, cluster)
 		} else {
 			metrics.AddMetric(model.DuplicatedClusters, cluster.Name, proxy,
@@ -152,6 +202,56 @@ func normalizeClusters(metrics model.Metrics, proxy *model.Proxy, clusters []*ap
 	return out
 }
 
+// ClusterHash returns a hash of the cluster that only changes with the configuration of the cluster. The order of
+// the localities of the load assignment and of the endpoints within a locality is not significant to Envoy, so two
+// clusters that only differ in it hash the same. The cluster itself is not modified.
+func ClusterHash(cluster *apiv2.Cluster) (uint64, error) {
+	normalized := proto.Clone(cluster).(*apiv2.Cluster)
+	if la := normalized.GetLoadAssignment(); la != nil {
+		for _, llb := range la.Endpoints {
+			sort.SliceStable(llb.LbEndpoints, func(i, j int) bool {
+				return lbEndpointKey(llb.LbEndpoints[i]) < lbEndpointKey(llb.LbEndpoints[j])
+			})
+		}
+		sort.SliceStable(la.Endpoints, func(i, j int) bool {
+			if la.Endpoints[i].Priority != la.Endpoints[j].Priority {
+				return la.Endpoints[i].Priority < la.Endpoints[j].Priority
+			}
+			return util.LocalityToString(la.Endpoints[i].Locality) < util.LocalityToString(la.Endpoints[j].Locality)
+		})
+	}
+
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(normalized); err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(buf.Bytes())
+	return h.Sum64(), nil
+}
+
+// lbEndpointKey returns the address of an endpoint, which orders the endpoints of a locality for ClusterHash.
+func lbEndpointKey(ep *endpoint.LbEndpoint) string {
+	socketAddress := ep.GetEndpoint().GetAddress().GetSocketAddress()
+	if socketAddress == nil {
+		return ep.GetEndpoint().GetAddress().GetPipe().GetPath()
+	}
+	return socketAddress.Address + ":" + strconv.Itoa(int(socketAddress.GetPortValue()))
+}
+
+// applyHealthCheckLbConfig keeps new hosts out of the load balancing rotation until they pass their first active
+// health check. Active health checks are only present on clusters patched in through an EnvoyFilter.
+func applyHealthCheckLbConfig(cluster *apiv2.Cluster) {
+	if len(cluster.HealthChecks) == 0 {
+		return
+	}
+	if cluster.CommonLbConfig == nil {
+		cluster.CommonLbConfig = &apiv2.Cluster_CommonLbConfig{}
+	}
+	cluster.CommonLbConfig.IgnoreNewHostsUntilFirstHc = true
+}
+
 func (configgen *ConfigGeneratorImpl) buildOutboundClusters(proxy *model.Proxy, push *model.PushContext) []*apiv2.Cluster {
 	clusters := make([]*apiv2.Cluster, 0)
 	cb := NewClusterBuilder(proxy, push)
@@ -175,7 +275,8 @@ func (configgen *ConfigGeneratorImpl) buildOutboundClusters(proxy *model.Proxy,
 			inputParams.Service = service
 			inputParams.Port = port
 
-			lbEndpoints := buildLocalityLbEndpoints(push, networkView, service, port.Port, nil)
+			lbEndpoints := buildLocalityLbEndpoints(push, networkView, service, port.Port, nil,
+				util.DefaultSubsetLabelKeys(push.DestinationRule(proxy, service)))
 
 			// create default cluster
 			discoveryType := convertResolution(proxy, service)
@@ -185,13 +286,17 @@ func (configgen *ConfigGeneratorImpl) buildOutboundClusters(proxy *model.Proxy,
 				continue
 			}
 			// If stat name is configured, build the alternate stats name.
-			if len(push.Mesh.OutboundClusterStatName) != 0 {
-				defaultCluster.AltStatName = util.BuildStatPrefix(push.Mesh.OutboundClusterStatName, string(service.Hostname), "", port, service.Attributes)
+			if statName := outboundClusterStatName(push, service); len(statName) != 0 {
+				defaultCluster.AltStatName = util.BuildStatPrefix(statName, string(service.Hostname), "", port, service.Attributes)
 			}
 
 			setUpstreamProtocol(proxy, defaultCluster, port, model.TrafficDirectionOutbound)
 			clusters = append(clusters, defaultCluster)
 			subsetClusters := cb.applyDestinationRule(defaultCluster, DefaultClusterMode, service, port, networkView)
+			if isDynamicForwardProxyService(service) {
+				// Converted after the destination rule is applied, which relies on the original destination type.
+				applyDynamicForwardProxy(push, defaultCluster)
+			}
 
 			// call plugins for subset clusters.
 			for _, subsetCluster := range subsetClusters {
@@ -205,12 +310,113 @@ func (configgen *ConfigGeneratorImpl) buildOutboundClusters(proxy *model.Proxy,
 			for _, p := range configgen.Plugins {
 				p.OnOutboundCluster(inputParams, defaultCluster)
 			}
+
+			if service.Resolution == model.Passthrough && features.EnableHeadlessServicePodClusters.Get() {
+				for _, podCluster := range cb.buildHeadlessPodClusters(service, port, networkView) {
+					for _, p := range configgen.Plugins {
+						p.OnOutboundCluster(inputParams, podCluster)
+					}
+					clusters = append(clusters, podCluster)
+				}
+			}
 		}
 	}
+	addSourceLabelsToMetadata(proxy, clusters)
 
 	return clusters
 }
 
+// addSourceLabelsToMetadata records the workload labels of the proxy in the istio metadata of its outbound clusters,
+// if enabled. Proxies without labels have nothing to record.
+func addSourceLabelsToMetadata(proxy *model.Proxy, clusters []*apiv2.Cluster) {
+	if !features.EnableSourceLabelsClusterMetadata.Get() || proxy.Metadata == nil || len(proxy.Metadata.Labels) == 0 {
+		return
+	}
+	fields := make(map[string]*structpb.Value, len(proxy.Metadata.Labels))
+	for k, v := range proxy.Metadata.Labels {
+		fields[k] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: v}}
+	}
+	sourceLabels := &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: fields}}}
+	for _, cluster := range clusters {
+		if cluster.Metadata == nil {
+			cluster.Metadata = &core.Metadata{}
+		}
+		if cluster.Metadata.FilterMetadata == nil {
+			cluster.Metadata.FilterMetadata = make(map[string]*structpb.Struct)
+		}
+		istioMetadata, ok := cluster.Metadata.FilterMetadata[util.IstioMetadataKey]
+		if !ok {
+			istioMetadata = &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+			cluster.Metadata.FilterMetadata[util.IstioMetadataKey] = istioMetadata
+		}
+		istioMetadata.Fields["sourceLabels"] = sourceLabels
+	}
+}
+
+// applyOutboundLbPolicyOverride applies the load balancing policy override from the proxy metadata, if any, to an
+// outbound cluster without a load balancer policy of its own. Clusters whose load balancing is provided by the cluster
+// itself are left alone.
+func applyOutboundLbPolicyOverride(proxy *model.Proxy, cluster *apiv2.Cluster) {
+	if proxy.Metadata == nil || proxy.Metadata.OutboundLbPolicy == "" {
+		return
+	}
+	var lbPolicy apiv2.Cluster_LbPolicy
+	switch proxy.Metadata.OutboundLbPolicy {
+	case networking.LoadBalancerSettings_LEAST_CONN.String():
+		lbPolicy = apiv2.Cluster_LEAST_REQUEST
+	case networking.LoadBalancerSettings_RANDOM.String():
+		lbPolicy = apiv2.Cluster_RANDOM
+	case networking.LoadBalancerSettings_ROUND_ROBIN.String():
+		lbPolicy = apiv2.Cluster_ROUND_ROBIN
+	default:
+		log.Debugf("ignoring invalid outbound load balancing policy %q of proxy %s", proxy.Metadata.OutboundLbPolicy, proxy.ID)
+		return
+	}
+	if cluster.LbPolicy == apiv2.Cluster_CLUSTER_PROVIDED {
+		return
+	}
+	log.Debugf("overriding load balancing policy of cluster %s with %s for proxy %s", cluster.Name, lbPolicy, proxy.ID)
+	cluster.LbPolicy = lbPolicy
+}
+
+// isDynamicForwardProxyService checks if the outbound clusters of the service should resolve the requested host
+// through a dynamic forward proxy, instead of forwarding to the original destination.
+func isDynamicForwardProxyService(service *model.Service) bool {
+	return features.EnableDynamicForwardProxyClusters.Get() &&
+		service.MeshExternal &&
+		service.Resolution == model.Passthrough &&
+		strings.HasPrefix(string(service.Hostname), "*")
+}
+
+// applyDynamicForwardProxy turns the cluster into a dynamic forward proxy cluster. The DNS cache is shared with the
+// dynamic forward proxy HTTP filter through its name.
+func applyDynamicForwardProxy(push *model.PushContext, cluster *apiv2.Cluster) {
+	clusterConfig := &dfpcluster.ClusterConfig{
+		DnsCacheConfig: &dfpcommon.DnsCacheConfig{
+			Name:            DynamicForwardProxyDNSCacheName,
+			DnsLookupFamily: apiv2.Cluster_V4_ONLY,
+			DnsRefreshRate:  dnsRefreshRate(push.Mesh),
+		},
+	}
+	cluster.ClusterDiscoveryType = &apiv2.Cluster_ClusterType{
+		ClusterType: &apiv2.Cluster_CustomClusterType{
+			Name:        "envoy.clusters.dynamic_forward_proxy",
+			TypedConfig: util.MessageToAny(clusterConfig),
+		},
+	}
+	cluster.LbPolicy = apiv2.Cluster_CLUSTER_PROVIDED
+	cluster.DnsLookupFamily = apiv2.Cluster_V4_ONLY
+
+	// The host is only known at request time, so a static SNI would be wrong for every host but one.
+	// Use the host header of the request as SNI instead and validate the upstream certificate against it.
+	if cluster.TransportSocket != nil {
+		cluster.UpstreamHttpProtocolOptions = &core.UpstreamHttpProtocolOptions{
+			AutoSni:           true,
+			AutoSanValidation: true,
+		}
+	}
+}
+
 // SniDnat clusters do not have any TLS setting, as they simply forward traffic to upstream
 // All SniDnat clusters are internal services in the mesh.
 func (configgen *ConfigGeneratorImpl) buildOutboundSniDnatClusters(proxy *model.Proxy, push *model.PushContext) []*apiv2.Cluster {
@@ -227,7 +433,8 @@ func (configgen *ConfigGeneratorImpl) buildOutboundSniDnatClusters(proxy *model.
 			if port.Protocol == protocol.UDP {
 				continue
 			}
-			lbEndpoints := buildLocalityLbEndpoints(push, networkView, service, port.Port, nil)
+			lbEndpoints := buildLocalityLbEndpoints(push, networkView, service, port.Port, nil,
+				util.DefaultSubsetLabelKeys(push.DestinationRule(proxy, service)))
 
 			// create default cluster
 			discoveryType := convertResolution(proxy, service)
@@ -245,8 +452,10 @@ func (configgen *ConfigGeneratorImpl) buildOutboundSniDnatClusters(proxy *model.
 	return clusters
 }
 
+// buildLocalityLbEndpoints builds the endpoints of the service port for clusters resolved through DNS. Endpoints
+// carry the values of the given subset label keys of their workload in their load balancing metadata.
 func buildLocalityLbEndpoints(push *model.PushContext, proxyNetworkView map[string]bool, service *model.Service,
-	port int, labels labels.Collection) []*endpoint.LocalityLbEndpoints {
+	port int, labels labels.Collection, subsetLabelKeys []string) []*endpoint.LocalityLbEndpoints {
 
 	if service.Resolution != model.DNSLB {
 		return nil
@@ -259,6 +468,9 @@ func buildLocalityLbEndpoints(push *model.PushContext, proxyNetworkView map[stri
 	}
 
 	lbEndpoints := make(map[string][]*endpoint.LbEndpoint)
+	// A ServiceEntry with multiple addresses is converted into one service per address, each with the same
+	// endpoints. Only add each endpoint once.
+	seen := make(map[string]bool, len(instances))
 	for _, instance := range instances {
 		// Only send endpoints from the networks in the network view requested by the proxy.
 		// The default network view assigned to the Proxy is the UnnamedNetwork (""), which matches
@@ -267,6 +479,11 @@ func buildLocalityLbEndpoints(push *model.PushContext, proxyNetworkView map[stri
 			// Endpoint's network doesn't match the set of networks that the proxy wants to see.
 			continue
 		}
+		key := instance.Endpoint.Address + ":" + strconv.Itoa(int(instance.Endpoint.EndpointPort))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
 		addr := util.BuildAddress(instance.Endpoint.Address, instance.Endpoint.EndpointPort)
 		ep := &endpoint.LbEndpoint{
 			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
@@ -281,14 +498,37 @@ func buildLocalityLbEndpoints(push *model.PushContext, proxyNetworkView map[stri
 		if instance.Endpoint.LbWeight > 0 {
 			ep.LoadBalancingWeight.Value = instance.Endpoint.LbWeight
 		}
-		ep.Metadata = util.BuildLbEndpointMetadata(instance.Endpoint.UID, instance.Endpoint.Network, instance.Endpoint.TLSMode, push)
+		// Envoy resolves endpoints given by hostname itself. Keep the hostname on the endpoint, so that it is
+		// still known for the hosts resolved from it.
+		if instance.Endpoint.EndpointPort != 0 && net.ParseIP(instance.Endpoint.Address) == nil {
+			ep.GetEndpoint().Hostname = instance.Endpoint.Address
+		}
+		ep.Metadata = util.BuildLbEndpointMetadata(instance.Endpoint.UID, instance.Endpoint.ServiceAccount, instance.Endpoint.Network,
+			instance.Endpoint.TLSMode, push)
+		util.ApplyLbEndpointHealthCheckPort(ep, instance.Endpoint.Labels)
+		if instance.Endpoint.Draining {
+			util.MarkLbEndpointDraining(ep)
+		}
+		ep = util.WithLbEndpointSubsetLabels(ep, instance.Endpoint.Labels, subsetLabelKeys)
 		locality := instance.Endpoint.Locality.Label
+		if locality == "" {
+			locality = localityFromTopologyLabels(instance.Endpoint.Labels)
+		}
 		lbEndpoints[locality] = append(lbEndpoints[locality], ep)
 	}
 
+	// Build the localities in a stable order, so that the load assignment of a cluster only changes when its
+	// endpoints do.
+	localities := make([]string, 0, len(lbEndpoints))
+	for locality := range lbEndpoints {
+		localities = append(localities, locality)
+	}
+	sort.Strings(localities)
+
 	localityLbEndpoints := make([]*endpoint.LocalityLbEndpoints, 0, len(lbEndpoints))
 
-	for locality, eps := range lbEndpoints {
+	for _, locality := range localities {
+		eps := lbEndpoints[locality]
 		var weight uint32
 		for _, ep := range eps {
 			weight += ep.LoadBalancingWeight.GetValue()
@@ -305,6 +545,27 @@ func buildLocalityLbEndpoints(push *model.PushContext, proxyNetworkView map[stri
 	return localityLbEndpoints
 }
 
+// localityFromTopologyLabels derives the locality of an endpoint from the well-known topology labels, the same way
+// the Kubernetes registry derives the locality of a pod from the labels of its node. It returns an empty locality
+// if the endpoint has none of the labels.
+func localityFromTopologyLabels(endpointLabels labels.Instance) string {
+	labelValue := func(names ...string) string {
+		for _, name := range names {
+			if value := endpointLabels[name]; value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	region := labelValue("topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region")
+	zone := labelValue("topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone")
+	subzone := labelValue("topology.istio.io/subzone")
+	if region == "" && zone == "" && subzone == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s", region, zone, subzone)
+}
+
 func buildInboundLocalityLbEndpoints(bind string, port uint32) []*endpoint.LocalityLbEndpoints {
 	address := util.BuildAddress(bind, port)
 	lbEndpoint := &endpoint.LbEndpoint{
@@ -336,6 +597,7 @@ func (configgen *ConfigGeneratorImpl) buildInboundClusters(proxy *model.Proxy,
 	noneMode := proxy.GetInterceptionMode() == model.InterceptionNone
 
 	_, actualLocalHost := getActualWildcardAndLocalHost(proxy)
+	actualLocalHost = inboundClusterAddress(proxy, actualLocalHost)
 
 	if !sidecarScope.HasCustomIngressListeners {
 		// No user supplied sidecar scope or the user supplied one has no ingress listeners
@@ -430,6 +692,19 @@ func (configgen *ConfigGeneratorImpl) buildInboundClusters(proxy *model.Proxy,
 	return clusters
 }
 
+// inboundClusterAddress returns the address that the inbound clusters of the proxy send traffic to. This is the
+// localhost address, unless the proxy metadata configures another address, such as the pod IP.
+func inboundClusterAddress(proxy *model.Proxy, localhost string) string {
+	if proxy.Metadata == nil || proxy.Metadata.InboundClusterAddress == "" {
+		return localhost
+	}
+	if net.ParseIP(proxy.Metadata.InboundClusterAddress) == nil {
+		log.Warnf("ignoring invalid inbound cluster address %q of proxy %s", proxy.Metadata.InboundClusterAddress, proxy.ID)
+		return localhost
+	}
+	return proxy.Metadata.InboundClusterAddress
+}
+
 func (configgen *ConfigGeneratorImpl) findOrCreateServiceInstance(instances []*model.ServiceInstance,
 	ingressListener *networking.IstioIngressListener, sidecar string, sidecarns string) *model.ServiceInstance {
 	for _, realInstance := range instances {
@@ -485,7 +760,8 @@ func (configgen *ConfigGeneratorImpl) buildInboundClusterForPortOrUDS(pluginPara
 			// only connection pool settings make sense on the inbound path.
 			// upstream TLS settings/outlier detection/load balancer don't apply here.
 			applyConnectionPool(pluginParams.Push, localCluster, destinationRule.TrafficPolicy.ConnectionPool)
-			localCluster.Metadata = util.BuildConfigInfoMetadata(cfg.ConfigMeta)
+			localCluster.Metadata = util.AddConfigSourceToMetadata(util.BuildConfigInfoMetadata(cfg.ConfigMeta),
+				instance.Service, &cfg.ConfigMeta)
 		}
 	}
 	return localCluster
@@ -633,14 +909,26 @@ type buildClusterOpts struct {
 	proxy           *model.Proxy
 	meshExternal    bool
 	serviceMTLSMode model.MutualTLSMode
+	// Whether endpoints without the istio TLS mode label should be sent plaintext when ISTIO_MUTUAL is configured.
+	plaintextFallback bool
+	// The name of the SDS secret holding the client certificate for MUTUAL TLS, if any.
+	clientCredentialName string
+	// The ALPN protocols advertised when originating SIMPLE or MUTUAL TLS, if any.
+	alpnProtocols []string
 }
 
 func applyTrafficPolicy(opts buildClusterOpts) {
 	connectionPool, outlierDetection, loadBalancer, tls := SelectTrafficPolicyComponents(opts.policy, opts.port)
+	connectionPool = tcpOnlyConnectionPool(opts.cluster.Name, opts.port, connectionPool)
 
 	applyConnectionPool(opts.push, opts.cluster, connectionPool)
-	applyOutlierDetection(opts.cluster, outlierDetection)
+	applyH2Upgrade(opts, connectionPool)
+	applyOutlierDetection(opts.cluster, withDefaultOutlierDetection(opts, outlierDetection))
 	applyLoadBalancer(opts.cluster, loadBalancer, opts.port, opts.proxy, opts.push.Mesh)
+	// Load balancer policies of destination rules take precedence over the override of the proxy.
+	if opts.direction == model.TrafficDirectionOutbound && loadBalancer.GetLbPolicy() == nil {
+		applyOutboundLbPolicyOverride(opts.proxy, opts.cluster)
+	}
 
 	if opts.clusterMode != SniDnatClusterMode && opts.direction != model.TrafficDirectionInbound {
 		autoMTLSEnabled := opts.push.Mesh.GetEnableAutoMtls().Value
@@ -651,6 +939,23 @@ func applyTrafficPolicy(opts buildClusterOpts) {
 	}
 }
 
+// withDefaultOutlierDetection returns the outlier detection to apply to an outbound EDS cluster when default outlier
+// detection is enabled: a conservative default if the traffic policy has none, or nil if the traffic policy disables
+// it with a zero interval.
+func withDefaultOutlierDetection(opts buildClusterOpts, outlier *networking.OutlierDetection) *networking.OutlierDetection {
+	if !features.EnableDefaultOutlierDetection.Get() || opts.direction != model.TrafficDirectionOutbound ||
+		opts.cluster.GetType() != apiv2.Cluster_EDS {
+		return outlier
+	}
+	if outlier == nil {
+		return &networking.OutlierDetection{ConsecutiveGatewayErrors: &types.UInt32Value{Value: 5}}
+	}
+	if interval := outlier.Interval; interval != nil && interval.Seconds == 0 && interval.Nanos == 0 {
+		return nil
+	}
+	return outlier
+}
+
 // FIXME: there isn't a way to distinguish between unset values and zero values
 func applyConnectionPool(push *model.PushContext, cluster *apiv2.Cluster, settings *networking.ConnectionPoolSettings) {
 	if settings == nil {
@@ -679,12 +984,17 @@ func applyConnectionPool(push *model.PushContext, cluster *apiv2.Cluster, settin
 			threshold.MaxRetries = &wrappers.UInt32Value{Value: uint32(settings.Http.MaxRetries)}
 		}
 
-		idleTimeout = settings.Http.IdleTimeout
+		if validDuration(cluster.Name, "idle timeout", settings.Http.IdleTimeout, true) {
+			idleTimeout = settings.Http.IdleTimeout
+		}
 	}
 
 	if settings.Tcp != nil {
-		if settings.Tcp.ConnectTimeout != nil {
+		if validDuration(cluster.Name, "connect timeout", settings.Tcp.ConnectTimeout, false) {
 			cluster.ConnectTimeout = gogo.DurationToProtoDuration(settings.Tcp.ConnectTimeout)
+			if jitter := features.ConnectTimeoutJitter.Get(); jitter > 0 {
+				cluster.ConnectTimeout = jitterConnectTimeout(cluster.Name, cluster.ConnectTimeout, jitter)
+			}
 		}
 
 		if settings.Tcp.MaxConnections > 0 {
@@ -704,6 +1014,76 @@ func applyConnectionPool(push *model.PushContext, cluster *apiv2.Cluster, settin
 	}
 }
 
+// validDuration reports whether a duration of a traffic policy is set to a value Envoy accepts. Negative durations, and
+// zero durations unless allowZero is set, are logged and ignored, so that the default of the setting applies instead.
+func validDuration(clusterName, setting string, d *types.Duration, allowZero bool) bool {
+	if d == nil {
+		return false
+	}
+	if d.Seconds < 0 || d.Nanos < 0 || (!allowZero && d.Seconds == 0 && d.Nanos == 0) {
+		log.Warnf("ignoring invalid %s %ds %dns for cluster %s", setting, d.Seconds, d.Nanos, clusterName)
+		return false
+	}
+	return true
+}
+
+// tcpOnlyConnectionPool drops the HTTP settings from the connection pool of a plain TCP port. They have no meaning
+// for connections proxied at L4 and would otherwise add HTTP protocol options to the cluster. The idle timeout is
+// only recorded in the cluster metadata, see addTCPIdleTimeoutToMetadata.
+func tcpOnlyConnectionPool(clusterName string, port *model.Port, settings *networking.ConnectionPoolSettings) *networking.ConnectionPoolSettings {
+	if port == nil || port.Protocol != protocol.TCP || settings.GetHttp() == nil {
+		return settings
+	}
+	log.Warnf("ignoring HTTP connection pool settings for TCP cluster %s", clusterName)
+	return &networking.ConnectionPoolSettings{Tcp: settings.Tcp}
+}
+
+// applyH2Upgrade makes the cluster use HTTP/2 towards the upstream when the destination rule asks for the
+// connection to be upgraded. Without TLS this is cleartext HTTP/2 (h2c); when TLS is applied afterwards,
+// h2 is advertised with ALPN instead.
+func applyH2Upgrade(opts buildClusterOpts, settings *networking.ConnectionPoolSettings) {
+	if !shouldH2Upgrade(opts.direction, opts.port, settings) {
+		return
+	}
+	opts.cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{
+		// Envoy default value of 100 is too low for data path.
+		MaxConcurrentStreams: &wrappers.UInt32Value{
+			Value: 1073741824,
+		},
+	}
+	// The upstream is known to speak HTTP/2, do not mirror the downstream protocol for auto detected ports.
+	opts.cluster.ProtocolSelection = apiv2.Cluster_USE_CONFIGURED_PROTOCOL
+}
+
+func shouldH2Upgrade(direction model.TrafficDirection, port *model.Port, settings *networking.ConnectionPoolSettings) bool {
+	if direction != model.TrafficDirectionOutbound || port == nil {
+		return false
+	}
+	// Only HTTP/1.1 and auto detected ports can be upgraded.
+	if !port.Protocol.IsHTTP() && !port.Protocol.IsUnsupported() {
+		return false
+	}
+	policy := settings.GetHttp().GetH2UpgradePolicy()
+	if policy == networking.ConnectionPoolSettings_HTTPSettings_DEFAULT {
+		policy = meshDefaultH2UpgradePolicy()
+	}
+	return policy == networking.ConnectionPoolSettings_HTTPSettings_UPGRADE
+}
+
+// meshDefaultH2UpgradePolicy returns the HTTP/2 upgrade policy of clusters whose DestinationRule does not specify one.
+func meshDefaultH2UpgradePolicy() networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy {
+	name := features.DefaultH2UpgradePolicy.Get()
+	if name == "" {
+		return networking.ConnectionPoolSettings_HTTPSettings_DEFAULT
+	}
+	policy, ok := networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy_value[name]
+	if !ok {
+		log.Warnf("ignoring invalid default h2 upgrade policy %q", name)
+		return networking.ConnectionPoolSettings_HTTPSettings_DEFAULT
+	}
+	return networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy(policy)
+}
+
 func applyTCPKeepalive(push *model.PushContext, cluster *apiv2.Cluster, settings *networking.ConnectionPoolSettings) {
 	// Apply Keepalive config only if it is configured in mesh config or in destination rule.
 	if push.Mesh.TcpKeepalive != nil || settings.Tcp.TcpKeepalive != nil {
@@ -746,8 +1126,10 @@ func applyOutlierDetection(cluster *apiv2.Cluster, outlier *networking.OutlierDe
 	}
 
 	out := &v2Cluster.OutlierDetection{}
-	if outlier.BaseEjectionTime != nil {
+	if validDuration(cluster.Name, "base ejection time", outlier.BaseEjectionTime, false) {
 		out.BaseEjectionTime = gogo.DurationToProtoDuration(outlier.BaseEjectionTime)
+	} else if baseEjectionTime := features.OutlierDefaultBaseEjectionTime.Get(); baseEjectionTime > 0 {
+		out.BaseEjectionTime = ptypes.DurationProto(baseEjectionTime)
 	}
 	if outlier.ConsecutiveErrors > 0 {
 		// Only listen to gateway errors, see https://github.com/istio/api/pull/617
@@ -777,11 +1159,25 @@ func applyOutlierDetection(cluster *apiv2.Cluster, outlier *networking.OutlierDe
 		out.EnforcingConsecutiveGatewayFailure = &wrappers.UInt32Value{Value: v}
 	}
 
-	if outlier.Interval != nil {
+	if jitter := features.OutlierBaseEjectionTimeJitter.Get(); jitter > 0 {
+		out.BaseEjectionTime = jitterBaseEjectionTime(cluster.Name, out.BaseEjectionTime, jitter)
+	}
+
+	if validDuration(cluster.Name, "outlier detection interval", outlier.Interval, false) {
 		out.Interval = gogo.DurationToProtoDuration(outlier.Interval)
+	} else if interval := features.OutlierDefaultInterval.Get(); interval > 0 {
+		out.Interval = ptypes.DurationProto(interval)
 	}
 	if outlier.MaxEjectionPercent > 0 {
 		out.MaxEjectionPercent = &wrappers.UInt32Value{Value: uint32(outlier.MaxEjectionPercent)}
+	} else if maxEjectionPercent := features.OutlierDefaultMaxEjectionPercent.Get(); maxEjectionPercent > 0 && maxEjectionPercent <= 100 {
+		out.MaxEjectionPercent = &wrappers.UInt32Value{Value: uint32(maxEjectionPercent)}
+	}
+	if ceiling := features.OutlierMaxEjectionPercentCeiling.Get(); ceiling > 0 && ceiling < 100 &&
+		out.MaxEjectionPercent.GetValue() > uint32(ceiling) {
+		log.Warnf("clamping max ejection percent %d of cluster %s to %d%%", out.MaxEjectionPercent.GetValue(),
+			cluster.Name, ceiling)
+		out.MaxEjectionPercent = &wrappers.UInt32Value{Value: uint32(ceiling)}
 	}
 
 	cluster.OutlierDetection = out
@@ -798,7 +1194,43 @@ func applyOutlierDetection(cluster *apiv2.Cluster, outlier *networking.OutlierDe
 	}
 }
 
+// jitterBaseEjectionTime adds an offset in [0, jitter) to the base ejection time. The offset is derived from
+// the cluster name rather than picked at random, so that the generated config does not change on every push.
+func jitterBaseEjectionTime(clusterName string, base *duration.Duration, jitter time.Duration) *duration.Duration {
+	baseEjectionTime := defaultBaseEjectionTime
+	if base != nil {
+		if d, err := ptypes.Duration(base); err == nil {
+			baseEjectionTime = d
+		}
+	}
+	return ptypes.DurationProto(baseEjectionTime + clusterJitter(clusterName, jitter))
+}
+
+// jitterConnectTimeout adds an offset in [0, jitter) to the connect timeout, derived from the cluster name like the
+// offset of jitterBaseEjectionTime.
+func jitterConnectTimeout(clusterName string, timeout *duration.Duration, jitter time.Duration) *duration.Duration {
+	connectTimeout, err := ptypes.Duration(timeout)
+	if err != nil {
+		return timeout
+	}
+	return ptypes.DurationProto(connectTimeout + clusterJitter(clusterName, jitter))
+}
+
+// clusterJitter returns an offset in [0, jitter) that is stable for the given cluster name.
+func clusterJitter(clusterName string, jitter time.Duration) time.Duration {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(clusterName))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
+
 func applyLoadBalancer(cluster *apiv2.Cluster, lb *networking.LoadBalancerSettings, port *model.Port, proxy *model.Proxy, meshConfig *meshconfig.MeshConfig) {
+	if mergeWindow := features.ClusterUpdateMergeWindow.Get(); mergeWindow > 0 {
+		if cluster.CommonLbConfig == nil {
+			cluster.CommonLbConfig = &apiv2.Cluster_CommonLbConfig{}
+		}
+		cluster.CommonLbConfig.UpdateMergeWindow = ptypes.DurationProto(mergeWindow)
+	}
+
 	if cluster.OutlierDetection != nil {
 		if cluster.CommonLbConfig == nil {
 			cluster.CommonLbConfig = &apiv2.Cluster_CommonLbConfig{}
@@ -833,6 +1265,10 @@ func applyLoadBalancer(cluster *apiv2.Cluster, lb *networking.LoadBalancerSettin
 		return
 	}
 
+	// Reset the config of a previously applied policy, e.g. the ring hash config of the destination rule traffic
+	// policy when a subset overrides it with a simple policy.
+	cluster.LbConfig = nil
+
 	// DO not do if else here. since lb.GetSimple returns a enum value (not pointer).
 	switch lb.GetSimple() {
 	case networking.LoadBalancerSettings_LEAST_CONN:
@@ -880,13 +1316,83 @@ func applyLocalityLBSetting(
 	}
 }
 
+// appendTrustDomainAliases returns the subject alt names, followed by the SPIFFE identities of the local trust domain
+// rewritten to each of the trust domain aliases, so that upstreams with certificates of an aliased trust domain are
+// accepted as well.
+func appendTrustDomainAliases(subjectAltNames []string, trustDomainAliases []string) []string {
+	if len(trustDomainAliases) == 0 {
+		return subjectAltNames
+	}
+	localPrefix := spiffe.URIPrefix + spiffe.GetTrustDomain() + "/"
+	out := append([]string{}, subjectAltNames...)
+	for _, san := range subjectAltNames {
+		if !strings.HasPrefix(san, localPrefix) {
+			continue
+		}
+		for _, alias := range trustDomainAliases {
+			out = append(out, spiffe.URIPrefix+alias+"/"+strings.TrimPrefix(san, localPrefix))
+		}
+	}
+	return out
+}
+
+// clientCredentialSdsUdsPath returns the SDS path to fetch the client credential of a MUTUAL TLS cluster from, or an
+// empty string if the client certificate is read from files.
+func clientCredentialSdsUdsPath(opts *buildClusterOpts, tls *networking.TLSSettings) string {
+	if tls.Mode != networking.TLSSettings_MUTUAL || opts.clientCredentialName == "" || !opts.proxy.Metadata.UserSds {
+		return ""
+	}
+	if opts.proxy.Type == model.Router {
+		return authn_model.IngressGatewaySdsUdsPath
+	}
+	return opts.push.Mesh.SdsUdsPath
+}
+
+// buildClientCredentialTLSContext builds the TLS context of a MUTUAL TLS cluster whose client certificate is fetched
+// over SDS. The secret is referenced by its name only, so Envoy picks up a rotated certificate without the cluster
+// changing.
+func buildClientCredentialTLSContext(credentialName, sdsUdsPath string, tls *networking.TLSSettings,
+	certValidationContext *auth.CertificateValidationContext) *auth.UpstreamTlsContext {
+	tlsContext := &auth.UpstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{
+				authn_model.ConstructSdsSecretConfigWithCustomUds(credentialName, sdsUdsPath),
+			},
+		},
+		Sni: tls.Sni,
+	}
+	if len(tls.CaCertificates) != 0 {
+		tlsContext.CommonTlsContext.ValidationContextType = &auth.CommonTlsContext_ValidationContext{
+			ValidationContext: certValidationContext,
+		}
+	} else {
+		tlsContext.CommonTlsContext.ValidationContextType = &auth.CommonTlsContext_CombinedValidationContext{
+			CombinedValidationContext: &auth.CommonTlsContext_CombinedCertificateValidationContext{
+				DefaultValidationContext: &auth.CertificateValidationContext{VerifySubjectAltName: tls.SubjectAltNames},
+				ValidationContextSdsSecretConfig: authn_model.ConstructSdsSecretConfigWithCustomUds(
+					credentialName+authn_model.SdsCaSuffix, sdsUdsPath),
+			},
+		}
+	}
+	return tlsContext
+}
+
 func applyUpstreamTLSSettings(opts *buildClusterOpts, tls *networking.TLSSettings, mtlsCtxType mtlsContextType, node *model.Proxy) {
 	if tls == nil {
 		return
 	}
+	if tls.Mode == networking.TLSSettings_DISABLE && opts.serviceMTLSMode == model.MTLSStrict && !opts.meshExternal &&
+		features.EnforceStrictMTLSForClusters.Get() {
+		log.Warnf("overriding TLS mode DISABLE with ISTIO_MUTUAL for cluster %s, as the host requires strict mTLS", opts.cluster.Name)
+		tls = buildIstioMutualTLS(opts.serviceAccounts, opts.istioMtlsSni, opts.proxy)
+	}
 
 	cluster := opts.cluster
 	proxy := opts.proxy
+	subjectAltNames := tls.SubjectAltNames
+	if tls.Mode == networking.TLSSettings_ISTIO_MUTUAL {
+		subjectAltNames = appendTrustDomainAliases(subjectAltNames, opts.push.Mesh.TrustDomainAliases)
+	}
 	certValidationContext := &auth.CertificateValidationContext{}
 	var trustedCa *core.DataSource
 	if len(tls.CaCertificates) != 0 {
@@ -896,10 +1402,10 @@ func applyUpstreamTLSSettings(opts *buildClusterOpts, tls *networking.TLSSetting
 			},
 		}
 	}
-	if trustedCa != nil || len(tls.SubjectAltNames) > 0 {
+	if trustedCa != nil || len(subjectAltNames) > 0 {
 		certValidationContext = &auth.CertificateValidationContext{
 			TrustedCa:            trustedCa,
-			VerifySubjectAltName: tls.SubjectAltNames,
+			VerifySubjectAltName: subjectAltNames,
 		}
 	}
 
@@ -921,6 +1427,13 @@ func applyUpstreamTLSSettings(opts *buildClusterOpts, tls *networking.TLSSetting
 			tlsContext.CommonTlsContext.AlpnProtocols = util.ALPNH2Only
 		}
 	case networking.TLSSettings_MUTUAL, networking.TLSSettings_ISTIO_MUTUAL:
+		if sdsPath := clientCredentialSdsUdsPath(opts, tls); sdsPath != "" {
+			tlsContext = buildClientCredentialTLSContext(opts.clientCredentialName, sdsPath, tls, certValidationContext)
+			if cluster.Http2ProtocolOptions != nil {
+				tlsContext.CommonTlsContext.AlpnProtocols = util.ALPNH2Only
+			}
+			break
+		}
 		if tls.ClientCertificate == "" || tls.PrivateKey == "" {
 			log.Errorf("failed to apply tls setting for %s: client certificate and private key must not be empty",
 				cluster.Name)
@@ -957,7 +1470,7 @@ func applyUpstreamTLSSettings(opts *buildClusterOpts, tls *networking.TLSSetting
 
 			tlsContext.CommonTlsContext.ValidationContextType = &auth.CommonTlsContext_CombinedValidationContext{
 				CombinedValidationContext: &auth.CommonTlsContext_CombinedCertificateValidationContext{
-					DefaultValidationContext:         &auth.CertificateValidationContext{VerifySubjectAltName: tls.SubjectAltNames},
+					DefaultValidationContext:         &auth.CertificateValidationContext{VerifySubjectAltName: subjectAltNames},
 					ValidationContextSdsSecretConfig: authn_model.ConstructSdsSecretConfig(authn_model.SDSRootResourceName, opts.push.Mesh.SdsUdsPath),
 				},
 			}
@@ -970,7 +1483,11 @@ func applyUpstreamTLSSettings(opts *buildClusterOpts, tls *networking.TLSSetting
 		if cluster.Http2ProtocolOptions != nil {
 			// This is HTTP/2 in-mesh cluster, advertise it with ALPN.
 			if tls.Mode == networking.TLSSettings_ISTIO_MUTUAL {
-				tlsContext.CommonTlsContext.AlpnProtocols = util.ALPNInMeshH2
+				if util.IsTCPMetadataExchangeEnabled(node) {
+					tlsContext.CommonTlsContext.AlpnProtocols = util.ALPNInMeshH2WithMxc
+				} else {
+					tlsContext.CommonTlsContext.AlpnProtocols = util.ALPNInMeshH2
+				}
 			} else {
 				tlsContext.CommonTlsContext.AlpnProtocols = util.ALPNH2Only
 			}
@@ -984,18 +1501,29 @@ func applyUpstreamTLSSettings(opts *buildClusterOpts, tls *networking.TLSSetting
 		}
 	}
 
+	// Pin the TLS parameters used when originating TLS to non-mesh (egress) upstreams, if configured.
+	if tlsContext != nil && (tls.Mode == networking.TLSSettings_SIMPLE || tls.Mode == networking.TLSSettings_MUTUAL) {
+		tlsContext.CommonTlsContext.TlsParams = buildUpstreamTLSParams(cluster.Name)
+		if len(opts.alpnProtocols) > 0 {
+			tlsContext.CommonTlsContext.AlpnProtocols = opts.alpnProtocols
+		}
+	}
+
 	if tlsContext != nil {
 		cluster.TransportSocket = &core.TransportSocket{
 			Name:       util.EnvoyTLSSocketName,
 			ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: util.MessageToAny(tlsContext)},
 		}
 	}
+	addAutoMtlsToMetadata(cluster, tlsContext, mtlsCtxType)
 
 	// For headless service, discover type will be `Cluster_ORIGINAL_DST`
 	// Apply auto mtls to clusters excluding these kind of headless service
 	if cluster.GetType() != apiv2.Cluster_ORIGINAL_DST {
-		// convert to transport socket matcher if the mode was auto detected
-		if tls.Mode == networking.TLSSettings_ISTIO_MUTUAL && mtlsCtxType == autoDetected && util.IsIstioVersionGE14(proxy) {
+		// convert to transport socket matcher if the mode was auto detected, or if a plaintext fallback was requested
+		// and not all endpoints are known to accept mTLS.
+		fallback := opts.plaintextFallback && opts.serviceMTLSMode != model.MTLSStrict
+		if tls.Mode == networking.TLSSettings_ISTIO_MUTUAL && (mtlsCtxType == autoDetected || fallback) && util.IsIstioVersionGE14(proxy) {
 			transportSocket := cluster.TransportSocket
 			cluster.TransportSocket = nil
 			cluster.TransportSocketMatches = []*apiv2.Cluster_TransportSocketMatch{
@@ -1014,6 +1542,145 @@ func applyUpstreamTLSSettings(opts *buildClusterOpts, tls *networking.TLSSetting
 	}
 }
 
+// addAutoMtlsToMetadata records in the istio metadata of a cluster, if enabled, whether the TLS it originates comes
+// from automatic mTLS or from the TLS settings of a DestinationRule. Plaintext clusters have no autoMtls field.
+func addAutoMtlsToMetadata(cluster *apiv2.Cluster, tlsContext *auth.UpstreamTlsContext, mtlsCtxType mtlsContextType) {
+	if !features.EnableAutoMtlsClusterMetadata.Get() {
+		return
+	}
+	if tlsContext == nil {
+		if istioMetadata := cluster.GetMetadata().GetFilterMetadata()[util.IstioMetadataKey]; istioMetadata != nil {
+			delete(istioMetadata.Fields, "autoMtls")
+		}
+		return
+	}
+	if cluster.Metadata == nil {
+		cluster.Metadata = &core.Metadata{}
+	}
+	if cluster.Metadata.FilterMetadata == nil {
+		cluster.Metadata.FilterMetadata = make(map[string]*structpb.Struct)
+	}
+	istioMetadata, ok := cluster.Metadata.FilterMetadata[util.IstioMetadataKey]
+	if !ok {
+		istioMetadata = &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+		cluster.Metadata.FilterMetadata[util.IstioMetadataKey] = istioMetadata
+	}
+	istioMetadata.Fields["autoMtls"] = &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: mtlsCtxType == autoDetected}}
+}
+
+// keepAutoMtlsMetadata copies the autoMtls field recorded when the TLS settings were applied to a cluster into the
+// metadata that replaces the metadata of the cluster.
+func keepAutoMtlsMetadata(cluster *apiv2.Cluster, md *core.Metadata) *core.Metadata {
+	autoMtls, ok := cluster.GetMetadata().GetFilterMetadata()[util.IstioMetadataKey].GetFields()["autoMtls"]
+	if !ok {
+		return md
+	}
+	if istioMetadata, ok := md.FilterMetadata[util.IstioMetadataKey]; ok {
+		istioMetadata.Fields["autoMtls"] = autoMtls
+	}
+	return md
+}
+
+// upstreamCipherSuites is the set of cipher suite names that Envoy accepts for upstream TLS.
+var upstreamCipherSuites = map[string]bool{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": true,
+	"ECDHE-RSA-AES128-GCM-SHA256":   true,
+	"ECDHE-ECDSA-AES256-GCM-SHA384": true,
+	"ECDHE-RSA-AES256-GCM-SHA384":   true,
+	"ECDHE-ECDSA-CHACHA20-POLY1305": true,
+	"ECDHE-RSA-CHACHA20-POLY1305":   true,
+	"ECDHE-PSK-CHACHA20-POLY1305":   true,
+	"ECDHE-ECDSA-AES128-SHA":        true,
+	"ECDHE-RSA-AES128-SHA":          true,
+	"ECDHE-PSK-AES128-CBC-SHA":      true,
+	"ECDHE-ECDSA-AES256-SHA":        true,
+	"ECDHE-RSA-AES256-SHA":          true,
+	"ECDHE-PSK-AES256-CBC-SHA":      true,
+	"AES128-GCM-SHA256":             true,
+	"AES256-GCM-SHA384":             true,
+	"AES128-SHA":                    true,
+	"AES256-SHA":                    true,
+	"PSK-AES128-CBC-SHA":            true,
+	"PSK-AES256-CBC-SHA":            true,
+	"DES-CBC3-SHA":                  true,
+}
+
+// buildUpstreamTLSParams builds the TLS parameters for originating TLS to an upstream cluster from the
+// PILOT_UPSTREAM_TLS_* settings. Returns nil if none of them are set, so that Envoy defaults apply.
+func buildUpstreamTLSParams(clusterName string) *auth.TlsParameters {
+	minVersion := convertTLSProtocolName(features.UpstreamTLSMinProtocolVersion.Get())
+	maxVersion := convertTLSProtocolName(features.UpstreamTLSMaxProtocolVersion.Get())
+
+	var cipherSuites []string
+	for _, cipherSuite := range splitCommaSeparated(features.UpstreamTLSCipherSuites.Get()) {
+		if !isValidCipherSuite(cipherSuite) {
+			log.Warnf("ignoring unrecognized cipher suite %q for cluster %s", cipherSuite, clusterName)
+			continue
+		}
+		cipherSuites = append(cipherSuites, cipherSuite)
+	}
+	ecdhCurves := splitCommaSeparated(features.UpstreamTLSEcdhCurves.Get())
+
+	if minVersion == auth.TlsParameters_TLS_AUTO && maxVersion == auth.TlsParameters_TLS_AUTO &&
+		len(cipherSuites) == 0 && len(ecdhCurves) == 0 {
+		return nil
+	}
+	return &auth.TlsParameters{
+		TlsMinimumProtocolVersion: minVersion,
+		TlsMaximumProtocolVersion: maxVersion,
+		CipherSuites:              cipherSuites,
+		EcdhCurves:                ecdhCurves,
+	}
+}
+
+// isValidCipherSuite checks a cipher suite name, including Envoy's "[A|B]" equal-preference groups.
+func isValidCipherSuite(cipherSuite string) bool {
+	if strings.HasPrefix(cipherSuite, "[") && strings.HasSuffix(cipherSuite, "]") {
+		for _, c := range strings.Split(strings.Trim(cipherSuite, "[]"), "|") {
+			if !upstreamCipherSuites[c] {
+				return false
+			}
+		}
+		return true
+	}
+	return upstreamCipherSuites[cipherSuite]
+}
+
+// convertTLSProtocolName converts a TLS protocol name such as "TLSV1_2" to the Envoy TLS protocol.
+func convertTLSProtocolName(name string) auth.TlsParameters_TlsProtocol {
+	if name == "" {
+		return auth.TlsParameters_TLS_AUTO
+	}
+	v, ok := networking.Server_TLSOptions_TLSProtocol_value[strings.ToUpper(name)]
+	if !ok {
+		log.Warnf("ignoring unrecognized TLS protocol version %q", name)
+		return auth.TlsParameters_TLS_AUTO
+	}
+	return convertTLSProtocol(networking.Server_TLSOptions_TLSProtocol(v))
+}
+
+func splitCommaSeparated(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// dnsRefreshRate returns the DNS refresh rate of DNS clusters. It is the one of the mesh config, if set, and falls
+// back to PILOT_DEFAULT_DNS_REFRESH_RATE otherwise, so that the rate does not silently depend on the Envoy default.
+func dnsRefreshRate(mesh *meshconfig.MeshConfig) *duration.Duration {
+	if mesh.DnsRefreshRate != nil {
+		return gogo.DurationToProtoDuration(mesh.DnsRefreshRate)
+	}
+	if rate := features.DefaultDNSRefreshRate.Get(); rate > 0 {
+		return ptypes.DurationProto(rate)
+	}
+	return nil
+}
+
 func setUpstreamProtocol(node *model.Proxy, cluster *apiv2.Cluster, port *model.Port, direction model.TrafficDirection) {
 	if port.Protocol.IsHTTP2() {
 		cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{
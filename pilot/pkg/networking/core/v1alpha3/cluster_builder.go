@@ -16,17 +16,30 @@ package v1alpha3
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
 	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	v2Cluster "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	xdstype "github.com/envoyproxy/go-control-plane/envoy/type"
 	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/ptypes"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
 
 	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/pkg/log"
+
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/util/gogo"
 )
 
@@ -54,11 +67,13 @@ func (cb *ClusterBuilder) applyDestinationRule(cluster *apiv2.Cluster, clusterMo
 	proxyNetworkView map[string]bool) []*apiv2.Cluster {
 	destRule := cb.push.DestinationRule(cb.proxy, service)
 	destinationRule := castDestinationRuleOrDefault(destRule)
+	annotations := model.GetDestinationRuleAnnotations(destRule)
+	policy := cb.withSidecarConnectionPool(destinationRule.TrafficPolicy, port)
 
 	opts := buildClusterOpts{
 		push:        cb.push,
 		cluster:     cluster,
-		policy:      destinationRule.TrafficPolicy,
+		policy:      policy,
 		port:        port,
 		clusterMode: clusterMode,
 		direction:   model.TrafficDirectionOutbound,
@@ -72,6 +87,9 @@ func (cb *ClusterBuilder) applyDestinationRule(cluster *apiv2.Cluster, clusterMo
 		opts.meshExternal = service.MeshExternal
 		opts.serviceMTLSMode = cb.push.BestEffortInferServiceMTLSMode(service, port)
 	}
+	opts.plaintextFallback = annotations.PlaintextFallback
+	opts.clientCredentialName = annotations.ClientCredentialName
+	opts.alpnProtocols = annotations.ALPNProtocols
 
 	// Apply traffic policy for the main default cluster.
 	applyTrafficPolicy(opts)
@@ -81,10 +99,53 @@ func (cb *ClusterBuilder) applyDestinationRule(cluster *apiv2.Cluster, clusterMo
 	maybeApplyEdsConfig(cluster)
 
 	var clusterMetadata *core.Metadata
+	var configMeta *model.ConfigMeta
 	if destRule != nil {
 		clusterMetadata = util.BuildConfigInfoMetadata(destRule.ConfigMeta)
-		cluster.Metadata = clusterMetadata
+		configMeta = &destRule.ConfigMeta
+	}
+	clusterMetadata = util.AddConfigSourceToMetadata(clusterMetadata, service, configMeta)
+	if annotations.StatsHistogramBuckets != "" {
+		clusterMetadata.FilterMetadata[util.IstioMetadataKey].Fields["histogramBuckets"] = &structpb.Value{
+			Kind: &structpb.Value_StringValue{StringValue: annotations.StatsHistogramBuckets},
+		}
+	}
+	if annotations.StatsTags != nil {
+		clusterMetadata.FilterMetadata[util.IstioMetadataKey].Fields["statsTags"] = &structpb.Value{
+			Kind: &structpb.Value_StructValue{StructValue: annotations.StatsTags},
+		}
+	}
+	if annotations.WasmConfig != nil {
+		clusterMetadata.FilterMetadata[wasmMetadataKey] = annotations.WasmConfig
+	}
+	// Routes to the host without a timeout of their own use this timeout.
+	if annotations.DefaultRequestTimeout > 0 {
+		clusterMetadata.FilterMetadata[util.IstioMetadataKey].Fields["defaultRequestTimeout"] = &structpb.Value{
+			Kind: &structpb.Value_StringValue{StringValue: annotations.DefaultRequestTimeout.String()},
+		}
+	}
+	// Retries of routes to the host without a per try timeout of their own use this timeout.
+	if annotations.DefaultPerTryTimeout > 0 {
+		clusterMetadata.FilterMetadata[util.IstioMetadataKey].Fields["defaultPerTryTimeout"] = &structpb.Value{
+			Kind: &structpb.Value_StringValue{StringValue: annotations.DefaultPerTryTimeout.String()},
+		}
+	}
+	applyEndpointPort(cluster, annotations.EndpointPorts, port)
+	applyHealthCheckHost(cluster, annotations.HealthCheckHost)
+	if annotations.StatName != "" {
+		cluster.AltStatName = util.BuildStatPrefix(annotations.StatName, string(service.Hostname), "", port, service.Attributes)
+	}
+	addTCPIdleTimeoutToMetadata(clusterMetadata, policy, port)
+	addPortNameToMetadata(clusterMetadata, port)
+	addResolutionToMetadata(clusterMetadata, service)
+	_, _, loadBalancer, _ := SelectTrafficPolicyComponents(policy, port)
+	addConsistentHashKeysToMetadata(clusterMetadata, cluster, loadBalancer, annotations.ConsistentHashKeys)
+	cluster.Metadata = keepAutoMtlsMetadata(cluster, util.AddCanonicalServiceToMetadata(clusterMetadata, service, nil))
+	applyDestinationRuleAnnotations(cluster, port, annotations)
+	if annotations.DefaultSubset != "" {
+		cluster.LbSubsetConfig = buildLbSubsetConfig(destinationRule.Subsets, annotations.DefaultSubset)
 	}
+	cb.applyMaxConnectionsPerHost(cluster, service, port, nil, annotations.MaxConnectionsPerHost)
 	subsetClusters := make([]*apiv2.Cluster, 0)
 	for _, subset := range destinationRule.Subsets {
 		var subsetClusterName string
@@ -100,7 +161,7 @@ func (cb *ClusterBuilder) applyDestinationRule(cluster *apiv2.Cluster, clusterMo
 		// ServiceEntry's need to filter hosts based on subset.labels in order to perform weighted routing
 		var lbEndpoints []*endpoint.LocalityLbEndpoints
 		if cluster.GetType() != apiv2.Cluster_EDS && len(subset.Labels) != 0 {
-			lbEndpoints = buildLocalityLbEndpoints(cb.push, proxyNetworkView, service, port.Port, []labels.Instance{subset.Labels})
+			lbEndpoints = buildLocalityLbEndpoints(cb.push, proxyNetworkView, service, port.Port, []labels.Instance{subset.Labels}, nil)
 		}
 
 		subsetCluster := cb.buildDefaultCluster(subsetClusterName, cluster.GetType(), lbEndpoints,
@@ -109,31 +170,228 @@ func (cb *ClusterBuilder) applyDestinationRule(cluster *apiv2.Cluster, clusterMo
 		if subsetCluster == nil {
 			continue
 		}
-		if len(cb.push.Mesh.OutboundClusterStatName) != 0 {
-			subsetCluster.AltStatName = util.BuildStatPrefix(cb.push.Mesh.OutboundClusterStatName, string(service.Hostname), subset.Name, port, service.Attributes)
+		if statName := destinationRuleStatName(cb.push, service, annotations.StatName); len(statName) != 0 {
+			subsetCluster.AltStatName = util.BuildStatPrefix(statName, string(service.Hostname), subset.Name, port, service.Attributes)
 		}
 		setUpstreamProtocol(cb.proxy, subsetCluster, port, model.TrafficDirectionOutbound)
 
 		// Apply traffic policy for subset cluster with the destination rule traffice policy.
 		opts.cluster = subsetCluster
-		opts.policy = destinationRule.TrafficPolicy
+		opts.policy = policy
 		opts.istioMtlsSni = defaultSni
+		opts.clientCredentialName = annotations.ClientCredentialName
+		if name, ok := annotations.SubsetClientCredentialNames[subset.Name]; ok {
+			opts.clientCredentialName = name
+		}
 		applyTrafficPolicy(opts)
 
 		// If subset has a traffic policy, apply it so that it overrides the destination rule traffic policy.
 		if subset.TrafficPolicy != nil {
 			opts.policy = subset.TrafficPolicy
 			applyTrafficPolicy(opts)
+			applySubsetOutlierDetection(subsetCluster, destinationRule.TrafficPolicy, subset.TrafficPolicy, port)
 		}
 
 		maybeApplyEdsConfig(subsetCluster)
+		applyDestinationRuleAnnotations(subsetCluster, port, annotations)
+		applyEndpointPort(subsetCluster, annotations.EndpointPorts, port)
+		applyHealthCheckHost(subsetCluster, annotations.HealthCheckHost)
+		cb.applyMaxConnectionsPerHost(subsetCluster, service, port, []labels.Instance{subset.Labels},
+			annotations.MaxConnectionsPerHost)
 
-		subsetCluster.Metadata = util.AddSubsetToMetadata(clusterMetadata, subset.Name)
+		subsetCluster.Metadata = keepAutoMtlsMetadata(subsetCluster, util.AddCanonicalServiceToMetadata(
+			util.AddSubsetToMetadata(clusterMetadata, subset.Name), service, subset.Labels))
+		if subset.TrafficPolicy != nil {
+			addTCPIdleTimeoutToMetadata(subsetCluster.Metadata, subset.TrafficPolicy, port)
+		}
 		subsetClusters = append(subsetClusters, subsetCluster)
 	}
 	return subsetClusters
 }
 
+// applyEndpointPort remaps the port of the endpoints that a cluster carries itself, as set by the endpointPorts
+// annotation of the destination rule. The endpoints of EDS clusters are remapped when they are pushed.
+func applyEndpointPort(cluster *apiv2.Cluster, endpointPorts map[int]uint32, port *model.Port) {
+	if port == nil || cluster.LoadAssignment == nil {
+		return
+	}
+	if endpointPort, ok := endpointPorts[port.Port]; ok {
+		cluster.LoadAssignment.Endpoints = util.WithLbEndpointsPort(cluster.LoadAssignment.Endpoints, endpointPort)
+	}
+}
+
+// applyHealthCheckHost sets the host of the healthCheckHost annotation on the endpoints that a cluster carries itself.
+// Envoy sends the host of an endpoint in all of its HTTP health checks, including the ones that EnvoyFilter patches
+// add once the cluster is built. The endpoints of EDS clusters get the host when they are pushed.
+func applyHealthCheckHost(cluster *apiv2.Cluster, host string) {
+	if host == "" || cluster.LoadAssignment == nil {
+		return
+	}
+	cluster.LoadAssignment.Endpoints = util.WithLbEndpointsHealthCheckHostname(cluster.LoadAssignment.Endpoints, host)
+}
+
+// addTCPIdleTimeoutToMetadata records the idle timeout of the connection pool settings of a TCP port in the cluster
+// metadata. Clusters have no idle timeout for TCP connections, so it is only recorded; the TCP proxy filter does not
+// read it, and keeps the idle timeout of the proxy metadata.
+func addTCPIdleTimeoutToMetadata(md *core.Metadata, policy *networking.TrafficPolicy, port *model.Port) {
+	if port == nil || port.Protocol != protocol.TCP {
+		return
+	}
+	connectionPool, _, _, _ := SelectTrafficPolicyComponents(policy, port)
+	if connectionPool.GetHttp().GetIdleTimeout() == nil {
+		return
+	}
+	idleTimeout, err := types.DurationFromProto(connectionPool.Http.IdleTimeout)
+	if err != nil {
+		return
+	}
+	md.FilterMetadata[util.IstioMetadataKey].Fields["tcpIdleTimeout"] = &structpb.Value{
+		Kind: &structpb.Value_StringValue{StringValue: idleTimeout.String()},
+	}
+}
+
+// addPortNameToMetadata records the name of the service port in the istio metadata of a cluster, so that telemetry
+// and diagnostics can refer to the port by name. Ports without a name are recorded by their number.
+func addPortNameToMetadata(md *core.Metadata, port *model.Port) {
+	if port == nil {
+		return
+	}
+	portName := port.Name
+	if portName == "" {
+		portName = strconv.Itoa(port.Port)
+	}
+	md.FilterMetadata[util.IstioMetadataKey].Fields["portName"] = &structpb.Value{
+		Kind: &structpb.Value_StringValue{StringValue: portName},
+	}
+}
+
+// addResolutionToMetadata records how the endpoints of the service are resolved, i.e. ClientSide, DNS or Passthrough,
+// in the istio metadata of a cluster, so that filters and tooling need not infer it from the cluster type.
+func addResolutionToMetadata(md *core.Metadata, service *model.Service) {
+	md.FilterMetadata[util.IstioMetadataKey].Fields["resolution"] = &structpb.Value{
+		Kind: &structpb.Value_StringValue{StringValue: service.Resolution.String()},
+	}
+}
+
+// addConsistentHashKeysToMetadata records the ordered keys that a consistent hash cluster hashes requests on in its
+// istio metadata. The keys of the consistentHashKeys annotation take precedence over the single key of the load
+// balancer settings. Clusters of other load balancing policies have nothing to record.
+func addConsistentHashKeysToMetadata(md *core.Metadata, cluster *apiv2.Cluster, lb *networking.LoadBalancerSettings,
+	keys []string) {
+	if cluster.LbPolicy != apiv2.Cluster_RING_HASH && cluster.LbPolicy != apiv2.Cluster_MAGLEV {
+		return
+	}
+	if len(keys) == 0 {
+		if key := consistentHashKey(lb.GetConsistentHash()); key != "" {
+			keys = []string{key}
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	values := make([]*structpb.Value, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: key}})
+	}
+	md.FilterMetadata[util.IstioMetadataKey].Fields["consistentHashKeys"] = &structpb.Value{
+		Kind: &structpb.Value_ListValue{ListValue: &structpb.ListValue{Values: values}},
+	}
+}
+
+// consistentHashKey returns the hash key of the consistent hash load balancer settings in the format of the
+// consistentHashKeys annotation, or an empty string if there is none.
+func consistentHashKey(consistentHash *networking.LoadBalancerSettings_ConsistentHashLB) string {
+	switch consistentHash.GetHashKey().(type) {
+	case *networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName:
+		return "header:" + consistentHash.GetHttpHeaderName()
+	case *networking.LoadBalancerSettings_ConsistentHashLB_HttpCookie:
+		return "cookie:" + consistentHash.GetHttpCookie().GetName()
+	case *networking.LoadBalancerSettings_ConsistentHashLB_HttpQueryParameterName:
+		return "queryParameter:" + consistentHash.GetHttpQueryParameterName()
+	case *networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp:
+		return "sourceIP"
+	}
+	return ""
+}
+
+// withSidecarConnectionPool returns the traffic policy with the default outbound connection pool settings of the
+// Sidecar of the proxy, unless the policy selects connection pool settings for the port itself.
+func (cb *ClusterBuilder) withSidecarConnectionPool(policy *networking.TrafficPolicy, port *model.Port) *networking.TrafficPolicy {
+	if cb.proxy.SidecarScope == nil || cb.proxy.SidecarScope.OutboundConnectionPool == nil {
+		return policy
+	}
+	if connectionPool, _, _, _ := SelectTrafficPolicyComponents(policy, port); connectionPool != nil {
+		return policy
+	}
+	connectionPool := cb.proxy.SidecarScope.OutboundConnectionPool
+	if policy == nil {
+		return &networking.TrafficPolicy{ConnectionPool: connectionPool}
+	}
+
+	// Copy the policy, so that the shared destination rule is not modified.
+	out := *policy
+	out.ConnectionPool = connectionPool
+	if port != nil && len(policy.PortLevelSettings) > 0 {
+		out.PortLevelSettings = make([]*networking.TrafficPolicy_PortTrafficPolicy, 0, len(policy.PortLevelSettings))
+		for _, p := range policy.PortLevelSettings {
+			if p.Port != nil && uint32(port.Port) == p.Port.Number {
+				portPolicy := *p
+				portPolicy.ConnectionPool = connectionPool
+				p = &portPolicy
+			}
+			out.PortLevelSettings = append(out.PortLevelSettings, p)
+		}
+	}
+	return &out
+}
+
+// applySubsetOutlierDetection overrides the outlier detection of the destination rule with the one of the subset
+// field by field, rather than replacing it as a whole. A subset can disable outlier detection by setting its
+// interval to zero.
+func applySubsetOutlierDetection(cluster *apiv2.Cluster, policy *networking.TrafficPolicy,
+	subsetPolicy *networking.TrafficPolicy, port *model.Port) {
+	_, subsetOutlier, _, _ := SelectTrafficPolicyComponents(subsetPolicy, port)
+	if subsetOutlier == nil {
+		return
+	}
+	if interval := subsetOutlier.Interval; interval != nil && interval.Seconds == 0 && interval.Nanos == 0 {
+		cluster.OutlierDetection = nil
+		return
+	}
+	_, outlier, _, _ := SelectTrafficPolicyComponents(policy, port)
+	if outlier == nil {
+		return
+	}
+	applyOutlierDetection(cluster, mergeOutlierDetection(outlier, subsetOutlier))
+}
+
+// mergeOutlierDetection returns a copy of the outlier detection with the fields set in override replacing its own.
+func mergeOutlierDetection(outlier, override *networking.OutlierDetection) *networking.OutlierDetection {
+	merged := *outlier
+	if override.BaseEjectionTime != nil {
+		merged.BaseEjectionTime = override.BaseEjectionTime
+	}
+	if override.ConsecutiveErrors > 0 {
+		merged.ConsecutiveErrors = override.ConsecutiveErrors
+	}
+	if override.Consecutive_5XxErrors != nil {
+		merged.Consecutive_5XxErrors = override.Consecutive_5XxErrors
+	}
+	if override.ConsecutiveGatewayErrors != nil {
+		merged.ConsecutiveGatewayErrors = override.ConsecutiveGatewayErrors
+	}
+	if override.Interval != nil {
+		merged.Interval = override.Interval
+	}
+	if override.MaxEjectionPercent > 0 {
+		merged.MaxEjectionPercent = override.MaxEjectionPercent
+	}
+	if override.MinHealthPercent > 0 {
+		merged.MinHealthPercent = override.MinHealthPercent
+	}
+	return &merged
+}
+
 // buildDefaultCluster builds the default cluster and also applies default traffic policy.
 func (cb *ClusterBuilder) buildDefaultCluster(name string, discoveryType apiv2.Cluster_DiscoveryType,
 	localityLbEndpoints []*endpoint.LocalityLbEndpoints, direction model.TrafficDirection,
@@ -146,9 +404,17 @@ func (cb *ClusterBuilder) buildDefaultCluster(name string, discoveryType apiv2.C
 	switch discoveryType {
 	case apiv2.Cluster_STRICT_DNS:
 		cluster.DnsLookupFamily = apiv2.Cluster_V4_ONLY
-		dnsRate := gogo.DurationToProtoDuration(cb.push.Mesh.DnsRefreshRate)
-		cluster.DnsRefreshRate = dnsRate
+		cluster.DnsRefreshRate = dnsRefreshRate(cb.push.Mesh)
 		cluster.RespectDnsTtl = true
+		// Without a failure refresh rate, Envoy retries failed resolutions at the regular refresh rate.
+		if baseInterval := features.DNSFailureRefreshBaseInterval.Get(); baseInterval > 0 {
+			cluster.DnsFailureRefreshRate = &apiv2.Cluster_RefreshRate{
+				BaseInterval: ptypes.DurationProto(baseInterval),
+			}
+			if maxInterval := features.DNSFailureRefreshMaxInterval.Get(); maxInterval > baseInterval {
+				cluster.DnsFailureRefreshRate.MaxInterval = ptypes.DurationProto(maxInterval)
+			}
+		}
 		fallthrough
 	case apiv2.Cluster_STATIC:
 		if len(localityLbEndpoints) == 0 {
@@ -167,7 +433,7 @@ func (cb *ClusterBuilder) buildDefaultCluster(name string, discoveryType apiv2.C
 	opts := buildClusterOpts{
 		push:            cb.push,
 		cluster:         cluster,
-		policy:          cb.defaultTrafficPolicy(discoveryType),
+		policy:          cb.defaultTrafficPolicy(discoveryType, direction),
 		port:            port,
 		serviceAccounts: nil,
 		istioMtlsSni:    "",
@@ -177,14 +443,91 @@ func (cb *ClusterBuilder) buildDefaultCluster(name string, discoveryType apiv2.C
 		meshExternal:    meshExternal,
 	}
 	applyTrafficPolicy(opts)
+	cluster.TrackTimeoutBudgets = features.EnableTimeoutBudgetStats.Get()
 
 	return cluster
 }
 
+// buildHeadlessPodClusters builds a STATIC cluster for every pod backing a headless service, so that individual pods
+// can be addressed by their DNS name <pod>.<service hostname>, e.g. the replicas of a StatefulSet.
+func (cb *ClusterBuilder) buildHeadlessPodClusters(service *model.Service, port *model.Port,
+	proxyNetworkView map[string]bool) []*apiv2.Cluster {
+	instances, err := cb.push.InstancesByPort(service, port.Port, nil)
+	if err != nil {
+		log.Errorf("failed to retrieve instances for %s: %v", service.Hostname, err)
+		return nil
+	}
+
+	clusters := make([]*apiv2.Cluster, 0, len(instances))
+	for _, instance := range instances {
+		if !proxyNetworkView[instance.Endpoint.Network] {
+			continue
+		}
+		podName := podNameFromUID(instance.Endpoint.UID, service.Attributes.Namespace)
+		if podName == "" {
+			continue
+		}
+		podHostname := host.Name(podName + "." + string(service.Hostname))
+		clusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", podHostname, port.Port)
+		lbEndpoints := []*endpoint.LocalityLbEndpoints{
+			{
+				Locality: util.ConvertLocality(instance.Endpoint.Locality.Label),
+				LbEndpoints: []*endpoint.LbEndpoint{
+					{
+						HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+							Endpoint: &endpoint.Endpoint{
+								Address: util.BuildAddress(instance.Endpoint.Address, instance.Endpoint.EndpointPort),
+							},
+						},
+						Metadata: util.BuildLbEndpointMetadata(instance.Endpoint.UID, instance.Endpoint.ServiceAccount,
+							instance.Endpoint.Network, instance.Endpoint.TLSMode, cb.push),
+					},
+				},
+			},
+		}
+		podCluster := cb.buildDefaultCluster(clusterName, apiv2.Cluster_STATIC, lbEndpoints,
+			model.TrafficDirectionOutbound, port, service.MeshExternal)
+		if podCluster == nil {
+			continue
+		}
+		setUpstreamProtocol(cb.proxy, podCluster, port, model.TrafficDirectionOutbound)
+		clusters = append(clusters, podCluster)
+	}
+	return clusters
+}
+
+// podNameFromUID extracts the pod name from a Kubernetes endpoint UID of the form kubernetes://<pod>.<namespace>.
+// It returns an empty string for endpoints that are not backed by a Kubernetes pod.
+func podNameFromUID(uid string, namespace string) string {
+	const kubernetesUIDPrefix = "kubernetes://"
+	if !strings.HasPrefix(uid, kubernetesUIDPrefix) || namespace == "" {
+		return ""
+	}
+	name := strings.TrimPrefix(uid, kubernetesUIDPrefix)
+	if !strings.HasSuffix(name, "."+namespace) {
+		return ""
+	}
+	return strings.TrimSuffix(name, "."+namespace)
+}
+
 // buildInboundPassthroughClusters builds passthrough clusters for inbound.
 func (cb *ClusterBuilder) buildInboundPassthroughClusters() []*apiv2.Cluster {
 	// ipv4 and ipv6 feature detection. Envoy cannot ignore a config where the ip version is not supported
 	clusters := make([]*apiv2.Cluster, 0, 2)
+	if features.DisableInboundPassthroughClusters.Get() {
+		// The inbound listeners still reference the passthrough clusters, keep them as black holes.
+		if cb.proxy.SupportsIPv4() {
+			blackHoleIpv4 := cb.buildBlackHoleCluster()
+			blackHoleIpv4.Name = util.InboundPassthroughClusterIpv4
+			clusters = append(clusters, blackHoleIpv4)
+		}
+		if cb.proxy.SupportsIPv6() {
+			blackHoleIpv6 := cb.buildBlackHoleCluster()
+			blackHoleIpv6.Name = util.InboundPassthroughClusterIpv6
+			clusters = append(clusters, blackHoleIpv6)
+		}
+		return clusters
+	}
 	if cb.proxy.SupportsIPv4() {
 		inboundPassthroughClusterIpv4 := cb.buildDefaultPassthroughCluster()
 		inboundPassthroughClusterIpv4.Name = util.InboundPassthroughClusterIpv4
@@ -240,13 +583,43 @@ func (cb *ClusterBuilder) buildDefaultPassthroughCluster() *apiv2.Cluster {
 	return cluster
 }
 
+// buildOutboundPassthroughCluster generates the passthrough cluster for outbound traffic. If requested by the proxy,
+// the original destination of HTTP requests is read from the x-envoy-original-dst-host header. This is not done
+// for the inbound passthrough clusters, as it would let callers redirect traffic received by the proxy.
+func (cb *ClusterBuilder) buildOutboundPassthroughCluster() *apiv2.Cluster {
+	cluster := cb.buildDefaultPassthroughCluster()
+	if cb.proxy.Metadata.PassthroughUseHTTPHeader {
+		cluster.LbConfig = &apiv2.Cluster_OriginalDstLbConfig_{
+			OriginalDstLbConfig: &apiv2.Cluster_OriginalDstLbConfig{UseHttpHeader: true},
+		}
+	}
+	return cluster
+}
+
+// meshDefaultLbType returns the load balancing policy of clusters whose DestinationRule does not specify one. It is
+// DefaultLbType, unless another policy is configured for the mesh.
+func meshDefaultLbType() networking.LoadBalancerSettings_SimpleLB {
+	name := features.DefaultLbPolicy.Get()
+	if name == "" {
+		return DefaultLbType
+	}
+	lbType, ok := networking.LoadBalancerSettings_SimpleLB_value[name]
+	if !ok || networking.LoadBalancerSettings_SimpleLB(lbType) == networking.LoadBalancerSettings_PASSTHROUGH {
+		log.Warnf("ignoring invalid default load balancing policy %q", name)
+		return DefaultLbType
+	}
+	return networking.LoadBalancerSettings_SimpleLB(lbType)
+}
+
 // defaultTrafficPolicy builds a default traffic policy applying default connection timeouts.
-func (cb *ClusterBuilder) defaultTrafficPolicy(discoveryType apiv2.Cluster_DiscoveryType) *networking.TrafficPolicy {
-	lbPolicy := DefaultLbType
+// Inbound clusters also get the inbound circuit breaker defaults, if any are configured.
+func (cb *ClusterBuilder) defaultTrafficPolicy(discoveryType apiv2.Cluster_DiscoveryType,
+	direction model.TrafficDirection) *networking.TrafficPolicy {
+	lbPolicy := meshDefaultLbType()
 	if discoveryType == apiv2.Cluster_ORIGINAL_DST {
 		lbPolicy = networking.LoadBalancerSettings_PASSTHROUGH
 	}
-	return &networking.TrafficPolicy{
+	policy := &networking.TrafficPolicy{
 		LoadBalancer: &networking.LoadBalancerSettings{
 			LbPolicy: &networking.LoadBalancerSettings_Simple{
 				Simple: lbPolicy,
@@ -261,6 +634,23 @@ func (cb *ClusterBuilder) defaultTrafficPolicy(discoveryType apiv2.Cluster_Disco
 			},
 		},
 	}
+	// The connect timeout of the Sidecar of the proxy replaces the mesh wide one for outbound clusters. A destination
+	// rule still takes precedence, as its connection pool is applied on top.
+	if direction == model.TrafficDirectionOutbound && cb.proxy.SidecarScope != nil &&
+		cb.proxy.SidecarScope.OutboundConnectTimeout > 0 {
+		policy.ConnectionPool.Tcp.ConnectTimeout = types.DurationProto(cb.proxy.SidecarScope.OutboundConnectTimeout)
+	}
+	if direction == model.TrafficDirectionInbound {
+		if maxConnections := features.InboundDefaultMaxConnections.Get(); maxConnections > 0 {
+			policy.ConnectionPool.Tcp.MaxConnections = int32(maxConnections)
+		}
+		if maxRequests := features.InboundDefaultMaxRequests.Get(); maxRequests > 0 {
+			policy.ConnectionPool.Http = &networking.ConnectionPoolSettings_HTTPSettings{
+				Http2MaxRequests: int32(maxRequests),
+			}
+		}
+	}
+	return policy
 }
 
 // castDestinationRuleOrDefault returns the destination rule enclosed by the config, if not null.
@@ -273,11 +663,262 @@ func castDestinationRuleOrDefault(config *model.Config) *networking.DestinationR
 	return &defaultDestinationRule
 }
 
-// maybeApplyEdsConfig applies EdsClusterConfig on the passed in cluster if it is an EDS type of cluster.
+// applyDestinationRuleAnnotations applies cluster settings that are not part of the DestinationRule API yet and are
+// instead configured through annotations on the DestinationRule.
+func applyDestinationRuleAnnotations(cluster *apiv2.Cluster, port *model.Port, annotations *model.DestinationRuleAnnotations) {
+	if annotations.CloseConnectionsOnHostHealthFailure {
+		cluster.CloseConnectionsOnHostHealthFailure = true
+	}
+	if annotations.UseDownstreamProtocol {
+		applyUseDownstreamProtocol(cluster, port)
+	}
+	applyHTTP2ProtocolOptions(cluster, annotations)
+	applyRetryBudgets(cluster, annotations.RetryBudget, annotations.HighPriorityRetryBudget)
+	if annotations.EdsInitialFetchTimeout > 0 && cluster.GetEdsClusterConfig().GetEdsConfig() != nil {
+		cluster.EdsClusterConfig.EdsConfig.InitialFetchTimeout = ptypes.DurationProto(annotations.EdsInitialFetchTimeout)
+	}
+	applyLoadBalancerExtension(cluster, annotations.LoadBalancerExtension, annotations.LoadBalancerExtensionConfig)
+	if cluster.OutlierDetection != nil {
+		applyOutlierSuccessRate(cluster.OutlierDetection, annotations)
+		applyOutlierFailurePercentage(cluster.OutlierDetection, annotations)
+		applyOutlierEnforcing(cluster.OutlierDetection, annotations)
+	}
+	if annotations.UseHostnameForHashing {
+		applyUseHostnameForHashing(cluster)
+	}
+}
+
+// applyUseHostnameForHashing makes the consistent hash load balancer of a DNS cluster hash the hostnames of the
+// endpoints. Other clusters have no endpoint hostnames to hash, and are left hashing the endpoint addresses.
+func applyUseHostnameForHashing(cluster *apiv2.Cluster) {
+	if cluster.GetType() != apiv2.Cluster_STRICT_DNS && cluster.GetType() != apiv2.Cluster_LOGICAL_DNS {
+		return
+	}
+	if cluster.LbPolicy != apiv2.Cluster_RING_HASH && cluster.LbPolicy != apiv2.Cluster_MAGLEV {
+		return
+	}
+	if cluster.CommonLbConfig == nil {
+		cluster.CommonLbConfig = &apiv2.Cluster_CommonLbConfig{}
+	}
+	cluster.CommonLbConfig.ConsistentHashingLbConfig = &apiv2.Cluster_CommonLbConfig_ConsistentHashingLbConfig{
+		UseHostnameForHashing: true,
+	}
+}
+
+// applyLoadBalancerExtension makes the cluster delegate load balancing to the custom load balancer extension named
+// by the destination rule, passing it the configured typed config.
+func applyLoadBalancerExtension(cluster *apiv2.Cluster, name string, config *structpb.Struct) {
+	if name == "" || cluster.GetType() == apiv2.Cluster_ORIGINAL_DST {
+		// Original destination clusters always route to the requested address.
+		return
+	}
+	policy := &apiv2.LoadBalancingPolicy_Policy{
+		Name: name,
+	}
+	if config != nil {
+		policy.TypedConfig = util.MessageToAny(config)
+	}
+	// The load balancing policy is only used by Envoy with this lb policy.
+	cluster.LbPolicy = apiv2.Cluster_LOAD_BALANCING_POLICY_CONFIG
+	cluster.LoadBalancingPolicy = &apiv2.LoadBalancingPolicy{
+		Policies: []*apiv2.LoadBalancingPolicy_Policy{policy},
+	}
+}
+
+// applyOutlierSuccessRate tunes success rate based ejection for a cluster with outlier detection. Once tuned,
+// success rate based ejection is enforced explicitly, rather than relying on the Envoy default.
+func applyOutlierSuccessRate(out *v2Cluster.OutlierDetection, annotations *model.DestinationRuleAnnotations) {
+	var stdevFactor *wrappers.UInt32Value
+	if annotations.OutlierSuccessRateStdevFactor > 0 {
+		// Envoy takes the factor multiplied by 1000.
+		stdevFactor = &wrappers.UInt32Value{Value: uint32(math.Round(annotations.OutlierSuccessRateStdevFactor * 1000))}
+	}
+	if annotations.OutlierSuccessRateMinimumHosts == nil && annotations.OutlierSuccessRateRequestVolume == nil &&
+		stdevFactor == nil {
+		return
+	}
+	out.SuccessRateMinimumHosts = annotations.OutlierSuccessRateMinimumHosts
+	out.SuccessRateRequestVolume = annotations.OutlierSuccessRateRequestVolume
+	out.SuccessRateStdevFactor = stdevFactor
+	out.EnforcingSuccessRate = &wrappers.UInt32Value{Value: 100}
+}
+
+// applyOutlierFailurePercentage enables failure percentage based ejection for a cluster with outlier detection. It
+// complements the consecutive error and success rate based ejection that is already configured.
+func applyOutlierFailurePercentage(out *v2Cluster.OutlierDetection, annotations *model.DestinationRuleAnnotations) {
+	if annotations.OutlierFailurePercentageThreshold == nil {
+		return
+	}
+	out.FailurePercentageThreshold = annotations.OutlierFailurePercentageThreshold
+	out.EnforcingFailurePercentage = &wrappers.UInt32Value{Value: 100} // defaults to 0
+	out.FailurePercentageMinimumHosts = annotations.OutlierFailurePercentageMinimumHosts
+	out.FailurePercentageRequestVolume = annotations.OutlierFailurePercentageRequestVolume
+}
+
+// applyOutlierEnforcing overrides the percentage of detected outliers that are ejected, per kind of detection, for a
+// cluster with outlier detection.
+func applyOutlierEnforcing(out *v2Cluster.OutlierDetection, annotations *model.DestinationRuleAnnotations) {
+	if v := annotations.OutlierEnforcingConsecutive5xx; v != nil {
+		out.EnforcingConsecutive_5Xx = v
+	}
+	if v := annotations.OutlierEnforcingConsecutiveGatewayErrors; v != nil {
+		out.EnforcingConsecutiveGatewayFailure = v
+	}
+	if v := annotations.OutlierEnforcingSuccessRate; v != nil {
+		out.EnforcingSuccessRate = v
+	}
+	if annotations.OutlierDetectionOnly {
+		out.EnforcingConsecutive_5Xx = &wrappers.UInt32Value{Value: 0}
+		out.EnforcingConsecutiveGatewayFailure = &wrappers.UInt32Value{Value: 0}
+		out.EnforcingConsecutiveLocalOriginFailure = &wrappers.UInt32Value{Value: 0}
+		out.EnforcingSuccessRate = &wrappers.UInt32Value{Value: 0}
+		out.EnforcingLocalOriginSuccessRate = &wrappers.UInt32Value{Value: 0}
+		out.EnforcingFailurePercentage = &wrappers.UInt32Value{Value: 0}
+		out.EnforcingFailurePercentageLocalOrigin = &wrappers.UInt32Value{Value: 0}
+	}
+}
+
+// applyRetryBudgets sets the retry budgets of the cluster, in percent, for the default and the high routing priority.
+// The high priority gets thresholds of its own, as Envoy tracks circuit breaking separately for each priority.
+func applyRetryBudgets(cluster *apiv2.Cluster, defaultBudget, highBudget float64) {
+	if defaultBudget == 0 && highBudget == 0 {
+		return
+	}
+
+	if cluster.CircuitBreakers == nil {
+		cluster.CircuitBreakers = &v2Cluster.CircuitBreakers{
+			Thresholds: []*v2Cluster.CircuitBreakers_Thresholds{getDefaultCircuitBreakerThresholds()},
+		}
+	}
+	if defaultBudget != 0 {
+		cluster.CircuitBreakers.Thresholds[0].RetryBudget = &v2Cluster.CircuitBreakers_Thresholds_RetryBudget{
+			BudgetPercent: &xdstype.Percent{Value: defaultBudget},
+		}
+	}
+	if highBudget != 0 {
+		threshold := getDefaultCircuitBreakerThresholds()
+		threshold.Priority = core.RoutingPriority_HIGH
+		threshold.RetryBudget = &v2Cluster.CircuitBreakers_Thresholds_RetryBudget{
+			BudgetPercent: &xdstype.Percent{Value: highBudget},
+		}
+		cluster.CircuitBreakers.Thresholds = append(cluster.CircuitBreakers.Thresholds, threshold)
+	}
+}
+
+// applyUseDownstreamProtocol makes an HTTP cluster mirror the downstream protocol, unless HTTP/2 has been
+// explicitly configured for the upstream.
+func applyUseDownstreamProtocol(cluster *apiv2.Cluster, port *model.Port) {
+	if port == nil || !(port.Protocol.IsHTTP() || port.Protocol == protocol.Unsupported) || port.Protocol.IsHTTP2() {
+		return
+	}
+	if cluster.Http2ProtocolOptions != nil && cluster.ProtocolSelection == apiv2.Cluster_USE_CONFIGURED_PROTOCOL {
+		// The destination rule upgrades the connection to HTTP/2.
+		return
+	}
+	cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{
+		// Envoy default value of 100 is too low for data path.
+		MaxConcurrentStreams: &wrappers.UInt32Value{
+			Value: 1073741824,
+		},
+	}
+	cluster.ProtocolSelection = apiv2.Cluster_USE_DOWNSTREAM_PROTOCOL
+}
+
+// applyHTTP2ProtocolOptions limits the concurrent streams per connection, and sets the initial stream and
+// connection window sizes, of an HTTP/2 cluster.
+func applyHTTP2ProtocolOptions(cluster *apiv2.Cluster, annotations *model.DestinationRuleAnnotations) {
+	options := cluster.Http2ProtocolOptions
+	if options == nil {
+		return
+	}
+	if annotations.MaxConcurrentStreams > 0 {
+		options.MaxConcurrentStreams = &wrappers.UInt32Value{Value: annotations.MaxConcurrentStreams}
+	}
+	if annotations.HTTP2InitialStreamWindowSize > 0 {
+		options.InitialStreamWindowSize = &wrappers.UInt32Value{Value: annotations.HTTP2InitialStreamWindowSize}
+	}
+	if annotations.HTTP2InitialConnectionWindowSize > 0 {
+		options.InitialConnectionWindowSize = &wrappers.UInt32Value{Value: annotations.HTTP2InitialConnectionWindowSize}
+	}
+}
+
+// applyMaxConnectionsPerHost derives the cluster wide connection limit from the per host limit requested on the
+// destination rule and the number of endpoints of the cluster. The stricter of this limit and the one set by the
+// connection pool settings is used. As endpoint updates do not regenerate clusters, the limit is only
+// recomputed on full pushes.
+func (cb *ClusterBuilder) applyMaxConnectionsPerHost(cluster *apiv2.Cluster, service *model.Service, port *model.Port,
+	subsetLabels labels.Collection, maxConnectionsPerHost uint32) {
+	if maxConnectionsPerHost == 0 {
+		return
+	}
+	instances, err := cb.push.InstancesByPort(service, port.Port, subsetLabels)
+	if err != nil {
+		log.Errorf("failed to retrieve instances for %s: %v", service.Hostname, err)
+		return
+	}
+	// A cluster without endpoints still gets the limit of a single host, so that it is usable as soon as the
+	// first endpoint shows up.
+	hosts := uint64(len(instances))
+	if hosts == 0 {
+		hosts = 1
+	}
+	maxConnections := uint64(maxConnectionsPerHost) * hosts
+	if maxConnections > math.MaxUint32 {
+		maxConnections = math.MaxUint32
+	}
+
+	if cluster.CircuitBreakers == nil {
+		cluster.CircuitBreakers = &v2Cluster.CircuitBreakers{
+			Thresholds: []*v2Cluster.CircuitBreakers_Thresholds{getDefaultCircuitBreakerThresholds()},
+		}
+	}
+	threshold := cluster.CircuitBreakers.Thresholds[0]
+	if threshold.MaxConnections == nil || uint64(threshold.MaxConnections.Value) > maxConnections {
+		threshold.MaxConnections = &wrappers.UInt32Value{Value: uint32(maxConnections)}
+	}
+}
+
+// buildLbSubsetConfig builds the subset load balancer config for the subsets of a destination rule. Requests that
+// do not select a subset fall back to the named default subset, or to any endpoint if the default subset does not
+// exist or has no labels.
+func buildLbSubsetConfig(subsets []*networking.Subset, defaultSubset string) *apiv2.Cluster_LbSubsetConfig {
+	lbSubsetConfig := &apiv2.Cluster_LbSubsetConfig{
+		FallbackPolicy: apiv2.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+	}
+	selectors := make(map[string]bool)
+	for _, subset := range subsets {
+		if len(subset.Labels) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(subset.Labels))
+		for k := range subset.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if selector := strings.Join(keys, ","); !selectors[selector] {
+			selectors[selector] = true
+			lbSubsetConfig.SubsetSelectors = append(lbSubsetConfig.SubsetSelectors,
+				&apiv2.Cluster_LbSubsetConfig_LbSubsetSelector{Keys: keys})
+		}
+		if subset.Name == defaultSubset {
+			fields := make(map[string]*structpb.Value, len(subset.Labels))
+			for k, v := range subset.Labels {
+				fields[k] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: v}}
+			}
+			lbSubsetConfig.FallbackPolicy = apiv2.Cluster_LbSubsetConfig_DEFAULT_SUBSET
+			lbSubsetConfig.DefaultSubset = &structpb.Struct{Fields: fields}
+		}
+	}
+	return lbSubsetConfig
+}
+
+// maybeApplyEdsConfig applies EdsClusterConfig on the passed in cluster if it is an EDS type of cluster. For any other
+// type, an EdsClusterConfig set before the discovery type was changed is cleared.
 func maybeApplyEdsConfig(cluster *apiv2.Cluster) {
 	switch v := cluster.ClusterDiscoveryType.(type) {
 	case *apiv2.Cluster_Type:
 		if v.Type != apiv2.Cluster_EDS {
+			cluster.EdsClusterConfig = nil
 			return
 		}
 	}
@@ -15,6 +15,8 @@
 package v1alpha3
 
 import (
+	"fmt"
+	"os"
 	"reflect"
 	"testing"
 
@@ -24,15 +26,21 @@ import (
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
 
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/duration"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 	"github.com/golang/protobuf/ptypes/wrappers"
 
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/fakes"
+	"istio.io/istio/pilot/pkg/networking/plugin"
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/schema/collections"
 	"istio.io/istio/pkg/config/schema/resource"
@@ -263,6 +271,211 @@ func compareClusters(t *testing.T, ec *apiv2.Cluster, gc *apiv2.Cluster) {
 	}
 }
 
+// applyAnnotatedDestinationRule applies a destination rule with the given traffic policy, a single subset v1 and the
+// given annotations to the EDS cluster of port 8080 of foo.example.org, which is backed by a single endpoint. It
+// returns the default cluster and the subset cluster.
+func applyAnnotatedDestinationRule(t *testing.T, policy *networking.TrafficPolicy,
+	annotations map[string]string) (*apiv2.Cluster, *apiv2.Cluster) {
+	t.Helper()
+	port := &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:    host.Name("foo.example.org"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports:       model.PortList{port},
+		Resolution:  model.ClientSideLB,
+		Attributes:  model.ServiceAttributes{Namespace: TestServiceNamespace},
+	}
+	destRule := &networking.DestinationRule{
+		Host:          "foo.example.org",
+		TrafficPolicy: policy,
+		Subsets:       []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	}
+	instances := []*model.ServiceInstance{
+		{
+			Service:     service,
+			ServicePort: port,
+			Endpoint:    &model.IstioEndpoint{Address: "192.168.1.1", EndpointPort: 10001},
+		},
+	}
+
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+	serviceDiscovery.InstancesByPortReturns(instances, nil)
+	configStore := &fakes.IstioConfigStore{
+		ListStub: func(typ resource.GroupVersionKind, namespace string) (configs []model.Config, e error) {
+			if typ == collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind() {
+				return []model.Config{
+					{ConfigMeta: model.ConfigMeta{
+						Type:        collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+						Version:     collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+						Name:        "acme",
+						Annotations: annotations,
+					},
+						Spec: destRule,
+					}}, nil
+			}
+			return nil, nil
+		},
+	}
+	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+	proxy := &model.Proxy{Type: model.SidecarProxy, Metadata: &model.NodeMetadata{}}
+	proxy.SetSidecarScope(env.PushContext)
+	cb := NewClusterBuilder(proxy, env.PushContext)
+
+	cluster := &apiv2.Cluster{
+		Name:                 "outbound|8080||foo.example.org",
+		ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+	}
+	subsetClusters := cb.applyDestinationRule(cluster, DefaultClusterMode, service, port, map[string]bool{"": true})
+	if len(subsetClusters) != 1 {
+		t.Fatalf("Unexpected subset clusters want 1, got %d", len(subsetClusters))
+	}
+	return cluster, subsetClusters[0]
+}
+
+func TestApplyDestinationRuleCloseConnectionsOnHostHealthFailure(t *testing.T) {
+	cluster, subsetCluster := applyAnnotatedDestinationRule(t, nil, nil)
+	if cluster.CloseConnectionsOnHostHealthFailure || subsetCluster.CloseConnectionsOnHostHealthFailure {
+		t.Errorf("Unexpected close connections on host health failure without the annotation")
+	}
+
+	cluster, subsetCluster = applyAnnotatedDestinationRule(t, nil,
+		map[string]string{model.CloseConnectionsOnHostHealthFailureAnnotation: "true"})
+	if !cluster.CloseConnectionsOnHostHealthFailure || !subsetCluster.CloseConnectionsOnHostHealthFailure {
+		t.Errorf("Expected close connections on host health failure, got %v for %s and %v for %s",
+			cluster.CloseConnectionsOnHostHealthFailure, cluster.Name,
+			subsetCluster.CloseConnectionsOnHostHealthFailure, subsetCluster.Name)
+	}
+}
+
+func TestApplyDestinationRuleMaxConnectionsPerHost(t *testing.T) {
+	cluster, subsetCluster := applyAnnotatedDestinationRule(t, nil,
+		map[string]string{model.MaxConnectionsPerHostAnnotation: "10"})
+	for _, c := range []*apiv2.Cluster{cluster, subsetCluster} {
+		// A single endpoint backs the clusters.
+		if got := c.CircuitBreakers.GetThresholds()[0].GetMaxConnections().GetValue(); got != 10 {
+			t.Errorf("Unexpected max connections for cluster %s, want 10, got %d", c.Name, got)
+		}
+	}
+}
+
+func TestApplyDestinationRuleMetadataAnnotations(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		field       string
+		expected    *structpb.Value
+	}{
+		{
+			name:        "stats histogram buckets",
+			annotations: map[string]string{model.StatsHistogramBucketsAnnotation: "fine-grained"},
+			field:       "histogramBuckets",
+			expected:    &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: "fine-grained"}},
+		},
+		{
+			name:        "stats tags",
+			annotations: map[string]string{model.StatsTagsAnnotation: `{"team": "payments"}`},
+			field:       "statsTags",
+			expected: &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{
+				Fields: map[string]*structpb.Value{
+					"team": {Kind: &structpb.Value_StringValue{StringValue: "payments"}},
+				},
+			}}},
+		},
+		{
+			name:        "default request timeout",
+			annotations: map[string]string{model.DefaultRequestTimeoutAnnotation: "5s"},
+			field:       "defaultRequestTimeout",
+			expected:    &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: "5s"}},
+		},
+		{
+			name:        "default per try timeout",
+			annotations: map[string]string{model.DefaultPerTryTimeoutAnnotation: "2s"},
+			field:       "defaultPerTryTimeout",
+			expected:    &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: "2s"}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster, subsetCluster := applyAnnotatedDestinationRule(t, nil, nil)
+			for _, c := range []*apiv2.Cluster{cluster, subsetCluster} {
+				if got := c.Metadata.FilterMetadata[util.IstioMetadataKey].Fields[tt.field]; got != nil {
+					t.Errorf("Unexpected %s metadata without the annotation for cluster %s: %v", tt.field, c.Name, got)
+				}
+			}
+
+			cluster, subsetCluster = applyAnnotatedDestinationRule(t, nil, tt.annotations)
+			for _, c := range []*apiv2.Cluster{cluster, subsetCluster} {
+				if got := c.Metadata.FilterMetadata[util.IstioMetadataKey].Fields[tt.field]; !proto.Equal(got, tt.expected) {
+					t.Errorf("Unexpected %s metadata for cluster %s, want %v, got %v", tt.field, c.Name, tt.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyDestinationRuleWasmConfig(t *testing.T) {
+	cluster, subsetCluster := applyAnnotatedDestinationRule(t, nil, nil)
+	if cluster.Metadata.FilterMetadata[wasmMetadataKey] != nil || subsetCluster.Metadata.FilterMetadata[wasmMetadataKey] != nil {
+		t.Errorf("Unexpected WASM metadata without the annotation")
+	}
+
+	cluster, subsetCluster = applyAnnotatedDestinationRule(t, nil,
+		map[string]string{model.WasmConfigAnnotation: `{"rate_limit": 100}`})
+	expected := &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			"rate_limit": {Kind: &structpb.Value_NumberValue{NumberValue: 100}},
+		},
+	}
+	for _, c := range []*apiv2.Cluster{cluster, subsetCluster} {
+		if got := c.Metadata.FilterMetadata[wasmMetadataKey]; !proto.Equal(got, expected) {
+			t.Errorf("Unexpected WASM metadata for cluster %s, want %v, got %v", c.Name, expected, got)
+		}
+	}
+}
+
+func TestApplyDestinationRuleUseDownstreamProtocol(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   *networking.TrafficPolicy
+		expected apiv2.Cluster_ClusterProtocolSelection
+	}{
+		{
+			name:     "downstream protocol",
+			expected: apiv2.Cluster_USE_DOWNSTREAM_PROTOCOL,
+		},
+		{
+			name: "upgrading to http2 wins over the downstream protocol",
+			policy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Http: &networking.ConnectionPoolSettings_HTTPSettings{
+						H2UpgradePolicy: networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+					},
+				},
+			},
+			expected: apiv2.Cluster_USE_CONFIGURED_PROTOCOL,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster, subsetCluster := applyAnnotatedDestinationRule(t, tt.policy,
+				map[string]string{model.UseDownstreamProtocolAnnotation: "true"})
+			for _, c := range []*apiv2.Cluster{cluster, subsetCluster} {
+				if c.Http2ProtocolOptions == nil {
+					t.Errorf("Expected http2 protocol options for cluster %s", c.Name)
+				}
+				if c.ProtocolSelection != tt.expected {
+					t.Errorf("Unexpected protocol selection for cluster %s, want %v, got %v", c.Name, tt.expected, c.ProtocolSelection)
+				}
+			}
+		})
+	}
+}
+
 func TestApplyEdsConfig(t *testing.T) {
 
 	cases := []struct {
@@ -275,6 +488,25 @@ func TestApplyEdsConfig(t *testing.T) {
 			cluster:   &apiv2.Cluster{Name: "foo", ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STRICT_DNS}},
 			edsConfig: nil,
 		},
+		{
+			name:      "logical dns type of cluster",
+			cluster:   &apiv2.Cluster{Name: "foo", ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_LOGICAL_DNS}},
+			edsConfig: nil,
+		},
+		{
+			name:      "original dst type of cluster",
+			cluster:   &apiv2.Cluster{Name: "foo", ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_ORIGINAL_DST}},
+			edsConfig: nil,
+		},
+		{
+			name: "cluster changed from eds to static",
+			cluster: &apiv2.Cluster{
+				Name:                 "foo",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STATIC},
+				EdsClusterConfig:     &apiv2.Cluster_EdsClusterConfig{ServiceName: "foo"},
+			},
+			edsConfig: nil,
+		},
 		{
 			name:    "eds type of cluster",
 			cluster: &apiv2.Cluster{Name: "foo", ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS}},
@@ -300,178 +532,1765 @@ func TestApplyEdsConfig(t *testing.T) {
 	}
 }
 
-func TestBuildDefaultCluster(t *testing.T) {
-	servicePort := &model.Port{
-		Name:     "default",
-		Port:     8080,
-		Protocol: protocol.HTTP,
-	}
-
+func TestApplyEdsInitialFetchTimeout(t *testing.T) {
 	cases := []struct {
 		name            string
-		clusterName     string
-		discovery       apiv2.Cluster_DiscoveryType
-		endpoints       []*endpoint.LocalityLbEndpoints
-		direction       model.TrafficDirection
-		external        bool
-		expectedCluster *apiv2.Cluster
+		discoveryType   apiv2.Cluster_DiscoveryType
+		annotations     map[string]string
+		expectedTimeout *duration.Duration
 	}{
 		{
-			name:        "default EDS cluster",
-			clusterName: "foo",
-			discovery:   apiv2.Cluster_EDS,
-			endpoints:   nil,
-			direction:   model.TrafficDirectionOutbound,
-			external:    false,
-			expectedCluster: &apiv2.Cluster{
-				Name:                 "foo",
-				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
-				ConnectTimeout:       &duration.Duration{Seconds: 10, Nanos: 1},
-				CircuitBreakers: &v2Cluster.CircuitBreakers{
-					Thresholds: []*v2Cluster.CircuitBreakers_Thresholds{&defaultCircuitBreakerThresholds},
-				},
-			},
+			name:            "default warming",
+			discoveryType:   apiv2.Cluster_EDS,
+			expectedTimeout: features.InitialFetchTimeout,
 		},
 		{
-			name:            "static cluster with no endpoints",
-			clusterName:     "foo",
-			discovery:       apiv2.Cluster_STATIC,
-			endpoints:       nil,
-			direction:       model.TrafficDirectionOutbound,
-			external:        false,
-			expectedCluster: nil,
+			name:            "timeout from annotation",
+			discoveryType:   apiv2.Cluster_EDS,
+			annotations:     map[string]string{model.EdsInitialFetchTimeoutAnnotation: "5s"},
+			expectedTimeout: &duration.Duration{Seconds: 5},
 		},
 		{
-			name:            "strict DNS cluster with no endpoints",
-			clusterName:     "foo",
-			discovery:       apiv2.Cluster_STRICT_DNS,
-			endpoints:       nil,
-			direction:       model.TrafficDirectionOutbound,
-			external:        false,
-			expectedCluster: nil,
+			name:            "invalid timeout",
+			discoveryType:   apiv2.Cluster_EDS,
+			annotations:     map[string]string{model.EdsInitialFetchTimeoutAnnotation: "soon"},
+			expectedTimeout: features.InitialFetchTimeout,
 		},
 		{
-			name:        "static cluster with endpoints",
-			clusterName: "foo",
-			discovery:   apiv2.Cluster_STATIC,
-			endpoints: []*endpoint.LocalityLbEndpoints{
-				{
-					Locality: &core.Locality{
-						Region:  "region1",
-						Zone:    "zone1",
-						SubZone: "subzone1",
-					},
-					LbEndpoints: []*endpoint.LbEndpoint{},
-					LoadBalancingWeight: &wrappers.UInt32Value{
-						Value: 1,
-					},
-					Priority: 0,
-				},
-			},
-			direction: model.TrafficDirectionOutbound,
-			external:  false,
-			expectedCluster: &apiv2.Cluster{
-				Name:                 "foo",
-				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STATIC},
-				ConnectTimeout:       &duration.Duration{Seconds: 10, Nanos: 1},
-				LoadAssignment: &apiv2.ClusterLoadAssignment{
-					ClusterName: "foo",
-					Endpoints: []*endpoint.LocalityLbEndpoints{
-						{
-							Locality: &core.Locality{
-								Region:  "region1",
-								Zone:    "zone1",
-								SubZone: "subzone1",
-							},
-							LbEndpoints: []*endpoint.LbEndpoint{},
-							LoadBalancingWeight: &wrappers.UInt32Value{
-								Value: 1,
-							},
-							Priority: 0,
-						},
-					},
-				},
-				CircuitBreakers: &v2Cluster.CircuitBreakers{
-					Thresholds: []*v2Cluster.CircuitBreakers_Thresholds{&defaultCircuitBreakerThresholds},
-				},
-			},
+			name:          "non eds type of cluster",
+			discoveryType: apiv2.Cluster_STRICT_DNS,
+			annotations:   map[string]string{model.EdsInitialFetchTimeoutAnnotation: "5s"},
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			serviceDiscovery := &fakes.ServiceDiscovery{}
-			configStore := &fakes.IstioConfigStore{}
-			env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
-
-			proxy.SetSidecarScope(env.PushContext)
-
-			cb := NewClusterBuilder(&model.Proxy{}, env.PushContext)
-
-			defaultCluster := cb.buildDefaultCluster(tt.clusterName, tt.discovery,
-				tt.endpoints, tt.direction, servicePort, tt.external)
+			cluster := &apiv2.Cluster{Name: "foo", ClusterDiscoveryType: &apiv2.Cluster_Type{Type: tt.discoveryType}}
+			maybeApplyEdsConfig(cluster)
+			applyDestinationRuleAnnotations(cluster, nil, parseAnnotations(tt.annotations))
 
-			if !reflect.DeepEqual(defaultCluster, tt.expectedCluster) {
-				t.Errorf("Unexpected default cluster, want %v got %v", tt.expectedCluster, defaultCluster)
+			if tt.discoveryType != apiv2.Cluster_EDS {
+				if cluster.EdsClusterConfig != nil {
+					t.Errorf("Unexpected Eds config in cluster %v", cluster.EdsClusterConfig)
+				}
+				return
+			}
+			if got := cluster.EdsClusterConfig.EdsConfig.InitialFetchTimeout; !reflect.DeepEqual(got, tt.expectedTimeout) {
+				t.Errorf("Unexpected initial fetch timeout, want %v, got %v", tt.expectedTimeout, got)
 			}
 		})
 	}
 }
 
-func TestBuildPassthroughClusters(t *testing.T) {
+func TestAddPortNameToMetadata(t *testing.T) {
+	service := &model.Service{Hostname: "foo.default.svc.cluster.local"}
+
 	cases := []struct {
-		name         string
-		ips          []string
-		ipv4Expected bool
-		ipv6Expected bool
+		name     string
+		port     *model.Port
+		expected string
 	}{
 		{
-			name:         "both ipv4 and ipv6",
-			ips:          []string{"6.6.6.6", "::1"},
-			ipv4Expected: true,
-			ipv6Expected: true,
+			name:     "named port",
+			port:     &model.Port{Name: "default", Port: 8080, Protocol: protocol.HTTP},
+			expected: "default",
 		},
 		{
-			name:         "ipv4 only",
-			ips:          []string{"6.6.6.6"},
-			ipv4Expected: true,
-			ipv6Expected: false,
+			name:     "auto port",
+			port:     &model.Port{Name: "auto", Port: 9090, Protocol: protocol.Unsupported},
+			expected: "auto",
 		},
 		{
-			name:         "ipv6 only",
-			ips:          []string{"::1"},
-			ipv4Expected: false,
-			ipv6Expected: true,
+			name:     "port without name",
+			port:     &model.Port{Port: 3306, Protocol: protocol.TCP},
+			expected: "3306",
 		},
 	}
+
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			serviceDiscovery := &fakes.ServiceDiscovery{}
-			configStore := &fakes.IstioConfigStore{}
-			env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+			md := util.AddConfigSourceToMetadata(nil, service, nil)
+			addPortNameToMetadata(md, tt.port)
 
-			proxy := &model.Proxy{IPAddresses: tt.ips}
-			proxy.SetSidecarScope(env.PushContext)
-			proxy.DiscoverIPVersions()
+			got := md.FilterMetadata[util.IstioMetadataKey].Fields["portName"].GetStringValue()
+			if got != tt.expected {
+				t.Errorf("Unexpected port name metadata, want %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
 
-			cb := NewClusterBuilder(proxy, env.PushContext)
+func TestAddResolutionToMetadata(t *testing.T) {
+	cases := []struct {
+		resolution model.Resolution
+		expected   string
+	}{
+		{resolution: model.ClientSideLB, expected: "ClientSide"},
+		{resolution: model.DNSLB, expected: "DNS"},
+		{resolution: model.Passthrough, expected: "Passthrough"},
+	}
 
-			clusters := cb.buildInboundPassthroughClusters()
-			var hasIpv4, hasIpv6 bool
-			for _, c := range clusters {
-				hasIpv4 = hasIpv4 || c.Name == util.InboundPassthroughClusterIpv4
-				hasIpv6 = hasIpv6 || c.Name == util.InboundPassthroughClusterIpv6
-			}
-			if hasIpv4 != tt.ipv4Expected {
-				t.Errorf("Unexpected Ipv4 Passthrough Cluster, want %v got %v", tt.ipv4Expected, hasIpv4)
-			}
-			if hasIpv6 != tt.ipv6Expected {
-				t.Errorf("Unexpected Ipv6 Passthrough Cluster, want %v got %v", tt.ipv6Expected, hasIpv6)
-			}
-			// Validate that Passthrough Cluster LB Policy is set correctly.
-			if clusters[0].GetType() != apiv2.Cluster_ORIGINAL_DST || clusters[0].GetLbPolicy() != apiv2.Cluster_CLUSTER_PROVIDED {
-				t.Errorf("Unexpected Discovery type or Lb policy, got Discovery type: %v, Lb Policy: %v", clusters[0].GetType(), clusters[0].GetLbPolicy())
+	for _, tt := range cases {
+		t.Run(tt.expected, func(t *testing.T) {
+			service := &model.Service{Hostname: "foo.default.svc.cluster.local", Resolution: tt.resolution}
+			md := util.AddConfigSourceToMetadata(nil, service, nil)
+			addResolutionToMetadata(md, service)
+
+			got := md.FilterMetadata[util.IstioMetadataKey].Fields["resolution"].GetStringValue()
+			if got != tt.expected {
+				t.Errorf("Unexpected resolution metadata, want %q, got %q", tt.expected, got)
 			}
 		})
 	}
 }
+
+func TestAddConsistentHashKeysToMetadata(t *testing.T) {
+	headerLb := &networking.LoadBalancerSettings{
+		LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+			ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{HttpHeaderName: "x-user"},
+			},
+		},
+	}
+	service := &model.Service{Hostname: "foo.default.svc.cluster.local"}
+
+	cases := []struct {
+		name        string
+		lbPolicy    apiv2.Cluster_LbPolicy
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:     "single key of the load balancer settings",
+			lbPolicy: apiv2.Cluster_RING_HASH,
+			expected: []string{"header:x-user"},
+		},
+		{
+			name:        "multiple ordered keys",
+			lbPolicy:    apiv2.Cluster_MAGLEV,
+			annotations: map[string]string{model.ConsistentHashKeysAnnotation: "header:x-user, sourceIP,cookie:session"},
+			expected:    []string{"header:x-user", "sourceIP", "cookie:session"},
+		},
+		{
+			name:        "invalid keys",
+			lbPolicy:    apiv2.Cluster_RING_HASH,
+			annotations: map[string]string{model.ConsistentHashKeysAnnotation: "header:x-user,body"},
+			expected:    []string{"header:x-user"},
+		},
+		{
+			name:        "not a consistent hash cluster",
+			lbPolicy:    apiv2.Cluster_ROUND_ROBIN,
+			annotations: map[string]string{model.ConsistentHashKeysAnnotation: "header:x-user,sourceIP"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{Name: "foo", LbPolicy: tt.lbPolicy}
+			md := util.AddConfigSourceToMetadata(nil, service, nil)
+			addConsistentHashKeysToMetadata(md, cluster, headerLb, parseAnnotations(tt.annotations).ConsistentHashKeys)
+
+			var got []string
+			for _, value := range md.FilterMetadata[util.IstioMetadataKey].Fields["consistentHashKeys"].GetListValue().GetValues() {
+				got = append(got, value.GetStringValue())
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Unexpected consistent hash keys metadata, want %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestAddTCPIdleTimeoutToMetadata(t *testing.T) {
+	policy := &networking.TrafficPolicy{
+		ConnectionPool: &networking.ConnectionPoolSettings{
+			Http: &networking.ConnectionPoolSettings_HTTPSettings{
+				IdleTimeout: &types.Duration{Seconds: 30},
+			},
+		},
+	}
+	service := &model.Service{Hostname: "foo.default.svc.cluster.local"}
+
+	cases := []struct {
+		name     string
+		port     *model.Port
+		policy   *networking.TrafficPolicy
+		expected string
+	}{
+		{
+			name:     "tcp port",
+			port:     &model.Port{Name: "tcp", Port: 3306, Protocol: protocol.TCP},
+			policy:   policy,
+			expected: "30s",
+		},
+		{
+			name:   "http port",
+			port:   &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP},
+			policy: policy,
+		},
+		{
+			name: "tcp port without idle timeout",
+			port: &model.Port{Name: "tcp", Port: 3306, Protocol: protocol.TCP},
+			policy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+				},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			md := util.AddConfigSourceToMetadata(nil, service, nil)
+			addTCPIdleTimeoutToMetadata(md, tt.policy, tt.port)
+
+			got := md.FilterMetadata[util.IstioMetadataKey].Fields["tcpIdleTimeout"].GetStringValue()
+			if got != tt.expected {
+				t.Errorf("Unexpected TCP idle timeout metadata, want %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildLbSubsetConfig(t *testing.T) {
+	subsets := []*networking.Subset{
+		{
+			Name:   "v1",
+			Labels: map[string]string{"version": "v1"},
+		},
+		{
+			Name:   "v2",
+			Labels: map[string]string{"version": "v2"},
+		},
+		{
+			Name:   "v2-canary",
+			Labels: map[string]string{"version": "v2", "track": "canary"},
+		},
+		{
+			Name: "all",
+		},
+	}
+	selectors := []*apiv2.Cluster_LbSubsetConfig_LbSubsetSelector{
+		{Keys: []string{"version"}},
+		{Keys: []string{"track", "version"}},
+	}
+
+	cases := []struct {
+		name          string
+		defaultSubset string
+		expected      *apiv2.Cluster_LbSubsetConfig
+	}{
+		{
+			name:          "fallback to default subset",
+			defaultSubset: "v1",
+			expected: &apiv2.Cluster_LbSubsetConfig{
+				FallbackPolicy: apiv2.Cluster_LbSubsetConfig_DEFAULT_SUBSET,
+				DefaultSubset: &structpb.Struct{
+					Fields: map[string]*structpb.Value{
+						"version": {Kind: &structpb.Value_StringValue{StringValue: "v1"}},
+					},
+				},
+				SubsetSelectors: selectors,
+			},
+		},
+		{
+			name:          "default subset without labels",
+			defaultSubset: "all",
+			expected: &apiv2.Cluster_LbSubsetConfig{
+				FallbackPolicy:  apiv2.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+				SubsetSelectors: selectors,
+			},
+		},
+		{
+			name:          "unknown default subset",
+			defaultSubset: "v3",
+			expected: &apiv2.Cluster_LbSubsetConfig{
+				FallbackPolicy:  apiv2.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+				SubsetSelectors: selectors,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildLbSubsetConfig(subsets, tt.defaultSubset)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Unexpected lb subset config. want %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildLbSubsetConfigSelectorOrder(t *testing.T) {
+	// The more specific subset is declared first, so its selector is tried first by Envoy.
+	subsets := []*networking.Subset{
+		{
+			Name:   "v2-canary",
+			Labels: map[string]string{"version": "v2", "track": "canary", "zone": "a"},
+		},
+		{
+			Name:   "v1",
+			Labels: map[string]string{"version": "v1"},
+		},
+		{
+			Name:   "canary",
+			Labels: map[string]string{"track": "canary"},
+		},
+		{
+			Name:   "v2",
+			Labels: map[string]string{"version": "v2"},
+		},
+	}
+	expected := []*apiv2.Cluster_LbSubsetConfig_LbSubsetSelector{
+		{Keys: []string{"track", "version", "zone"}},
+		{Keys: []string{"version"}},
+		{Keys: []string{"track"}},
+	}
+
+	// The keys of the subset labels are iterated in random order, so build the config a few times.
+	for i := 0; i < 10; i++ {
+		got := buildLbSubsetConfig(subsets, "").SubsetSelectors
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Unexpected subset selectors. want %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestApplyRetryBudgets(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		expected    map[core.RoutingPriority]float64
+	}{
+		{
+			name:        "no retry budget",
+			annotations: nil,
+			expected:    nil,
+		},
+		{
+			name:        "default priority only",
+			annotations: map[string]string{model.RetryBudgetAnnotation: "20"},
+			expected:    map[core.RoutingPriority]float64{core.RoutingPriority_DEFAULT: 20},
+		},
+		{
+			name: "default and high priority",
+			annotations: map[string]string{
+				model.RetryBudgetAnnotation:             "20",
+				model.HighPriorityRetryBudgetAnnotation: "50.5",
+			},
+			expected: map[core.RoutingPriority]float64{
+				core.RoutingPriority_DEFAULT: 20,
+				core.RoutingPriority_HIGH:    50.5,
+			},
+		},
+		{
+			name:        "invalid retry budget",
+			annotations: map[string]string{model.RetryBudgetAnnotation: "150"},
+			expected:    nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{Name: "foo"}
+			annotations := parseAnnotations(tt.annotations)
+			applyRetryBudgets(cluster, annotations.RetryBudget, annotations.HighPriorityRetryBudget)
+
+			got := make(map[core.RoutingPriority]float64)
+			for _, threshold := range cluster.CircuitBreakers.GetThresholds() {
+				if threshold.RetryBudget != nil {
+					got[threshold.Priority] = threshold.RetryBudget.BudgetPercent.GetValue()
+				}
+			}
+			if len(got) == 0 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Unexpected retry budgets, got: %v, want: %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyOutlierSuccessRate(t *testing.T) {
+	cases := []struct {
+		name            string
+		annotations     map[string]string
+		expectHosts     *wrappers.UInt32Value
+		expectVolume    *wrappers.UInt32Value
+		expectStdev     *wrappers.UInt32Value
+		expectEnforcing *wrappers.UInt32Value
+	}{
+		{
+			name: "all success rate settings",
+			annotations: map[string]string{
+				model.OutlierSuccessRateMinimumHostsAnnotation:  "3",
+				model.OutlierSuccessRateRequestVolumeAnnotation: "20",
+				model.OutlierSuccessRateStdevFactorAnnotation:   "1.5",
+			},
+			expectHosts:     &wrappers.UInt32Value{Value: 3},
+			expectVolume:    &wrappers.UInt32Value{Value: 20},
+			expectStdev:     &wrappers.UInt32Value{Value: 1500},
+			expectEnforcing: &wrappers.UInt32Value{Value: 100},
+		},
+		{
+			// The cluster has fewer hosts than required, so Envoy does not run success rate based ejection for it.
+			name:            "cluster below the minimum hosts",
+			annotations:     map[string]string{model.OutlierSuccessRateMinimumHostsAnnotation: "10"},
+			expectHosts:     &wrappers.UInt32Value{Value: 10},
+			expectEnforcing: &wrappers.UInt32Value{Value: 100},
+		},
+		{
+			name:        "invalid stdev factor",
+			annotations: map[string]string{model.OutlierSuccessRateStdevFactorAnnotation: "-1"},
+		},
+		{
+			name: "no success rate settings",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{
+				Name: "foo",
+				LoadAssignment: &apiv2.ClusterLoadAssignment{
+					Endpoints: []*endpoint.LocalityLbEndpoints{
+						{
+							LbEndpoints: []*endpoint.LbEndpoint{
+								{HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{Address: util.BuildAddress("10.0.0.1", 8080)}}},
+								{HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{Address: util.BuildAddress("10.0.0.2", 8080)}}},
+							},
+						},
+					},
+				},
+			}
+			applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5})
+			applyDestinationRuleAnnotations(cluster, nil, parseAnnotations(tt.annotations))
+
+			out := cluster.OutlierDetection
+			if !reflect.DeepEqual(out.SuccessRateMinimumHosts, tt.expectHosts) {
+				t.Errorf("Unexpected success rate minimum hosts, got: %v, want: %v", out.SuccessRateMinimumHosts, tt.expectHosts)
+			}
+			if !reflect.DeepEqual(out.SuccessRateRequestVolume, tt.expectVolume) {
+				t.Errorf("Unexpected success rate request volume, got: %v, want: %v", out.SuccessRateRequestVolume, tt.expectVolume)
+			}
+			if !reflect.DeepEqual(out.SuccessRateStdevFactor, tt.expectStdev) {
+				t.Errorf("Unexpected success rate stdev factor, got: %v, want: %v", out.SuccessRateStdevFactor, tt.expectStdev)
+			}
+			if !reflect.DeepEqual(out.EnforcingSuccessRate, tt.expectEnforcing) {
+				t.Errorf("Unexpected enforcing success rate, got: %v, want: %v", out.EnforcingSuccessRate, tt.expectEnforcing)
+			}
+		})
+	}
+}
+
+func TestApplyOutlierFailurePercentage(t *testing.T) {
+	cases := []struct {
+		name            string
+		outlier         *networking.OutlierDetection
+		annotations     map[string]string
+		expectThreshold uint32
+		expectHosts     *wrappers.UInt32Value
+		expectVolume    *wrappers.UInt32Value
+	}{
+		{
+			name:    "all failure percentage settings",
+			outlier: &networking.OutlierDetection{ConsecutiveErrors: 5},
+			annotations: map[string]string{
+				model.OutlierFailurePercentageThresholdAnnotation:     "80",
+				model.OutlierFailurePercentageMinimumHostsAnnotation:  "3",
+				model.OutlierFailurePercentageRequestVolumeAnnotation: "20",
+			},
+			expectThreshold: 80,
+			expectHosts:     &wrappers.UInt32Value{Value: 3},
+			expectVolume:    &wrappers.UInt32Value{Value: 20},
+		},
+		{
+			name:            "threshold only",
+			outlier:         &networking.OutlierDetection{ConsecutiveErrors: 5},
+			annotations:     map[string]string{model.OutlierFailurePercentageThresholdAnnotation: "50"},
+			expectThreshold: 50,
+		},
+		{
+			name:        "invalid threshold",
+			outlier:     &networking.OutlierDetection{ConsecutiveErrors: 5},
+			annotations: map[string]string{model.OutlierFailurePercentageThresholdAnnotation: "150"},
+		},
+		{
+			name:        "without outlier detection",
+			annotations: map[string]string{model.OutlierFailurePercentageThresholdAnnotation: "80"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{Name: "foo"}
+			applyOutlierDetection(cluster, tt.outlier)
+			applyDestinationRuleAnnotations(cluster, nil, parseAnnotations(tt.annotations))
+
+			if tt.outlier == nil {
+				if cluster.OutlierDetection != nil {
+					t.Errorf("Unexpected outlier detection %v", cluster.OutlierDetection)
+				}
+				return
+			}
+			out := cluster.OutlierDetection
+			// Consecutive error based ejection is left in place.
+			if out.ConsecutiveGatewayFailure.GetValue() != 5 {
+				t.Errorf("Unexpected consecutive gateway failure %v", out.ConsecutiveGatewayFailure)
+			}
+			// Success rate based ejection keeps the Envoy defaults.
+			if out.EnforcingSuccessRate != nil {
+				t.Errorf("Unexpected enforcing success rate %v", out.EnforcingSuccessRate)
+			}
+			if tt.expectThreshold == 0 {
+				if out.FailurePercentageThreshold != nil || out.EnforcingFailurePercentage != nil {
+					t.Errorf("Unexpected failure percentage %v, %v", out.FailurePercentageThreshold, out.EnforcingFailurePercentage)
+				}
+				return
+			}
+			if out.FailurePercentageThreshold.GetValue() != tt.expectThreshold {
+				t.Errorf("Unexpected failure percentage threshold, got: %v, want: %d", out.FailurePercentageThreshold, tt.expectThreshold)
+			}
+			if out.EnforcingFailurePercentage.GetValue() != 100 {
+				t.Errorf("Unexpected enforcing failure percentage %v", out.EnforcingFailurePercentage)
+			}
+			if !reflect.DeepEqual(out.FailurePercentageMinimumHosts, tt.expectHosts) {
+				t.Errorf("Unexpected failure percentage minimum hosts, got: %v, want: %v", out.FailurePercentageMinimumHosts, tt.expectHosts)
+			}
+			if !reflect.DeepEqual(out.FailurePercentageRequestVolume, tt.expectVolume) {
+				t.Errorf("Unexpected failure percentage request volume, got: %v, want: %v", out.FailurePercentageRequestVolume, tt.expectVolume)
+			}
+		})
+	}
+}
+
+func TestApplyOutlierEnforcing(t *testing.T) {
+	cases := []struct {
+		name                string
+		annotations         map[string]string
+		expect5xx           uint32
+		expectGatewayErrors uint32
+		expectSuccessRate   *wrappers.UInt32Value
+	}{
+		{
+			name: "partial enforcement",
+			annotations: map[string]string{
+				model.OutlierEnforcingConsecutive5xxAnnotation:           "50",
+				model.OutlierEnforcingConsecutiveGatewayErrorsAnnotation: "25",
+				model.OutlierEnforcingSuccessRateAnnotation:              "10",
+			},
+			expect5xx:           50,
+			expectGatewayErrors: 25,
+			expectSuccessRate:   &wrappers.UInt32Value{Value: 10},
+		},
+		{
+			name: "monitoring only",
+			annotations: map[string]string{
+				model.OutlierEnforcingConsecutive5xxAnnotation:           "0",
+				model.OutlierEnforcingConsecutiveGatewayErrorsAnnotation: "0",
+				model.OutlierEnforcingSuccessRateAnnotation:              "0",
+			},
+			expect5xx:           0,
+			expectGatewayErrors: 0,
+			expectSuccessRate:   &wrappers.UInt32Value{Value: 0},
+		},
+		{
+			name:                "invalid percentage",
+			annotations:         map[string]string{model.OutlierEnforcingConsecutive5xxAnnotation: "200"},
+			expect5xx:           100,
+			expectGatewayErrors: 100,
+		},
+		{
+			name:                "no enforcing settings",
+			expect5xx:           100,
+			expectGatewayErrors: 100,
+		},
+		{
+			name: "detection only",
+			annotations: map[string]string{
+				model.OutlierDetectionOnlyAnnotation:           "true",
+				model.OutlierEnforcingConsecutive5xxAnnotation: "50",
+			},
+			expect5xx:           0,
+			expectGatewayErrors: 0,
+			expectSuccessRate:   &wrappers.UInt32Value{Value: 0},
+		},
+		{
+			name:                "detection only disabled",
+			annotations:         map[string]string{model.OutlierDetectionOnlyAnnotation: "false"},
+			expect5xx:           100,
+			expectGatewayErrors: 100,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{Name: "foo"}
+			applyOutlierDetection(cluster, &networking.OutlierDetection{
+				Consecutive_5XxErrors:    &types.UInt32Value{Value: 5},
+				ConsecutiveGatewayErrors: &types.UInt32Value{Value: 3},
+			})
+			applyDestinationRuleAnnotations(cluster, nil, parseAnnotations(tt.annotations))
+
+			out := cluster.OutlierDetection
+			if out.Consecutive_5Xx.GetValue() != 5 || out.ConsecutiveGatewayFailure.GetValue() != 3 {
+				t.Errorf("Unexpected consecutive errors %v, %v", out.Consecutive_5Xx, out.ConsecutiveGatewayFailure)
+			}
+			if got := out.EnforcingConsecutive_5Xx.GetValue(); got != tt.expect5xx {
+				t.Errorf("Unexpected enforcing consecutive 5xx, got: %d, want: %d", got, tt.expect5xx)
+			}
+			if got := out.EnforcingConsecutiveGatewayFailure.GetValue(); got != tt.expectGatewayErrors {
+				t.Errorf("Unexpected enforcing consecutive gateway failure, got: %d, want: %d", got, tt.expectGatewayErrors)
+			}
+			if !reflect.DeepEqual(out.EnforcingSuccessRate, tt.expectSuccessRate) {
+				t.Errorf("Unexpected enforcing success rate, got: %v, want: %v", out.EnforcingSuccessRate, tt.expectSuccessRate)
+			}
+			if tt.annotations[model.OutlierDetectionOnlyAnnotation] == "true" {
+				if out.EnforcingFailurePercentage.GetValue() != 0 || out.EnforcingConsecutiveLocalOriginFailure.GetValue() != 0 ||
+					out.EnforcingLocalOriginSuccessRate.GetValue() != 0 {
+					t.Errorf("Unexpected enforcing outlier detection in detection only mode: %v", out)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyMaxConcurrentStreams(t *testing.T) {
+	cases := []struct {
+		name        string
+		http2       bool
+		annotations map[string]string
+		expected    uint32
+	}{
+		{
+			name:     "http2 cluster without limit",
+			http2:    true,
+			expected: 1073741824,
+		},
+		{
+			name:        "http2 cluster with limit",
+			http2:       true,
+			annotations: map[string]string{model.MaxConcurrentStreamsAnnotation: "100"},
+			expected:    100,
+		},
+		{
+			name:        "zero limit",
+			http2:       true,
+			annotations: map[string]string{model.MaxConcurrentStreamsAnnotation: "0"},
+			expected:    1073741824,
+		},
+		{
+			name:        "invalid limit",
+			http2:       true,
+			annotations: map[string]string{model.MaxConcurrentStreamsAnnotation: "-5"},
+			expected:    1073741824,
+		},
+		{
+			name:        "http1 cluster",
+			annotations: map[string]string{model.MaxConcurrentStreamsAnnotation: "100"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{Name: "foo"}
+			if tt.http2 {
+				cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{
+					MaxConcurrentStreams: &wrappers.UInt32Value{Value: 1073741824},
+				}
+			}
+			applyDestinationRuleAnnotations(cluster, nil, parseAnnotations(tt.annotations))
+
+			if !tt.http2 && cluster.Http2ProtocolOptions != nil {
+				t.Fatalf("Unexpected http2 protocol options %v", cluster.Http2ProtocolOptions)
+			}
+			if got := cluster.Http2ProtocolOptions.GetMaxConcurrentStreams().GetValue(); got != tt.expected {
+				t.Errorf("Unexpected max concurrent streams, got: %d, want: %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyHTTP2WindowSizes(t *testing.T) {
+	cases := []struct {
+		name               string
+		annotations        map[string]string
+		expectedStream     *wrappers.UInt32Value
+		expectedConnection *wrappers.UInt32Value
+	}{
+		{
+			name: "envoy defaults",
+		},
+		{
+			name: "both window sizes",
+			annotations: map[string]string{
+				model.HTTP2InitialStreamWindowSizeAnnotation:     "1048576",
+				model.HTTP2InitialConnectionWindowSizeAnnotation: "16777216",
+			},
+			expectedStream:     &wrappers.UInt32Value{Value: 1048576},
+			expectedConnection: &wrappers.UInt32Value{Value: 16777216},
+		},
+		{
+			name: "out of range window sizes",
+			annotations: map[string]string{
+				model.HTTP2InitialStreamWindowSizeAnnotation:     "1024",
+				model.HTTP2InitialConnectionWindowSizeAnnotation: "4294967295",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{Name: "foo", Http2ProtocolOptions: &core.Http2ProtocolOptions{}}
+			applyDestinationRuleAnnotations(cluster, nil, parseAnnotations(tt.annotations))
+
+			if !reflect.DeepEqual(cluster.Http2ProtocolOptions.InitialStreamWindowSize, tt.expectedStream) {
+				t.Errorf("Unexpected initial stream window size, got: %v, want: %v",
+					cluster.Http2ProtocolOptions.InitialStreamWindowSize, tt.expectedStream)
+			}
+			if !reflect.DeepEqual(cluster.Http2ProtocolOptions.InitialConnectionWindowSize, tt.expectedConnection) {
+				t.Errorf("Unexpected initial connection window size, got: %v, want: %v",
+					cluster.Http2ProtocolOptions.InitialConnectionWindowSize, tt.expectedConnection)
+			}
+		})
+	}
+}
+
+func TestApplyLoadBalancerExtension(t *testing.T) {
+	cases := []struct {
+		name           string
+		annotations    map[string]string
+		expectedPolicy bool
+		expectedConfig map[string]string
+	}{
+		{
+			name: "extension with config",
+			annotations: map[string]string{
+				model.LoadBalancerExtensionAnnotation:       "envoy.lb.custom",
+				model.LoadBalancerExtensionConfigAnnotation: `{"mode": "sticky"}`,
+			},
+			expectedPolicy: true,
+			expectedConfig: map[string]string{"mode": "sticky"},
+		},
+		{
+			name:           "extension without config",
+			annotations:    map[string]string{model.LoadBalancerExtensionAnnotation: "envoy.lb.custom"},
+			expectedPolicy: true,
+		},
+		{
+			name:           "config without extension name",
+			annotations:    map[string]string{model.LoadBalancerExtensionConfigAnnotation: `{"mode": "sticky"}`},
+			expectedPolicy: false,
+		},
+		{
+			name: "invalid config",
+			annotations: map[string]string{
+				model.LoadBalancerExtensionAnnotation:       "envoy.lb.custom",
+				model.LoadBalancerExtensionConfigAnnotation: "mode=sticky",
+			},
+			expectedPolicy: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{
+				Name:                 "foo",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+				LbPolicy:             apiv2.Cluster_ROUND_ROBIN,
+			}
+			annotations := parseAnnotations(tt.annotations)
+			applyLoadBalancerExtension(cluster, annotations.LoadBalancerExtension, annotations.LoadBalancerExtensionConfig)
+
+			if !tt.expectedPolicy {
+				if cluster.LoadBalancingPolicy != nil || cluster.LbPolicy != apiv2.Cluster_ROUND_ROBIN {
+					t.Errorf("Unexpected load balancing policy %v, %v", cluster.LbPolicy, cluster.LoadBalancingPolicy)
+				}
+				return
+			}
+			if cluster.LbPolicy != apiv2.Cluster_LOAD_BALANCING_POLICY_CONFIG {
+				t.Errorf("Unexpected lb policy, got: %v, want: %v", cluster.LbPolicy, apiv2.Cluster_LOAD_BALANCING_POLICY_CONFIG)
+			}
+			policies := cluster.LoadBalancingPolicy.GetPolicies()
+			if len(policies) != 1 || policies[0].Name != "envoy.lb.custom" {
+				t.Fatalf("Unexpected load balancing policies %v", policies)
+			}
+			if tt.expectedConfig == nil {
+				if policies[0].TypedConfig != nil {
+					t.Errorf("Unexpected typed config %v", policies[0].TypedConfig)
+				}
+				return
+			}
+			config := &structpb.Struct{}
+			if err := ptypes.UnmarshalAny(policies[0].TypedConfig, config); err != nil {
+				t.Fatalf("Failed to unmarshal typed config: %v", err)
+			}
+			got := make(map[string]string)
+			for k, v := range config.Fields {
+				got[k] = v.GetStringValue()
+			}
+			if !reflect.DeepEqual(got, tt.expectedConfig) {
+				t.Errorf("Unexpected typed config, got: %v, want: %v", got, tt.expectedConfig)
+			}
+		})
+	}
+}
+
+func TestApplyUseHostnameForHashing(t *testing.T) {
+	cases := []struct {
+		name          string
+		discoveryType apiv2.Cluster_DiscoveryType
+		lbPolicy      apiv2.Cluster_LbPolicy
+		annotations   map[string]string
+		expected      bool
+	}{
+		{
+			name:          "hashing on addresses by default",
+			discoveryType: apiv2.Cluster_STRICT_DNS,
+			lbPolicy:      apiv2.Cluster_RING_HASH,
+			expected:      false,
+		},
+		{
+			name:          "dns ring hash cluster",
+			discoveryType: apiv2.Cluster_STRICT_DNS,
+			lbPolicy:      apiv2.Cluster_RING_HASH,
+			annotations:   map[string]string{model.UseHostnameForHashingAnnotation: "true"},
+			expected:      true,
+		},
+		{
+			name:          "dns round robin cluster",
+			discoveryType: apiv2.Cluster_STRICT_DNS,
+			lbPolicy:      apiv2.Cluster_ROUND_ROBIN,
+			annotations:   map[string]string{model.UseHostnameForHashingAnnotation: "true"},
+			expected:      false,
+		},
+		{
+			name:          "eds ring hash cluster",
+			discoveryType: apiv2.Cluster_EDS,
+			lbPolicy:      apiv2.Cluster_RING_HASH,
+			annotations:   map[string]string{model.UseHostnameForHashingAnnotation: "true"},
+			expected:      false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &apiv2.Cluster{
+				Name:                 "foo",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: tt.discoveryType},
+				LbPolicy:             tt.lbPolicy,
+			}
+			applyDestinationRuleAnnotations(cluster, nil, parseAnnotations(tt.annotations))
+
+			got := cluster.GetCommonLbConfig().GetConsistentHashingLbConfig().GetUseHostnameForHashing()
+			if got != tt.expected {
+				t.Errorf("Unexpected UseHostnameForHashing, got: %v, want: %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildDefaultCluster(t *testing.T) {
+	servicePort := &model.Port{
+		Name:     "default",
+		Port:     8080,
+		Protocol: protocol.HTTP,
+	}
+
+	cases := []struct {
+		name            string
+		clusterName     string
+		discovery       apiv2.Cluster_DiscoveryType
+		endpoints       []*endpoint.LocalityLbEndpoints
+		direction       model.TrafficDirection
+		external        bool
+		expectedCluster *apiv2.Cluster
+	}{
+		{
+			name:        "default EDS cluster",
+			clusterName: "foo",
+			discovery:   apiv2.Cluster_EDS,
+			endpoints:   nil,
+			direction:   model.TrafficDirectionOutbound,
+			external:    false,
+			expectedCluster: &apiv2.Cluster{
+				Name:                 "foo",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+				ConnectTimeout:       &duration.Duration{Seconds: 10, Nanos: 1},
+				CircuitBreakers: &v2Cluster.CircuitBreakers{
+					Thresholds: []*v2Cluster.CircuitBreakers_Thresholds{&defaultCircuitBreakerThresholds},
+				},
+			},
+		},
+		{
+			name:            "static cluster with no endpoints",
+			clusterName:     "foo",
+			discovery:       apiv2.Cluster_STATIC,
+			endpoints:       nil,
+			direction:       model.TrafficDirectionOutbound,
+			external:        false,
+			expectedCluster: nil,
+		},
+		{
+			name:            "strict DNS cluster with no endpoints",
+			clusterName:     "foo",
+			discovery:       apiv2.Cluster_STRICT_DNS,
+			endpoints:       nil,
+			direction:       model.TrafficDirectionOutbound,
+			external:        false,
+			expectedCluster: nil,
+		},
+		{
+			name:        "static cluster with endpoints",
+			clusterName: "foo",
+			discovery:   apiv2.Cluster_STATIC,
+			endpoints: []*endpoint.LocalityLbEndpoints{
+				{
+					Locality: &core.Locality{
+						Region:  "region1",
+						Zone:    "zone1",
+						SubZone: "subzone1",
+					},
+					LbEndpoints: []*endpoint.LbEndpoint{},
+					LoadBalancingWeight: &wrappers.UInt32Value{
+						Value: 1,
+					},
+					Priority: 0,
+				},
+			},
+			direction: model.TrafficDirectionOutbound,
+			external:  false,
+			expectedCluster: &apiv2.Cluster{
+				Name:                 "foo",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STATIC},
+				ConnectTimeout:       &duration.Duration{Seconds: 10, Nanos: 1},
+				LoadAssignment: &apiv2.ClusterLoadAssignment{
+					ClusterName: "foo",
+					Endpoints: []*endpoint.LocalityLbEndpoints{
+						{
+							Locality: &core.Locality{
+								Region:  "region1",
+								Zone:    "zone1",
+								SubZone: "subzone1",
+							},
+							LbEndpoints: []*endpoint.LbEndpoint{},
+							LoadBalancingWeight: &wrappers.UInt32Value{
+								Value: 1,
+							},
+							Priority: 0,
+						},
+					},
+				},
+				CircuitBreakers: &v2Cluster.CircuitBreakers{
+					Thresholds: []*v2Cluster.CircuitBreakers_Thresholds{&defaultCircuitBreakerThresholds},
+				},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceDiscovery := &fakes.ServiceDiscovery{}
+			configStore := &fakes.IstioConfigStore{}
+			env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+			proxy.SetSidecarScope(env.PushContext)
+
+			cb := NewClusterBuilder(&model.Proxy{}, env.PushContext)
+
+			defaultCluster := cb.buildDefaultCluster(tt.clusterName, tt.discovery,
+				tt.endpoints, tt.direction, servicePort, tt.external)
+
+			if !reflect.DeepEqual(defaultCluster, tt.expectedCluster) {
+				t.Errorf("Unexpected default cluster, want %v got %v", tt.expectedCluster, defaultCluster)
+			}
+		})
+	}
+}
+
+func TestBuildDefaultClusterDNSRefreshRate(t *testing.T) {
+	servicePort := &model.Port{Name: "default", Port: 8080, Protocol: protocol.HTTP}
+	endpoints := []*endpoint.LocalityLbEndpoints{
+		{
+			LbEndpoints: []*endpoint.LbEndpoint{
+				{
+					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+						Endpoint: &endpoint.Endpoint{Address: util.BuildAddress("foo.example.org", 8080)},
+					},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name        string
+		meshRate    *types.Duration
+		defaultRate string
+		expected    *duration.Duration
+	}{
+		{
+			name:     "builder default",
+			expected: &duration.Duration{Seconds: 5},
+		},
+		{
+			name:        "configured builder default",
+			defaultRate: "10s",
+			expected:    &duration.Duration{Seconds: 10},
+		},
+		{
+			name:        "disabled builder default",
+			defaultRate: "0s",
+			expected:    nil,
+		},
+		{
+			name:        "mesh config overrides builder default",
+			meshRate:    &types.Duration{Seconds: 30},
+			defaultRate: "10s",
+			expected:    &duration.Duration{Seconds: 30},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.defaultRate != "" {
+				os.Setenv(features.DefaultDNSRefreshRate.Name, tt.defaultRate)
+				defer os.Unsetenv(features.DefaultDNSRefreshRate.Name)
+			}
+			mesh := testMesh
+			mesh.DnsRefreshRate = tt.meshRate
+			env := newTestEnvironment(&fakes.ServiceDiscovery{}, mesh, &fakes.IstioConfigStore{})
+			cb := NewClusterBuilder(&model.Proxy{}, env.PushContext)
+
+			cluster := cb.buildDefaultCluster("outbound|8080||foo.example.org", apiv2.Cluster_STRICT_DNS,
+				endpoints, model.TrafficDirectionOutbound, servicePort, true)
+			if cluster == nil {
+				t.Fatalf("Expected a DNS cluster")
+			}
+			if !reflect.DeepEqual(cluster.DnsRefreshRate, tt.expected) {
+				t.Errorf("Unexpected DNS refresh rate, want %v got %v", tt.expected, cluster.DnsRefreshRate)
+			}
+		})
+	}
+}
+
+func TestBuildDefaultClusterTrackTimeoutBudgets(t *testing.T) {
+	servicePort := &model.Port{Name: "default", Port: 8080, Protocol: protocol.HTTP}
+	env := newTestEnvironment(&fakes.ServiceDiscovery{}, testMesh, &fakes.IstioConfigStore{})
+	cb := NewClusterBuilder(&model.Proxy{}, env.PushContext)
+
+	cluster := cb.buildDefaultCluster("outbound|8080||foo.example.org", apiv2.Cluster_EDS, nil,
+		model.TrafficDirectionOutbound, servicePort, false)
+	if cluster.TrackTimeoutBudgets {
+		t.Errorf("Expected no timeout budget stats by default")
+	}
+
+	os.Setenv(features.EnableTimeoutBudgetStats.Name, "true")
+	defer os.Unsetenv(features.EnableTimeoutBudgetStats.Name)
+
+	cluster = cb.buildDefaultCluster("outbound|8080||foo.example.org", apiv2.Cluster_EDS, nil,
+		model.TrafficDirectionOutbound, servicePort, false)
+	if !cluster.TrackTimeoutBudgets {
+		t.Errorf("Expected timeout budget stats with %s", features.EnableTimeoutBudgetStats.Name)
+	}
+}
+
+func TestBuildPassthroughClusters(t *testing.T) {
+	cases := []struct {
+		name         string
+		ips          []string
+		ipv4Expected bool
+		ipv6Expected bool
+	}{
+		{
+			name:         "both ipv4 and ipv6",
+			ips:          []string{"6.6.6.6", "::1"},
+			ipv4Expected: true,
+			ipv6Expected: true,
+		},
+		{
+			name:         "ipv4 only",
+			ips:          []string{"6.6.6.6"},
+			ipv4Expected: true,
+			ipv6Expected: false,
+		},
+		{
+			name:         "ipv6 only",
+			ips:          []string{"::1"},
+			ipv4Expected: false,
+			ipv6Expected: true,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceDiscovery := &fakes.ServiceDiscovery{}
+			configStore := &fakes.IstioConfigStore{}
+			env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+			proxy := &model.Proxy{IPAddresses: tt.ips}
+			proxy.SetSidecarScope(env.PushContext)
+			proxy.DiscoverIPVersions()
+
+			cb := NewClusterBuilder(proxy, env.PushContext)
+
+			clusters := cb.buildInboundPassthroughClusters()
+			var hasIpv4, hasIpv6 bool
+			for _, c := range clusters {
+				hasIpv4 = hasIpv4 || c.Name == util.InboundPassthroughClusterIpv4
+				hasIpv6 = hasIpv6 || c.Name == util.InboundPassthroughClusterIpv6
+			}
+			if hasIpv4 != tt.ipv4Expected {
+				t.Errorf("Unexpected Ipv4 Passthrough Cluster, want %v got %v", tt.ipv4Expected, hasIpv4)
+			}
+			if hasIpv6 != tt.ipv6Expected {
+				t.Errorf("Unexpected Ipv6 Passthrough Cluster, want %v got %v", tt.ipv6Expected, hasIpv6)
+			}
+			// Validate that Passthrough Cluster LB Policy is set correctly.
+			if clusters[0].GetType() != apiv2.Cluster_ORIGINAL_DST || clusters[0].GetLbPolicy() != apiv2.Cluster_CLUSTER_PROVIDED {
+				t.Errorf("Unexpected Discovery type or Lb policy, got Discovery type: %v, Lb Policy: %v", clusters[0].GetType(), clusters[0].GetLbPolicy())
+			}
+		})
+	}
+}
+
+func TestBuildDisabledPassthroughClusters(t *testing.T) {
+	_ = os.Setenv(features.DisableInboundPassthroughClusters.Name, "true")
+	defer func() { _ = os.Unsetenv(features.DisableInboundPassthroughClusters.Name) }()
+
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	configStore := &fakes.IstioConfigStore{}
+	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+	proxy := &model.Proxy{IPAddresses: []string{"6.6.6.6", "::1"}}
+	proxy.SetSidecarScope(env.PushContext)
+	proxy.DiscoverIPVersions()
+
+	cb := NewClusterBuilder(proxy, env.PushContext)
+
+	clusters := cb.buildInboundPassthroughClusters()
+	if len(clusters) != 2 {
+		t.Fatalf("Unexpected number of inbound passthrough clusters, want 2 got %d", len(clusters))
+	}
+	for _, c := range clusters {
+		if c.GetType() != apiv2.Cluster_STATIC || c.LoadAssignment != nil {
+			t.Errorf("Expected cluster %s without endpoints, got Discovery type: %v, Load assignment: %v",
+				c.Name, c.GetType(), c.LoadAssignment)
+		}
+	}
+}
+
+func TestBuildHeadlessPodClusters(t *testing.T) {
+	servicePort := &model.Port{
+		Name:     "tcp-peer",
+		Port:     9000,
+		Protocol: protocol.TCP,
+	}
+	service := &model.Service{
+		Hostname:   host.Name("zk.default.svc.cluster.local"),
+		Address:    "0.0.0.0",
+		Ports:      model.PortList{servicePort},
+		Resolution: model.Passthrough,
+		Attributes: model.ServiceAttributes{
+			Name:      "zk",
+			Namespace: "default",
+		},
+	}
+
+	// A three replica StatefulSet, plus an endpoint that is not backed by a pod.
+	instances := make([]*model.ServiceInstance, 0, 4)
+	for i, uid := range []string{"kubernetes://zk-0.default", "kubernetes://zk-1.default", "kubernetes://zk-2.default", ""} {
+		instances = append(instances, &model.ServiceInstance{
+			Service:     service,
+			ServicePort: servicePort,
+			Endpoint: &model.IstioEndpoint{
+				Address:      fmt.Sprintf("10.0.0.%d", i+1),
+				EndpointPort: 9000,
+				UID:          uid,
+			},
+		})
+	}
+
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+	serviceDiscovery.InstancesByPortReturns(instances, nil)
+	env := newTestEnvironment(serviceDiscovery, testMesh, &fakes.IstioConfigStore{})
+
+	proxy := &model.Proxy{Type: model.SidecarProxy}
+	proxy.SetSidecarScope(env.PushContext)
+	cb := NewClusterBuilder(proxy, env.PushContext)
+
+	clusters := cb.buildHeadlessPodClusters(service, servicePort, map[string]bool{"": true})
+	if len(clusters) != 3 {
+		t.Fatalf("Unexpected number of pod clusters, want 3 got %d", len(clusters))
+	}
+	for i, c := range clusters {
+		expectedName := fmt.Sprintf("outbound|9000||zk-%d.zk.default.svc.cluster.local", i)
+		if c.Name != expectedName {
+			t.Errorf("Unexpected pod cluster name, want %s got %s", expectedName, c.Name)
+		}
+		if c.GetType() != apiv2.Cluster_STATIC {
+			t.Errorf("Unexpected discovery type for %s, want STATIC got %v", c.Name, c.GetType())
+		}
+		address := c.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress().GetAddress()
+		if expectedAddress := fmt.Sprintf("10.0.0.%d", i+1); address != expectedAddress {
+			t.Errorf("Unexpected endpoint address for %s, want %s got %s", c.Name, expectedAddress, address)
+		}
+	}
+}
+
+func TestApplyDestinationRuleSubsetClientCredentialNames(t *testing.T) {
+	port := &model.Port{Name: "https", Port: 8443, Protocol: protocol.HTTPS}
+	service := &model.Service{
+		Hostname:    host.Name("foo.example.org"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports:       model.PortList{port},
+		Resolution:  model.ClientSideLB,
+		Attributes:  model.ServiceAttributes{Namespace: TestServiceNamespace},
+	}
+	destRule := &networking.DestinationRule{
+		Host: "foo.example.org",
+		TrafficPolicy: &networking.TrafficPolicy{
+			Tls: &networking.TLSSettings{Mode: networking.TLSSettings_MUTUAL},
+		},
+		Subsets: []*networking.Subset{
+			{Name: "v1", Labels: map[string]string{"version": "v1"}},
+			{Name: "v2", Labels: map[string]string{"version": "v2"}},
+		},
+	}
+
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+	configStore := &fakes.IstioConfigStore{
+		ListStub: func(typ resource.GroupVersionKind, namespace string) (configs []model.Config, e error) {
+			if typ == collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind() {
+				return []model.Config{
+					{ConfigMeta: model.ConfigMeta{
+						Type:    collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+						Version: collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+						Name:    "acme",
+						Annotations: map[string]string{
+							model.ClientCredentialNameAnnotation:        "foo-cert",
+							model.SubsetClientCredentialNamesAnnotation: "v2=foo-v2-cert",
+						},
+					},
+						Spec: destRule,
+					}}, nil
+			}
+			return nil, nil
+		},
+	}
+	mesh := testMesh
+	mesh.SdsUdsPath = "unix:/var/run/sds/uds_path"
+	env := newTestEnvironment(serviceDiscovery, mesh, configStore)
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{UserSds: true},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	proxy.SetSidecarScope(env.PushContext)
+	cb := NewClusterBuilder(proxy, env.PushContext)
+
+	cluster := &apiv2.Cluster{
+		Name:                 "outbound|8443||foo.example.org",
+		ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+	}
+	subsetClusters := cb.applyDestinationRule(cluster, DefaultClusterMode, service, port, map[string]bool{"": true})
+	if len(subsetClusters) != 2 {
+		t.Fatalf("Unexpected subset clusters want 2, got %d", len(subsetClusters))
+	}
+
+	expected := map[string]string{
+		"outbound|8443||foo.example.org": "foo-cert",
+		// The subset without an entry inherits the client certificate of the destination rule.
+		"outbound|8443|v1|foo.example.org": "foo-cert",
+		"outbound|8443|v2|foo.example.org": "foo-v2-cert",
+	}
+	for _, c := range append([]*apiv2.Cluster{cluster}, subsetClusters...) {
+		tlsContext := getTLSContext(t, c)
+		if tlsContext == nil {
+			t.Fatalf("Expected a TLS context for cluster %s", c.Name)
+		}
+		sdsConfigs := tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs
+		if len(sdsConfigs) != 1 || sdsConfigs[0].Name != expected[c.Name] {
+			t.Errorf("Unexpected SDS secret configs for cluster %s, want %s got %v", c.Name, expected[c.Name], sdsConfigs)
+		}
+	}
+}
+
+func TestApplyDestinationRuleSubsetEndpoints(t *testing.T) {
+	port := &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:     host.Name("foo.example.org"),
+		Address:      "1.1.1.1",
+		ClusterVIPs:  make(map[string]string),
+		Ports:        model.PortList{port},
+		Resolution:   model.DNSLB,
+		MeshExternal: true,
+		Attributes:   model.ServiceAttributes{Namespace: TestServiceNamespace},
+	}
+	instances := []*model.ServiceInstance{
+		{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "foo-v1.example.org",
+				EndpointPort: 8080,
+				Labels:       labels.Instance{"version": "v1"},
+			},
+		},
+		{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "foo-v2.example.org",
+				EndpointPort: 8080,
+				Labels:       labels.Instance{"version": "v2"},
+			},
+		},
+	}
+	destRule := &networking.DestinationRule{
+		Host: "foo.example.org",
+		Subsets: []*networking.Subset{
+			{Name: "v1", Labels: map[string]string{"version": "v1"}},
+		},
+	}
+
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+	serviceDiscovery.InstancesByPortStub = func(_ *model.Service, _ int, c labels.Collection) ([]*model.ServiceInstance, error) {
+		out := make([]*model.ServiceInstance, 0)
+		for _, instance := range instances {
+			if c.HasSubsetOf(instance.Endpoint.Labels) {
+				out = append(out, instance)
+			}
+		}
+		return out, nil
+	}
+	configStore := &fakes.IstioConfigStore{
+		ListStub: func(typ resource.GroupVersionKind, namespace string) (configs []model.Config, e error) {
+			if typ == collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind() {
+				return []model.Config{
+					{ConfigMeta: model.ConfigMeta{
+						Type:    collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+						Version: collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+						Name:    "acme",
+					},
+						Spec: destRule,
+					}}, nil
+			}
+			return nil, nil
+		},
+	}
+	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	proxy.SetSidecarScope(env.PushContext)
+	cb := NewClusterBuilder(proxy, env.PushContext)
+
+	cluster := cb.buildDefaultCluster("outbound|8080||foo.example.org", apiv2.Cluster_STRICT_DNS,
+		buildLocalityLbEndpoints(env.PushContext, map[string]bool{"": true}, service, port.Port, nil, nil),
+		model.TrafficDirectionOutbound, port, service.MeshExternal)
+	if cluster == nil {
+		t.Fatalf("Expected a default cluster")
+	}
+	subsetClusters := cb.applyDestinationRule(cluster, DefaultClusterMode, service, port, map[string]bool{"": true})
+	if len(subsetClusters) != 1 {
+		t.Fatalf("Unexpected subset clusters want 1, got %d", len(subsetClusters))
+	}
+
+	expected := map[string][]string{
+		"outbound|8080||foo.example.org":   {"foo-v1.example.org", "foo-v2.example.org"},
+		"outbound|8080|v1|foo.example.org": {"foo-v1.example.org"},
+	}
+	for _, c := range append([]*apiv2.Cluster{cluster}, subsetClusters...) {
+		var addresses []string
+		for _, llb := range c.LoadAssignment.Endpoints {
+			for _, lb := range llb.LbEndpoints {
+				addresses = append(addresses, lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+			}
+		}
+		if !reflect.DeepEqual(addresses, expected[c.Name]) {
+			t.Errorf("Unexpected endpoints for cluster %s, want %v got %v", c.Name, expected[c.Name], addresses)
+		}
+	}
+}
+
+func TestBuildClustersDefaultSubsetEndpoints(t *testing.T) {
+	port := &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:     host.Name("foo.example.org"),
+		Address:      "1.1.1.1",
+		ClusterVIPs:  make(map[string]string),
+		Ports:        model.PortList{port},
+		Resolution:   model.DNSLB,
+		MeshExternal: true,
+		Attributes:   model.ServiceAttributes{Namespace: TestServiceNamespace},
+	}
+	instances := []*model.ServiceInstance{
+		{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "foo-v1.example.org",
+				EndpointPort: 8080,
+				Labels:       labels.Instance{"version": "v1", "app": "foo"},
+			},
+		},
+		{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "foo-v2.example.org",
+				EndpointPort: 8080,
+				Labels:       labels.Instance{"version": "v2", "app": "foo"},
+			},
+		},
+	}
+	destRule := &networking.DestinationRule{
+		Host: "foo.example.org",
+		Subsets: []*networking.Subset{
+			{Name: "v1", Labels: map[string]string{"version": "v1"}},
+			{Name: "v2", Labels: map[string]string{"version": "v2"}},
+		},
+	}
+
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+	serviceDiscovery.InstancesByPortStub = func(_ *model.Service, _ int, c labels.Collection) ([]*model.ServiceInstance, error) {
+		out := make([]*model.ServiceInstance, 0)
+		for _, instance := range instances {
+			if c.HasSubsetOf(instance.Endpoint.Labels) {
+				out = append(out, instance)
+			}
+		}
+		return out, nil
+	}
+	configStore := &fakes.IstioConfigStore{
+		ListStub: func(typ resource.GroupVersionKind, namespace string) (configs []model.Config, e error) {
+			if typ == collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind() {
+				return []model.Config{
+					{ConfigMeta: model.ConfigMeta{
+						Type:        collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+						Version:     collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+						Name:        "acme",
+						Annotations: map[string]string{model.DefaultSubsetAnnotation: "v1"},
+					},
+						Spec: destRule,
+					}}, nil
+			}
+			return nil, nil
+		},
+	}
+	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	proxy.SetSidecarScope(env.PushContext)
+
+	var cluster *apiv2.Cluster
+	for _, c := range NewConfigGenerator([]plugin.Plugin{}).BuildClusters(proxy, env.PushContext) {
+		if c.Name == "outbound|8080||foo.example.org" {
+			cluster = c
+		}
+	}
+	if cluster == nil {
+		t.Fatalf("Expected a default cluster")
+	}
+	if cluster.LbSubsetConfig.GetFallbackPolicy() != apiv2.Cluster_LbSubsetConfig_DEFAULT_SUBSET {
+		t.Fatalf("Unexpected fallback policy %v", cluster.LbSubsetConfig.GetFallbackPolicy())
+	}
+
+	// Envoy falls back to the endpoints whose envoy.lb metadata matches all of the default subset.
+	var matched []string
+	for _, llb := range cluster.LoadAssignment.Endpoints {
+		for _, lb := range llb.LbEndpoints {
+			lbMetadata := lb.GetMetadata().GetFilterMetadata()[util.EnvoyLbMetadataKey].GetFields()
+			matches := true
+			for k, v := range cluster.LbSubsetConfig.DefaultSubset.Fields {
+				if lbMetadata[k].GetStringValue() != v.GetStringValue() {
+					matches = false
+				}
+			}
+			if matches {
+				matched = append(matched, lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+			}
+		}
+	}
+	if !reflect.DeepEqual(matched, []string{"foo-v1.example.org"}) {
+		t.Errorf("Unexpected endpoints of the default subset, want [foo-v1.example.org] got %v", matched)
+	}
+}
+
+func TestApplyEndpointPort(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		expected    uint32
+	}{
+		{
+			name:     "default",
+			expected: 10001,
+		},
+		{
+			name:        "remapped port",
+			annotations: map[string]string{model.EndpointPortsAnnotation: "9090=9091, 8080=15001"},
+			expected:    15001,
+		},
+		{
+			name:        "other port remapped",
+			annotations: map[string]string{model.EndpointPortsAnnotation: "9090=9091"},
+			expected:    10001,
+		},
+		{
+			name:        "invalid port",
+			annotations: map[string]string{model.EndpointPortsAnnotation: "8080=http"},
+			expected:    10001,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			lbEndpoint := &endpoint.LbEndpoint{
+				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+					Endpoint: &endpoint.Endpoint{Address: util.BuildAddress("10.0.0.1", 10001)},
+				},
+			}
+			cluster := &apiv2.Cluster{
+				Name:                 "outbound|8080||foo.example.org",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STATIC},
+				LoadAssignment: &apiv2.ClusterLoadAssignment{
+					ClusterName: "outbound|8080||foo.example.org",
+					Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint}}},
+				},
+			}
+			applyEndpointPort(cluster, parseAnnotations(tt.annotations).EndpointPorts, &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP})
+
+			socketAddress := cluster.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress()
+			if socketAddress.GetAddress() != "10.0.0.1" || socketAddress.GetPortValue() != tt.expected {
+				t.Errorf("Unexpected endpoint address %v, want port %d", socketAddress, tt.expected)
+			}
+			// The original endpoint may be shared, so it is left alone.
+			if port := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress().GetPortValue(); port != 10001 {
+				t.Errorf("Unexpected change of the original endpoint port to %d", port)
+			}
+		})
+	}
+}
+
+func TestApplyHealthCheckHost(t *testing.T) {
+	newCluster := func() *apiv2.Cluster {
+		return &apiv2.Cluster{
+			Name:                 "outbound|8080||foo.example.org",
+			ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STATIC},
+			LoadAssignment: &apiv2.ClusterLoadAssignment{
+				ClusterName: "outbound|8080||foo.example.org",
+				Endpoints: []*endpoint.LocalityLbEndpoints{{LbEndpoints: []*endpoint.LbEndpoint{{
+					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+						Endpoint: &endpoint.Endpoint{Address: util.BuildAddress("10.0.0.1", 10001)},
+					},
+				}}}},
+			},
+		}
+	}
+
+	// Without a host, the endpoints are health checked with the host of the cluster.
+	cluster := newCluster()
+	applyHealthCheckHost(cluster, "")
+	if hc := cluster.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().HealthCheckConfig; hc != nil {
+		t.Errorf("Unexpected health check config %v", hc)
+	}
+
+	cluster = newCluster()
+	applyHealthCheckHost(cluster, "backend.example.org")
+	if host := cluster.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().HealthCheckConfig.GetHostname(); host != "backend.example.org" {
+		t.Errorf("Unexpected health check host %q, want backend.example.org", host)
+	}
+}
+
+func TestApplyDestinationRuleStatName(t *testing.T) {
+	port := &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:    host.Name("foo.example.org"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports:       model.PortList{port},
+		Resolution:  model.ClientSideLB,
+		Attributes:  model.ServiceAttributes{Namespace: TestServiceNamespace},
+	}
+	destRule := &networking.DestinationRule{
+		Host:    "foo.example.org",
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	}
+
+	cases := []struct {
+		name               string
+		annotations        map[string]string
+		expectedStatName   string
+		expectedSubsetName string
+	}{
+		{
+			name:               "default",
+			expectedStatName:   "",
+			expectedSubsetName: "mesh_v1_8080",
+		},
+		{
+			name:               "stat name",
+			annotations:        map[string]string{model.StatNameAnnotation: "payments_%SUBSET_NAME%_%SERVICE_PORT%"},
+			expectedStatName:   "payments__8080",
+			expectedSubsetName: "payments_v1_8080",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceDiscovery := &fakes.ServiceDiscovery{}
+			serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+			configStore := &fakes.IstioConfigStore{
+				ListStub: func(typ resource.GroupVersionKind, namespace string) (configs []model.Config, e error) {
+					if typ == collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind() {
+						return []model.Config{
+							{ConfigMeta: model.ConfigMeta{
+								Type:        collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+								Version:     collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+								Name:        "acme",
+								Annotations: tt.annotations,
+							},
+								Spec: destRule,
+							}}, nil
+					}
+					return nil, nil
+				},
+			}
+			mesh := testMesh
+			mesh.OutboundClusterStatName = "mesh_%SUBSET_NAME%_%SERVICE_PORT%"
+			env := newTestEnvironment(serviceDiscovery, mesh, configStore)
+
+			proxy := &model.Proxy{Type: model.SidecarProxy, Metadata: &model.NodeMetadata{}}
+			proxy.SetSidecarScope(env.PushContext)
+			cb := NewClusterBuilder(proxy, env.PushContext)
+
+			// The stat name of the default cluster is set by the caller, the destination rule only overrides it.
+			cluster := &apiv2.Cluster{
+				Name:                 "outbound|8080||foo.example.org",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+			}
+			subsetClusters := cb.applyDestinationRule(cluster, DefaultClusterMode, service, port, map[string]bool{"": true})
+			if len(subsetClusters) != 1 {
+				t.Fatalf("Unexpected subset clusters want 1, got %d", len(subsetClusters))
+			}
+			if cluster.AltStatName != tt.expectedStatName {
+				t.Errorf("Unexpected stat name want %q, got %q", tt.expectedStatName, cluster.AltStatName)
+			}
+			if subsetClusters[0].AltStatName != tt.expectedSubsetName {
+				t.Errorf("Unexpected subset stat name want %q, got %q", tt.expectedSubsetName, subsetClusters[0].AltStatName)
+			}
+		})
+	}
+}
+
+func TestApplyDestinationRuleAutoMtlsMetadata(t *testing.T) {
+	_ = os.Setenv(features.EnableAutoMtlsClusterMetadata.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableAutoMtlsClusterMetadata.Name) }()
+
+	port := &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:    host.Name("foo.default.svc.cluster.local"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports:       model.PortList{port},
+		Resolution:  model.ClientSideLB,
+		Attributes:  model.ServiceAttributes{Namespace: TestServiceNamespace},
+	}
+
+	cases := []struct {
+		name     string
+		tls      *networking.TLSSettings
+		expected *structpb.Value
+	}{
+		{
+			name:     "automatic mTLS",
+			tls:      nil,
+			expected: &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: true}},
+		},
+		{
+			name:     "destination rule mTLS",
+			tls:      &networking.TLSSettings{Mode: networking.TLSSettings_ISTIO_MUTUAL},
+			expected: &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: false}},
+		},
+		{
+			name:     "plaintext",
+			tls:      &networking.TLSSettings{Mode: networking.TLSSettings_DISABLE},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			destRule := &networking.DestinationRule{
+				Host:          "foo.default.svc.cluster.local",
+				TrafficPolicy: &networking.TrafficPolicy{Tls: tt.tls},
+				Subsets: []*networking.Subset{
+					{Name: "v1", Labels: map[string]string{"version": "v1"}},
+				},
+			}
+			serviceDiscovery := &fakes.ServiceDiscovery{}
+			serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+			configStore := &fakes.IstioConfigStore{
+				ListStub: func(typ resource.GroupVersionKind, namespace string) (configs []model.Config, e error) {
+					if typ == collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind() {
+						return []model.Config{
+							{ConfigMeta: model.ConfigMeta{
+								Type:    collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+								Version: collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+								Name:    "acme",
+							},
+								Spec: destRule,
+							}}, nil
+					}
+					return nil, nil
+				},
+			}
+			mesh := testMesh
+			mesh.EnableAutoMtls = &types.BoolValue{Value: true}
+			env := newTestEnvironment(serviceDiscovery, mesh, configStore)
+
+			proxy := &model.Proxy{
+				Type:         model.SidecarProxy,
+				Metadata:     &model.NodeMetadata{},
+				IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+			}
+			proxy.SetSidecarScope(env.PushContext)
+			cb := NewClusterBuilder(proxy, env.PushContext)
+
+			cluster := cb.buildDefaultCluster("outbound|8080||foo.default.svc.cluster.local", apiv2.Cluster_EDS, nil,
+				model.TrafficDirectionOutbound, port, service.MeshExternal)
+			subsetClusters := cb.applyDestinationRule(cluster, DefaultClusterMode, service, port, map[string]bool{"": true})
+			if len(subsetClusters) != 1 {
+				t.Fatalf("Unexpected subset clusters want 1, got %d", len(subsetClusters))
+			}
+
+			for _, c := range append([]*apiv2.Cluster{cluster}, subsetClusters...) {
+				autoMtls := c.Metadata.FilterMetadata[util.IstioMetadataKey].Fields["autoMtls"]
+				if !reflect.DeepEqual(autoMtls, tt.expected) {
+					t.Errorf("Unexpected autoMtls metadata for cluster %s, want %v got %v", c.Name, tt.expected, autoMtls)
+				}
+			}
+		})
+	}
+}
+
+// parseAnnotations parses the annotations of a destination rule, leaving the invalid ones unset like the cluster
+// builder does.
+func parseAnnotations(annotations map[string]string) *model.DestinationRuleAnnotations {
+	out, _ := model.ParseDestinationRuleAnnotations(annotations)
+	return out
+}
@@ -16,8 +16,10 @@ package v1alpha3
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -30,6 +32,8 @@ import (
 	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	apiv2_cluster "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	dfpcluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/dynamic_forward_proxy/v2alpha"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	. "github.com/onsi/gomega"
@@ -48,10 +52,13 @@ import (
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/mesh"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/schema/collections"
 	"istio.io/istio/pkg/config/schema/resource"
+	"istio.io/istio/pkg/spiffe"
+	"istio.io/istio/pkg/util/gogo"
 )
 
 type ConfigType int
@@ -77,6 +84,7 @@ var (
 		EnableAutoMtls: &types.BoolValue{
 			Value: false,
 		},
+		OutboundTrafficPolicy: &meshconfig.MeshConfig_OutboundTrafficPolicy{Mode: meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY},
 	}
 )
 
@@ -235,6 +243,200 @@ func TestCommonHttpProtocolOptions(t *testing.T) {
 	}
 }
 
+func TestTCPClusterIgnoresHTTPConnectionPoolSettings(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	push := model.NewPushContext()
+	push.Mesh = &testMesh
+	cluster := &apiv2.Cluster{Name: "outbound|3306||mysql.example.org"}
+	applyTrafficPolicy(buildClusterOpts{
+		push:    push,
+		cluster: cluster,
+		policy: &networking.TrafficPolicy{
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+					MaxConnections: 10,
+					ConnectTimeout: &types.Duration{Seconds: 2},
+				},
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{
+					MaxRequestsPerConnection: 1,
+					MaxRetries:               5,
+					IdleTimeout:              &types.Duration{Seconds: 30},
+					H2UpgradePolicy:          networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+				},
+			},
+		},
+		port:        &model.Port{Name: "mysql", Port: 3306, Protocol: protocol.TCP},
+		clusterMode: DefaultClusterMode,
+		direction:   model.TrafficDirectionOutbound,
+		proxy:       &model.Proxy{},
+	})
+
+	g.Expect(cluster.Http2ProtocolOptions).To(BeNil())
+	g.Expect(cluster.CommonHttpProtocolOptions).To(BeNil())
+	g.Expect(cluster.MaxRequestsPerConnection).To(BeNil())
+	g.Expect(cluster.CircuitBreakers.Thresholds[0].MaxRetries.GetValue()).To(Equal(uint32(math.MaxUint32)))
+	g.Expect(cluster.CircuitBreakers.Thresholds[0].MaxConnections.GetValue()).To(Equal(uint32(10)))
+	g.Expect(cluster.ConnectTimeout).To(Equal(ptypes.DurationProto(2 * time.Second)))
+}
+
+func TestH2UpgradeForAutoPort(t *testing.T) {
+	cases := []struct {
+		name         string
+		tls          *networking.TLSSettings
+		expectedAlpn []string
+	}{
+		{
+			name: "h2c",
+		},
+		{
+			name:         "h2 over tls",
+			tls:          &networking.TLSSettings{Mode: networking.TLSSettings_SIMPLE},
+			expectedAlpn: util.ALPNH2Only,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			clusters, err := buildTestClusters("*.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
+				&networking.DestinationRule{
+					Host: "*.example.org",
+					TrafficPolicy: &networking.TrafficPolicy{
+						PortLevelSettings: []*networking.TrafficPolicy_PortTrafficPolicy{
+							{
+								Port: &networking.PortSelector{
+									Number: 9090,
+								},
+								ConnectionPool: &networking.ConnectionPoolSettings{
+									Http: &networking.ConnectionPoolSettings_HTTPSettings{
+										H2UpgradePolicy: networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+									},
+								},
+								Tls: tc.tls,
+							},
+						},
+					},
+				})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			// The HTTP port is not upgraded.
+			g.Expect(clusters[0].Name).To(Equal("outbound|8080||*.example.org"))
+			g.Expect(clusters[0].Http2ProtocolOptions).To(BeNil())
+
+			cluster := clusters[1]
+			g.Expect(cluster.Name).To(Equal("outbound|9090||*.example.org"))
+			g.Expect(cluster.Http2ProtocolOptions).NotTo(BeNil())
+			g.Expect(cluster.ProtocolSelection).To(Equal(apiv2.Cluster_USE_CONFIGURED_PROTOCOL))
+			if tc.tls == nil {
+				g.Expect(cluster.TransportSocket).To(BeNil())
+			} else {
+				g.Expect(getTLSContext(t, cluster).CommonTlsContext.AlpnProtocols).To(Equal(tc.expectedAlpn))
+			}
+		})
+	}
+}
+
+func TestConnectionPoolForAutoPort(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	clusters, err := buildTestClusters("*.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+						MaxConnections: 100,
+						ConnectTimeout: &types.Duration{Seconds: 2},
+					},
+					Http: &networking.ConnectionPoolSettings_HTTPSettings{
+						Http1MaxPendingRequests:  10,
+						Http2MaxRequests:         200,
+						MaxRequestsPerConnection: 5,
+						IdleTimeout:              &types.Duration{Seconds: 30},
+					},
+				},
+			},
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	cluster := clusters[1]
+	g.Expect(cluster.Name).To(Equal("outbound|9090||*.example.org"))
+
+	// The TCP settings apply to the connections of either protocol.
+	g.Expect(cluster.ConnectTimeout).To(Equal(ptypes.DurationProto(2 * time.Second)))
+	thresholds := cluster.CircuitBreakers.Thresholds[0]
+	g.Expect(thresholds.MaxConnections.GetValue()).To(Equal(uint32(100)))
+
+	// The HTTP settings only take effect for the HTTP connection pools of Envoy, so they are safe to set along
+	// with the TCP settings. Envoy applies the ones of the protocol it detects.
+	g.Expect(thresholds.MaxPendingRequests.GetValue()).To(Equal(uint32(10)))
+	g.Expect(thresholds.MaxRequests.GetValue()).To(Equal(uint32(200)))
+	g.Expect(cluster.MaxRequestsPerConnection.GetValue()).To(Equal(uint32(5)))
+	g.Expect(cluster.CommonHttpProtocolOptions.GetIdleTimeout()).To(Equal(ptypes.DurationProto(30 * time.Second)))
+
+	// The upstream protocol is still selected at runtime, by the detected downstream protocol.
+	g.Expect(cluster.ProtocolSelection).To(Equal(apiv2.Cluster_USE_DOWNSTREAM_PROTOCOL))
+}
+
+func TestBuildClustersWithSubsetLoadBalancer(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	clusters, err := buildTestClusters("foo.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "foo.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				LoadBalancer: &networking.LoadBalancerSettings{
+					LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+						ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+							HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: true},
+						},
+					},
+				},
+			},
+			Subsets: []*networking.Subset{
+				{
+					Name:   "round-robin",
+					Labels: map[string]string{"version": "v1"},
+					TrafficPolicy: &networking.TrafficPolicy{
+						LoadBalancer: &networking.LoadBalancerSettings{
+							LbPolicy: &networking.LoadBalancerSettings_Simple{
+								Simple: networking.LoadBalancerSettings_ROUND_ROBIN,
+							},
+						},
+					},
+				},
+				{
+					Name:   "inherited",
+					Labels: map[string]string{"version": "v2"},
+					TrafficPolicy: &networking.TrafficPolicy{
+						ConnectionPool: &networking.ConnectionPoolSettings{
+							Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+						},
+					},
+				},
+			},
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	lbPolicies := make(map[string]apiv2.Cluster_LbPolicy)
+	for _, c := range clusters {
+		if strings.HasPrefix(c.Name, "outbound|8080|") {
+			lbPolicies[c.Name] = c.LbPolicy
+			if c.LbPolicy == apiv2.Cluster_RING_HASH {
+				g.Expect(c.GetRingHashLbConfig()).NotTo(BeNil())
+			} else {
+				g.Expect(c.LbConfig).To(BeNil())
+			}
+		}
+	}
+	g.Expect(lbPolicies).To(Equal(map[string]apiv2.Cluster_LbPolicy{
+		"outbound|8080||foo.example.org":            apiv2.Cluster_RING_HASH,
+		"outbound|8080|round-robin|foo.example.org": apiv2.Cluster_ROUND_ROBIN,
+		"outbound|8080|inherited|foo.example.org":   apiv2.Cluster_RING_HASH,
+	}))
+}
+
 func buildTestClusters(serviceHostname string, serviceResolution model.Resolution,
 	nodeType model.NodeType, locality *core.Locality, mesh meshconfig.MeshConfig,
 	destRule proto.Message) ([]*apiv2.Cluster, error) {
@@ -720,6 +922,25 @@ func TestBuildSidecarClustersWithMeshWideTCPKeepalive(t *testing.T) {
 	g.Expect(cluster.UpstreamConnectionOptions.TcpKeepalive.KeepaliveInterval).To(BeNil())
 }
 
+func TestBuildSidecarClustersWithMeshWideTCPKeepaliveWithoutDestinationRule(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	m := testMesh
+	m.TcpKeepalive = &networking.ConnectionPoolSettings_TCPSettings_TcpKeepalive{
+		Time: &types.Duration{Seconds: MeshWideTCPKeepaliveSeconds},
+	}
+
+	clusters, err := buildTestClusters("foo.example.org", model.DNSLB, model.SidecarProxy, nil, m, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	for _, cluster := range clusters {
+		if !strings.HasPrefix(cluster.Name, "outbound|") {
+			continue
+		}
+		g.Expect(cluster.UpstreamConnectionOptions).NotTo(BeNil(), cluster.Name)
+		g.Expect(cluster.UpstreamConnectionOptions.TcpKeepalive.KeepaliveTime.Value).To(Equal(uint32(MeshWideTCPKeepaliveSeconds)))
+	}
+}
+
 func buildTestClustersWithTCPKeepalive(configType ConfigType) ([]*apiv2.Cluster, error) {
 	// Set mesh wide defaults.
 	m := testMesh
@@ -853,6 +1074,57 @@ func TestClusterMetadata(t *testing.T) {
 	g.Expect(foundSNISubset).To(Equal(true))
 }
 
+func TestClusterMetadataWithoutDestinationRule(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// The destination rule does not apply to the service.
+	clusters, err := buildTestClusters("*.example.org", 0, model.SidecarProxy, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "other.example.com",
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Only the service is recorded as the config source.
+	istio := clusters[0].Metadata.GetFilterMetadata()["istio"]
+	g.Expect(istio).NotTo(BeNil())
+	g.Expect(istio.Fields["service"].GetStringValue()).To(Equal("*.example.org"))
+	g.Expect(istio.Fields["serviceNamespace"].GetStringValue()).To(Equal(TestServiceNamespace))
+	_, ok := istio.Fields["config"]
+	g.Expect(ok).To(BeFalse())
+	_, ok = istio.Fields["configResourceVersion"]
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestClusterMetadataForExternalService(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	destRule := &networking.DestinationRule{
+		Host: "*.example.org",
+		Subsets: []*networking.Subset{
+			{
+				Name:   "v1",
+				Labels: map[string]string{"version": "v1"},
+			},
+		},
+	}
+	for _, external := range []bool{true, false} {
+		clusters, err := buildTestClustersWithAuthnPolicy("*.example.org", model.ClientSideLB, external, model.SidecarProxy,
+			nil, testMesh, destRule, nil, nil)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		for _, c := range clusters {
+			if !strings.HasPrefix(c.Name, "outbound") {
+				continue
+			}
+			value, ok := c.Metadata.GetFilterMetadata()["istio"].GetFields()["external"]
+			g.Expect(ok).To(Equal(external), c.Name)
+			if external {
+				g.Expect(value.GetBoolValue()).To(BeTrue(), c.Name)
+			}
+		}
+	}
+}
+
 func TestConditionallyConvertToIstioMtls(t *testing.T) {
 	tlsSettings := &networking.TLSSettings{
 		Mode:              networking.TLSSettings_ISTIO_MUTUAL,
@@ -1140,144 +1412,1007 @@ func TestApplyOutlierDetection(t *testing.T) {
 	}
 }
 
-func TestStatNamePattern(t *testing.T) {
+func TestApplyOutlierDetectionBaseEjectionTimeJitter(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	statConfigMesh := meshconfig.MeshConfig{
-		ConnectTimeout: &types.Duration{
-			Seconds: 10,
-			Nanos:   1,
-		},
-		EnableAutoMtls: &types.BoolValue{
-			Value: false,
-		},
-		InboundClusterStatName:  "LocalService_%SERVICE%",
-		OutboundClusterStatName: "%SERVICE%_%SERVICE_PORT_NAME%_%SERVICE_PORT%",
+	outlier := &networking.OutlierDetection{
+		BaseEjectionTime: &types.Duration{Seconds: 10},
 	}
 
-	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
-		&core.Locality{}, statConfigMesh,
-		&networking.DestinationRule{
-			Host: "*.example.org",
-		})
+	// No jitter by default.
+	cluster := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyOutlierDetection(cluster, outlier)
+	g.Expect(cluster.OutlierDetection.BaseEjectionTime).To(Equal(ptypes.DurationProto(10 * time.Second)))
+
+	_ = os.Setenv(features.OutlierBaseEjectionTimeJitter.Name, "5s")
+	defer func() { _ = os.Unsetenv(features.OutlierBaseEjectionTimeJitter.Name) }()
+
+	applyOutlierDetection(cluster, outlier)
+	jittered, err := ptypes.Duration(cluster.OutlierDetection.BaseEjectionTime)
 	g.Expect(err).NotTo(HaveOccurred())
-	g.Expect(clusters[0].AltStatName).To(Equal("*.example.org_default_8080"))
-	g.Expect(clusters[4].AltStatName).To(Equal("LocalService_*.example.org"))
+	g.Expect(jittered).To(BeNumerically(">=", 10*time.Second))
+	g.Expect(jittered).To(BeNumerically("<", 15*time.Second))
+
+	// The jittered value is stable for a given cluster.
+	again := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyOutlierDetection(again, outlier)
+	g.Expect(again.OutlierDetection.BaseEjectionTime).To(Equal(cluster.OutlierDetection.BaseEjectionTime))
+
+	// Jitter applies on top of the Envoy default when the base ejection time is not set.
+	cluster = &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyOutlierDetection(cluster, &networking.OutlierDetection{})
+	jittered, err = ptypes.Duration(cluster.OutlierDetection.BaseEjectionTime)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(jittered).To(BeNumerically(">=", 30*time.Second))
+	g.Expect(jittered).To(BeNumerically("<", 35*time.Second))
 }
 
-func TestDuplicateClusters(t *testing.T) {
+func TestApplyConnectionPoolConnectTimeoutJitter(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
-		&core.Locality{}, testMesh,
-		&networking.DestinationRule{
-			Host: "*.example.org",
-		})
-	g.Expect(len(clusters)).To(Equal(8))
+	settings := &networking.ConnectionPoolSettings{
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+			ConnectTimeout: &types.Duration{Seconds: 1},
+		},
+	}
+	push := model.NewPushContext()
+	push.Mesh = &testMesh
+
+	// No jitter by default.
+	cluster := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyConnectionPool(push, cluster, settings)
+	g.Expect(cluster.ConnectTimeout).To(Equal(ptypes.DurationProto(time.Second)))
+
+	_ = os.Setenv(features.ConnectTimeoutJitter.Name, "500ms")
+	defer func() { _ = os.Unsetenv(features.ConnectTimeoutJitter.Name) }()
+
+	applyConnectionPool(push, cluster, settings)
+	jittered, err := ptypes.Duration(cluster.ConnectTimeout)
 	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(jittered).To(BeNumerically(">=", time.Second))
+	g.Expect(jittered).To(BeNumerically("<", 1500*time.Millisecond))
+
+	// The jittered value is stable for a given cluster, and does not add up when applied again.
+	again := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyConnectionPool(push, again, settings)
+	g.Expect(again.ConnectTimeout).To(Equal(cluster.ConnectTimeout))
 }
 
-func TestSidecarLocalityLB(t *testing.T) {
+func TestApplyOutlierDetectionDefaultMaxEjectionPercent(t *testing.T) {
 	g := NewGomegaWithT(t)
-	// Distribute locality loadbalancing setting
-	testMesh.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{
-		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
-			{
-				From: "region1/zone1/subzone1",
-				To: map[string]uint32{
-					"region1/zone1/*":        50,
-					"region2/zone1/subzone1": 50,
-				},
-			},
-		},
-	}
 
-	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
-		&core.Locality{
-			Region:  "region1",
-			Zone:    "zone1",
-			SubZone: "subzone1",
-		}, testMesh,
+	// Envoy's default is used when unset.
+	cluster := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5})
+	g.Expect(cluster.OutlierDetection.MaxEjectionPercent).To(BeNil())
+
+	_ = os.Setenv(features.OutlierDefaultMaxEjectionPercent.Name, "50")
+	defer func() { _ = os.Unsetenv(features.OutlierDefaultMaxEjectionPercent.Name) }()
+
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5})
+	g.Expect(cluster.OutlierDetection.MaxEjectionPercent.GetValue()).To(Equal(uint32(50)))
+
+	// The destination rule takes precedence over the mesh default.
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5, MaxEjectionPercent: 20})
+	g.Expect(cluster.OutlierDetection.MaxEjectionPercent.GetValue()).To(Equal(uint32(20)))
+}
+
+func TestBuildClustersWithInvalidDurations(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	clusters, err := buildTestClusters("foo.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
 		&networking.DestinationRule{
-			Host: "*.example.org",
+			Host: "foo.example.org",
 			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp:  &networking.ConnectionPoolSettings_TCPSettings{ConnectTimeout: &types.Duration{Seconds: -1}},
+					Http: &networking.ConnectionPoolSettings_HTTPSettings{IdleTimeout: &types.Duration{Seconds: -5}},
+				},
 				OutlierDetection: &networking.OutlierDetection{
 					ConsecutiveErrors: 5,
-					MinHealthPercent:  10,
+					Interval:          &types.Duration{Seconds: -10},
+					BaseEjectionTime:  &types.Duration{},
 				},
 			},
 		})
 	g.Expect(err).NotTo(HaveOccurred())
 
-	if clusters[0].CommonLbConfig == nil {
-		t.Fatalf("CommonLbConfig should be set for cluster %+v", clusters[0])
-	}
-	g.Expect(clusters[0].CommonLbConfig.HealthyPanicThreshold.GetValue()).To(Equal(float64(10)))
-
-	g.Expect(len(clusters[0].LoadAssignment.Endpoints)).To(Equal(3))
-	for _, localityLbEndpoint := range clusters[0].LoadAssignment.Endpoints {
-		locality := localityLbEndpoint.Locality
-		if locality.Region == "region1" && locality.SubZone == "subzone1" {
-			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(34)))
-			g.Expect(localityLbEndpoint.LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(40)))
-		} else if locality.Region == "region1" && locality.SubZone == "subzone2" {
-			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(17)))
-			g.Expect(localityLbEndpoint.LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(20)))
-		} else if locality.Region == "region2" {
-			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(50)))
-			g.Expect(len(localityLbEndpoint.LbEndpoints)).To(Equal(1))
-			g.Expect(localityLbEndpoint.LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(40)))
-		}
-	}
-
-	// Test failover
-	// Distribute locality loadbalancing setting
-	testMesh.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{}
-
-	clusters, err = buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
-		&core.Locality{
-			Region:  "region1",
-			Zone:    "zone1",
-			SubZone: "subzone1",
-		}, testMesh,
+	// The invalid durations are ignored, and the defaults apply instead.
+	cluster := clusters[0]
+	g.Expect(cluster.Name).To(Equal("outbound|8080||foo.example.org"))
+	g.Expect(cluster.ConnectTimeout).To(Equal(gogo.DurationToProtoDuration(testMesh.ConnectTimeout)))
+	g.Expect(cluster.CommonHttpProtocolOptions.GetIdleTimeout()).To(BeNil())
+	g.Expect(cluster.OutlierDetection.Interval).To(BeNil())
+	g.Expect(cluster.OutlierDetection.BaseEjectionTime).To(BeNil())
+
+	// Envoy requires a positive outlier detection interval, so a zero interval falls back to the default as well.
+	clusters, err = buildTestClusters("foo.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
 		&networking.DestinationRule{
-			Host: "*.example.org",
+			Host: "foo.example.org",
 			TrafficPolicy: &networking.TrafficPolicy{
 				OutlierDetection: &networking.OutlierDetection{
 					ConsecutiveErrors: 5,
-					MinHealthPercent:  10,
+					Interval:          &types.Duration{},
 				},
 			},
 		})
 	g.Expect(err).NotTo(HaveOccurred())
-	if clusters[0].CommonLbConfig == nil {
-		t.Fatalf("CommonLbConfig should be set for cluster %+v", clusters[0])
-	}
-	g.Expect(clusters[0].CommonLbConfig.HealthyPanicThreshold.GetValue()).To(Equal(float64(10)))
-
-	g.Expect(len(clusters[0].LoadAssignment.Endpoints)).To(Equal(3))
-	for _, localityLbEndpoint := range clusters[0].LoadAssignment.Endpoints {
-		locality := localityLbEndpoint.Locality
-		if locality.Region == "region1" && locality.Zone == "zone1" && locality.SubZone == "subzone1" {
-			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(0)))
-		} else if locality.Region == "region1" && locality.Zone == "zone1" && locality.SubZone == "subzone2" {
-			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(1)))
-		} else if locality.Region == "region2" {
-			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(2)))
-		}
-	}
+	g.Expect(clusters[0].Name).To(Equal("outbound|8080||foo.example.org"))
+	g.Expect(clusters[0].OutlierDetection.Interval).To(BeNil())
 }
 
-func TestLocalityLBDestinationRuleOverride(t *testing.T) {
+func TestApplyOutlierDetectionDefaultInterval(t *testing.T) {
 	g := NewGomegaWithT(t)
-	// Distribute locality loadbalancing setting
-	testMesh.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{
-		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
-			{
-				From: "region1/zone1/subzone1",
-				To: map[string]uint32{
-					"region1/zone1/*":        50,
-					"region2/zone1/subzone1": 50,
+
+	// Envoy's default is used when unset.
+	cluster := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5})
+	g.Expect(cluster.OutlierDetection.Interval).To(BeNil())
+
+	_ = os.Setenv(features.OutlierDefaultInterval.Name, "30s")
+	defer func() { _ = os.Unsetenv(features.OutlierDefaultInterval.Name) }()
+
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5})
+	g.Expect(cluster.OutlierDetection.Interval).To(Equal(ptypes.DurationProto(30 * time.Second)))
+
+	// The destination rule takes precedence over the mesh default.
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5, Interval: &types.Duration{Seconds: 5}})
+	g.Expect(cluster.OutlierDetection.Interval).To(Equal(ptypes.DurationProto(5 * time.Second)))
+}
+
+func TestBuildClustersWithDefaultOutlierDetection(t *testing.T) {
+	outlierDetection := func(destRule *networking.DestinationRule) *apiv2_cluster.OutlierDetection {
+		t.Helper()
+		clusters, err := buildTestClusters("foo.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh, destRule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range clusters {
+			if c.Name == "outbound|8080||foo.example.org" {
+				return c.OutlierDetection
+			}
+		}
+		t.Fatal("outbound cluster not found")
+		return nil
+	}
+	withoutOutlierDetection := &networking.DestinationRule{Host: "foo.example.org"}
+	disabled := &networking.DestinationRule{
+		Host: "foo.example.org",
+		TrafficPolicy: &networking.TrafficPolicy{
+			OutlierDetection: &networking.OutlierDetection{Interval: &types.Duration{}},
+		},
+	}
+
+	g := NewGomegaWithT(t)
+	g.Expect(outlierDetection(withoutOutlierDetection)).To(BeNil())
+
+	_ = os.Setenv(features.EnableDefaultOutlierDetection.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableDefaultOutlierDetection.Name) }()
+
+	outlier := outlierDetection(withoutOutlierDetection)
+	g.Expect(outlier).NotTo(BeNil())
+	g.Expect(outlier.ConsecutiveGatewayFailure.GetValue()).To(Equal(uint32(5)))
+	g.Expect(outlier.EnforcingConsecutiveGatewayFailure.GetValue()).To(Equal(uint32(100)))
+
+	// A destination rule can opt out of the default.
+	g.Expect(outlierDetection(disabled)).To(BeNil())
+}
+
+func TestApplyOutlierDetectionMaxEjectionPercentCeiling(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cluster := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5, MaxEjectionPercent: 100})
+	g.Expect(cluster.OutlierDetection.MaxEjectionPercent.GetValue()).To(Equal(uint32(100)))
+
+	_ = os.Setenv(features.OutlierMaxEjectionPercentCeiling.Name, "90")
+	defer func() { _ = os.Unsetenv(features.OutlierMaxEjectionPercentCeiling.Name) }()
+
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5, MaxEjectionPercent: 100})
+	g.Expect(cluster.OutlierDetection.MaxEjectionPercent.GetValue()).To(Equal(uint32(90)))
+
+	// Values below the ceiling are kept.
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5, MaxEjectionPercent: 50})
+	g.Expect(cluster.OutlierDetection.MaxEjectionPercent.GetValue()).To(Equal(uint32(50)))
+}
+
+func TestApplyOutlierDetectionDefaultBaseEjectionTime(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// Envoy's default is used when unset.
+	cluster := &apiv2.Cluster{Name: "outbound|8080||foo.example.org"}
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5})
+	g.Expect(cluster.OutlierDetection.BaseEjectionTime).To(BeNil())
+
+	_ = os.Setenv(features.OutlierDefaultBaseEjectionTime.Name, "1m")
+	defer func() { _ = os.Unsetenv(features.OutlierDefaultBaseEjectionTime.Name) }()
+
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5})
+	g.Expect(cluster.OutlierDetection.BaseEjectionTime).To(Equal(ptypes.DurationProto(time.Minute)))
+
+	// The destination rule takes precedence over the mesh default.
+	applyOutlierDetection(cluster, &networking.OutlierDetection{ConsecutiveErrors: 5, BaseEjectionTime: &types.Duration{Seconds: 10}})
+	g.Expect(cluster.OutlierDetection.BaseEjectionTime).To(Equal(ptypes.DurationProto(10 * time.Second)))
+}
+
+func TestClusterUpdateMergeWindow(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	destRule := &networking.DestinationRule{
+		Host: "*.example.org",
+	}
+
+	// Envoy's default merge window is used when unset.
+	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy, nil, testMesh, destRule)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters[0].CommonLbConfig.GetUpdateMergeWindow()).To(BeNil())
+
+	_ = os.Setenv(features.ClusterUpdateMergeWindow.Name, "3s")
+	defer func() { _ = os.Unsetenv(features.ClusterUpdateMergeWindow.Name) }()
+
+	clusters, err = buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy, nil, testMesh, destRule)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters[0].CommonLbConfig.GetUpdateMergeWindow()).To(Equal(ptypes.DurationProto(3 * time.Second)))
+}
+
+func TestDNSFailureRefreshRate(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	destRule := &networking.DestinationRule{
+		Host: "*.example.org",
+	}
+
+	// Failed resolutions are retried at the DNS refresh rate by default.
+	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy, nil, testMesh, destRule)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters[0].GetType()).To(Equal(apiv2.Cluster_STRICT_DNS))
+	g.Expect(clusters[0].DnsFailureRefreshRate).To(BeNil())
+
+	_ = os.Setenv(features.DNSFailureRefreshBaseInterval.Name, "1s")
+	defer func() { _ = os.Unsetenv(features.DNSFailureRefreshBaseInterval.Name) }()
+	_ = os.Setenv(features.DNSFailureRefreshMaxInterval.Name, "10s")
+	defer func() { _ = os.Unsetenv(features.DNSFailureRefreshMaxInterval.Name) }()
+
+	clusters, err = buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy, nil, testMesh, destRule)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters[0].DnsFailureRefreshRate).To(Equal(&apiv2.Cluster_RefreshRate{
+		BaseInterval: ptypes.DurationProto(time.Second),
+		MaxInterval:  ptypes.DurationProto(10 * time.Second),
+	}))
+}
+
+func TestDynamicForwardProxyCluster(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_ = os.Setenv(features.EnableDynamicForwardProxyClusters.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableDynamicForwardProxyClusters.Name) }()
+
+	clusters, err := buildTestClustersWithAuthnPolicy("*.example.org", model.Passthrough, true, model.SidecarProxy, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				Tls: &networking.TLSSettings{
+					Mode: networking.TLSSettings_SIMPLE,
+				},
+			},
+		}, nil, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	cluster := clusters[0]
+	g.Expect(cluster.Name).To(Equal("outbound|8080||*.example.org"))
+	g.Expect(cluster.GetClusterType().GetName()).To(Equal("envoy.clusters.dynamic_forward_proxy"))
+	g.Expect(cluster.LbPolicy).To(Equal(apiv2.Cluster_CLUSTER_PROVIDED))
+	g.Expect(cluster.EdsClusterConfig).To(BeNil())
+
+	clusterConfig := &dfpcluster.ClusterConfig{}
+	g.Expect(ptypes.UnmarshalAny(cluster.GetClusterType().GetTypedConfig(), clusterConfig)).To(Succeed())
+	g.Expect(clusterConfig.DnsCacheConfig.Name).To(Equal(DynamicForwardProxyDNSCacheName))
+
+	// The SNI follows the requested host.
+	g.Expect(cluster.TransportSocket).NotTo(BeNil())
+	g.Expect(cluster.UpstreamHttpProtocolOptions.GetAutoSni()).To(BeTrue())
+	g.Expect(cluster.UpstreamHttpProtocolOptions.GetAutoSanValidation()).To(BeTrue())
+}
+
+func TestSubsetOutlierDetectionOverride(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	clusters, err := buildTestClusters("*.example.org", 0, model.SidecarProxy, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				OutlierDetection: &networking.OutlierDetection{
+					ConsecutiveErrors: 5,
+					Interval:          &types.Duration{Seconds: 10},
+				},
+			},
+			Subsets: []*networking.Subset{
+				{
+					Name: "strict",
+					TrafficPolicy: &networking.TrafficPolicy{
+						OutlierDetection: &networking.OutlierDetection{
+							MaxEjectionPercent: 50,
+						},
+					},
+				},
+				{
+					Name: "disabled",
+					TrafficPolicy: &networking.TrafficPolicy{
+						OutlierDetection: &networking.OutlierDetection{
+							Interval: &types.Duration{},
+						},
+					},
+				},
+			},
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	outlierDetections := make(map[string]*apiv2_cluster.OutlierDetection)
+	for _, c := range clusters {
+		outlierDetections[c.Name] = c.OutlierDetection
+	}
+
+	defaultOutlier := outlierDetections["outbound|8080||*.example.org"]
+	g.Expect(defaultOutlier).NotTo(BeNil())
+	g.Expect(defaultOutlier.MaxEjectionPercent).To(BeNil())
+
+	// The subset only overrides the max ejection percent.
+	strictOutlier := outlierDetections["outbound|8080|strict|*.example.org"]
+	g.Expect(strictOutlier).NotTo(BeNil())
+	g.Expect(strictOutlier.MaxEjectionPercent.GetValue()).To(Equal(uint32(50)))
+	g.Expect(strictOutlier.ConsecutiveGatewayFailure.GetValue()).To(Equal(uint32(5)))
+	g.Expect(strictOutlier.Interval).To(Equal(ptypes.DurationProto(10 * time.Second)))
+
+	disabledOutlier, ok := outlierDetections["outbound|8080|disabled|*.example.org"]
+	g.Expect(ok).To(BeTrue())
+	g.Expect(disabledOutlier).To(BeNil())
+}
+
+func TestBuildLocalityLbEndpointsForServiceEntryWithMultipleAddresses(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	port := &model.Port{Name: "tcp", Port: 3306, Protocol: protocol.TCP}
+	// A ServiceEntry with a CIDR and a plain address becomes one service per address, sharing the endpoints.
+	services := []*model.Service{
+		{
+			Hostname:   "db.example.org",
+			Address:    "10.0.0.0/24",
+			Ports:      model.PortList{port},
+			Resolution: model.DNSLB,
+		},
+		{
+			Hostname:   "db.example.org",
+			Address:    "192.168.10.1",
+			Ports:      model.PortList{port},
+			Resolution: model.DNSLB,
+		},
+	}
+	instances := make([]*model.ServiceInstance, 0)
+	for _, service := range services {
+		for _, address := range []string{"db1.example.org", "db2.example.org"} {
+			instances = append(instances, &model.ServiceInstance{
+				Service:     service,
+				ServicePort: port,
+				Endpoint: &model.IstioEndpoint{
+					Address:      address,
+					EndpointPort: 3306,
+				},
+			})
+		}
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.InstancesByPortReturns(instances, nil)
+	push := model.NewPushContext()
+	push.ServiceDiscovery = serviceDiscovery
+
+	for _, service := range services {
+		localityLbEndpoints := buildLocalityLbEndpoints(push, map[string]bool{"": true}, service, port.Port, nil, nil)
+		addresses := make([]string, 0)
+		for _, llb := range localityLbEndpoints {
+			for _, lb := range llb.LbEndpoints {
+				addresses = append(addresses, lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+			}
+		}
+		g.Expect(addresses).To(ConsistOf("db1.example.org", "db2.example.org"))
+	}
+}
+
+func TestBuildLocalityLbEndpointsWithHostnames(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	port := &model.Port{Name: "https", Port: 443, Protocol: protocol.TLS}
+	service := &model.Service{
+		Hostname:   "api.example.org",
+		Ports:      model.PortList{port},
+		Resolution: model.DNSLB,
+	}
+	instances := make([]*model.ServiceInstance, 0)
+	for _, address := range []string{"api1.example.org", "10.0.0.1", "api2.example.org"} {
+		instances = append(instances, &model.ServiceInstance{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:      address,
+				EndpointPort: 443,
+			},
+		})
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.InstancesByPortReturns(instances, nil)
+	push := model.NewPushContext()
+	push.ServiceDiscovery = serviceDiscovery
+
+	hostnames := make(map[string]string)
+	for _, llb := range buildLocalityLbEndpoints(push, map[string]bool{"": true}, service, port.Port, nil, nil) {
+		for _, lb := range llb.LbEndpoints {
+			hostnames[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = lb.GetEndpoint().GetHostname()
+		}
+	}
+	g.Expect(hostnames).To(Equal(map[string]string{
+		"api1.example.org": "api1.example.org",
+		"10.0.0.1":         "",
+		"api2.example.org": "api2.example.org",
+	}))
+}
+
+func TestOutboundLbPolicyOverride(t *testing.T) {
+	destRule := &networking.DestinationRule{
+		Host: "*.example.org",
+	}
+	randomDestRule := &networking.DestinationRule{
+		Host: "*.example.org",
+		TrafficPolicy: &networking.TrafficPolicy{
+			LoadBalancer: &networking.LoadBalancerSettings{
+				LbPolicy: &networking.LoadBalancerSettings_Simple{
+					Simple: networking.LoadBalancerSettings_RANDOM,
+				},
+			},
+		},
+	}
+	consistentHashDestRule := &networking.DestinationRule{
+		Host: "*.example.org",
+		TrafficPolicy: &networking.TrafficPolicy{
+			LoadBalancer: &networking.LoadBalancerSettings{
+				LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+					ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+						HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: true},
+					},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		destRule *networking.DestinationRule
+		meta     *model.NodeMetadata
+		expected apiv2.Cluster_LbPolicy
+	}{
+		{
+			name:     "no override",
+			destRule: destRule,
+			meta:     &model.NodeMetadata{},
+			expected: apiv2.Cluster_ROUND_ROBIN,
+		},
+		{
+			name:     "override",
+			destRule: destRule,
+			meta:     &model.NodeMetadata{OutboundLbPolicy: "LEAST_CONN"},
+			expected: apiv2.Cluster_LEAST_REQUEST,
+		},
+		{
+			name:     "invalid override",
+			destRule: destRule,
+			meta:     &model.NodeMetadata{OutboundLbPolicy: "FASTEST"},
+			expected: apiv2.Cluster_ROUND_ROBIN,
+		},
+		{
+			name:     "destination rule policy",
+			destRule: randomDestRule,
+			meta:     &model.NodeMetadata{OutboundLbPolicy: "LEAST_CONN"},
+			expected: apiv2.Cluster_RANDOM,
+		},
+		{
+			name:     "destination rule consistent hash",
+			destRule: consistentHashDestRule,
+			meta:     &model.NodeMetadata{OutboundLbPolicy: "LEAST_CONN"},
+			expected: apiv2.Cluster_RING_HASH,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			clusters, err := buildTestClustersWithProxyMetadata("*.example.org", model.ClientSideLB, false, model.SidecarProxy,
+				nil, testMesh, tt.destRule, nil, nil, tt.meta, model.MaxIstioVersion)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			for _, c := range clusters {
+				switch {
+				case c.Name == util.PassthroughCluster:
+					g.Expect(c.LbPolicy).To(Equal(apiv2.Cluster_CLUSTER_PROVIDED))
+				case strings.HasPrefix(c.Name, "outbound"):
+					g.Expect(c.LbPolicy).To(Equal(tt.expected), c.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsFromTopologyLabels(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	port := &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:   "api.example.org",
+		Ports:      model.PortList{port},
+		Resolution: model.DNSLB,
+	}
+	endpoints := []*model.IstioEndpoint{
+		{
+			Address: "10.0.0.1",
+			Labels: labels.Instance{
+				"topology.kubernetes.io/region": "region1",
+				"topology.kubernetes.io/zone":   "zone1",
+				"topology.istio.io/subzone":     "subzone1",
+			},
+		},
+		{
+			Address: "10.0.0.2",
+			Labels: labels.Instance{
+				"failure-domain.beta.kubernetes.io/region": "region2",
+				"failure-domain.beta.kubernetes.io/zone":   "zone2",
+			},
+		},
+		{
+			Address:  "10.0.0.3",
+			Labels:   labels.Instance{"topology.kubernetes.io/region": "region1"},
+			Locality: model.Locality{Label: "region3/zone3"},
+		},
+		{
+			Address: "10.0.0.4",
+			Labels:  labels.Instance{"app": "api"},
+		},
+	}
+	instances := make([]*model.ServiceInstance, 0, len(endpoints))
+	for _, ep := range endpoints {
+		ep.EndpointPort = 8080
+		instances = append(instances, &model.ServiceInstance{
+			Service:     service,
+			ServicePort: port,
+			Endpoint:    ep,
+		})
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.InstancesByPortReturns(instances, nil)
+	push := model.NewPushContext()
+	push.ServiceDiscovery = serviceDiscovery
+
+	localities := make(map[string]string)
+	for _, llb := range buildLocalityLbEndpoints(push, map[string]bool{"": true}, service, port.Port, nil, nil) {
+		for _, lb := range llb.LbEndpoints {
+			localities[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = util.LocalityToString(llb.Locality)
+		}
+	}
+	g.Expect(localities).To(Equal(map[string]string{
+		"10.0.0.1": "region1/zone1/subzone1",
+		"10.0.0.2": "region2/zone2",
+		"10.0.0.3": "region3/zone3",
+		"10.0.0.4": "",
+	}))
+}
+
+func TestBuildLocalityLbEndpointsWithDrainingEndpoints(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	port := &model.Port{Name: "http", Port: 8080, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:   "api.example.org",
+		Ports:      model.PortList{port},
+		Resolution: model.DNSLB,
+	}
+	endpoints := []*model.IstioEndpoint{
+		{Address: "10.0.0.1", LbWeight: 10, Locality: model.Locality{Label: "region1/zone1"}},
+		{Address: "10.0.0.2", LbWeight: 10, Locality: model.Locality{Label: "region1/zone1"}, Draining: true},
+		// All endpoints of this locality are draining.
+		{Address: "10.0.0.3", LbWeight: 5, Locality: model.Locality{Label: "region2/zone2"}, Draining: true},
+		{Address: "10.0.0.4", LbWeight: 5, Locality: model.Locality{Label: "region2/zone2"}, Draining: true},
+	}
+	instances := make([]*model.ServiceInstance, 0, len(endpoints))
+	for _, ep := range endpoints {
+		ep.EndpointPort = 8080
+		instances = append(instances, &model.ServiceInstance{
+			Service:     service,
+			ServicePort: port,
+			Endpoint:    ep,
+		})
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.InstancesByPortReturns(instances, nil)
+	push := model.NewPushContext()
+	push.ServiceDiscovery = serviceDiscovery
+
+	localityWeights := make(map[string]uint32)
+	for _, llb := range buildLocalityLbEndpoints(push, map[string]bool{"": true}, service, port.Port, nil, nil) {
+		localityWeights[util.LocalityToString(llb.Locality)] = llb.LoadBalancingWeight.GetValue()
+		for _, lb := range llb.LbEndpoints {
+			if lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress() == "10.0.0.1" {
+				g.Expect(lb.HealthStatus).To(Equal(core.HealthStatus_UNKNOWN))
+				g.Expect(lb.LoadBalancingWeight.GetValue()).To(Equal(uint32(10)))
+				continue
+			}
+			g.Expect(lb.HealthStatus).To(Equal(core.HealthStatus_DRAINING))
+			g.Expect(lb.LoadBalancingWeight.GetValue()).To(Equal(uint32(1)))
+		}
+	}
+	g.Expect(localityWeights).To(Equal(map[string]uint32{
+		"region1/zone1": 11,
+		"region2/zone2": 2,
+	}))
+}
+
+func TestStatNamePattern(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	statConfigMesh := meshconfig.MeshConfig{
+		ConnectTimeout: &types.Duration{
+			Seconds: 10,
+			Nanos:   1,
+		},
+		EnableAutoMtls: &types.BoolValue{
+			Value: false,
+		},
+		InboundClusterStatName:  "LocalService_%SERVICE%",
+		OutboundClusterStatName: "%SERVICE%_%SERVICE_PORT_NAME%_%SERVICE_PORT%",
+		OutboundTrafficPolicy:   &meshconfig.MeshConfig_OutboundTrafficPolicy{Mode: meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY},
+	}
+
+	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
+		&core.Locality{}, statConfigMesh,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters[0].AltStatName).To(Equal("*.example.org_default_8080"))
+	g.Expect(clusters[4].AltStatName).To(Equal("LocalService_*.example.org"))
+}
+
+func TestStatNamePatternForExternalService(t *testing.T) {
+	_ = os.Setenv(features.ExternalClusterStatName.Name, "egress_%SERVICE%_%SERVICE_PORT%")
+	defer func() { _ = os.Unsetenv(features.ExternalClusterStatName.Name) }()
+
+	statConfigMesh := testMesh
+	statConfigMesh.OutboundClusterStatName = "%SERVICE%_%SERVICE_PORT%"
+
+	cases := []struct {
+		name         string
+		external     bool
+		expectedName string
+	}{
+		{
+			name:         "mesh internal service",
+			external:     false,
+			expectedName: "foo.example.org_8080",
+		},
+		{
+			name:         "mesh external service",
+			external:     true,
+			expectedName: "egress_foo.example.org_8080",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			clusters, err := buildTestClustersWithAuthnPolicy("foo.example.org", model.ClientSideLB, tt.external, model.SidecarProxy, nil,
+				statConfigMesh, &networking.DestinationRule{Host: "foo.example.org"}, nil, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(clusters[0].Name).To(Equal("outbound|8080||foo.example.org"))
+			g.Expect(clusters[0].AltStatName).To(Equal(tt.expectedName))
+		})
+	}
+}
+
+func TestCatchAllClustersForOutboundTrafficPolicy(t *testing.T) {
+	cases := []struct {
+		mode                meshconfig.MeshConfig_OutboundTrafficPolicy_Mode
+		expectedPassthrough bool
+	}{
+		{
+			mode:                meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY,
+			expectedPassthrough: true,
+		},
+		{
+			mode:                meshconfig.MeshConfig_OutboundTrafficPolicy_REGISTRY_ONLY,
+			expectedPassthrough: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			meshConfig := testMesh
+			meshConfig.OutboundTrafficPolicy = &meshconfig.MeshConfig_OutboundTrafficPolicy{Mode: tc.mode}
+			clusters, err := buildTestClusters("*.example.org", model.ClientSideLB, model.SidecarProxy, nil, meshConfig,
+				&networking.DestinationRule{
+					Host: "*.example.org",
+				})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			var hasBlackHole, hasPassthrough bool
+			for _, c := range clusters {
+				hasBlackHole = hasBlackHole || c.Name == util.BlackHoleCluster
+				hasPassthrough = hasPassthrough || c.Name == util.PassthroughCluster
+			}
+			// The blackhole cluster is always needed for routes to unresolved clusters.
+			g.Expect(hasBlackHole).To(BeTrue())
+			g.Expect(hasPassthrough).To(Equal(tc.expectedPassthrough))
+		})
+	}
+}
+
+func TestDuplicateClusters(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
+		&core.Locality{}, testMesh,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+		})
+	g.Expect(len(clusters)).To(Equal(8))
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+func TestIgnoreNewHostsUntilFirstHealthCheck(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	withHealthCheck := &apiv2.Cluster{
+		Name: "with-health-check",
+		HealthChecks: []*core.HealthCheck{
+			{
+				HealthChecker: &core.HealthCheck_TcpHealthCheck_{TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{}},
+			},
+		},
+	}
+	withoutHealthCheck := &apiv2.Cluster{Name: "without-health-check"}
+
+	clusters := normalizeClusters(model.NewPushContext(), &model.Proxy{}, []*apiv2.Cluster{withHealthCheck, withoutHealthCheck})
+	g.Expect(clusters).To(HaveLen(2))
+	g.Expect(clusters[0].CommonLbConfig.GetIgnoreNewHostsUntilFirstHc()).To(BeTrue())
+	g.Expect(clusters[1].CommonLbConfig).To(BeNil())
+}
+
+func TestClusterHash(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	lbEndpoint := func(address string) *endpoint.LbEndpoint {
+		return &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{Address: util.BuildAddress(address, 8080)},
+			},
+		}
+	}
+	newCluster := func(localities ...*endpoint.LocalityLbEndpoints) *apiv2.Cluster {
+		return &apiv2.Cluster{
+			Name:                 "outbound|8080||foo.example.org",
+			ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STATIC},
+			ConnectTimeout:       ptypes.DurationProto(time.Second),
+			LoadAssignment: &apiv2.ClusterLoadAssignment{
+				ClusterName: "outbound|8080||foo.example.org",
+				Endpoints:   localities,
+			},
+		}
+	}
+	region1 := util.ConvertLocality("region1/zone1")
+	region2 := util.ConvertLocality("region2/zone1")
+
+	original := newCluster(
+		&endpoint.LocalityLbEndpoints{Locality: region1, LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint("10.0.0.1"), lbEndpoint("10.0.0.2")}},
+		&endpoint.LocalityLbEndpoints{Locality: region2, LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint("10.0.0.3")}},
+	)
+	reordered := newCluster(
+		&endpoint.LocalityLbEndpoints{Locality: region2, LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint("10.0.0.3")}},
+		&endpoint.LocalityLbEndpoints{Locality: region1, LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint("10.0.0.2"), lbEndpoint("10.0.0.1")}},
+	)
+	changed := newCluster(
+		&endpoint.LocalityLbEndpoints{Locality: region1, LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint("10.0.0.1"), lbEndpoint("10.0.0.4")}},
+		&endpoint.LocalityLbEndpoints{Locality: region2, LbEndpoints: []*endpoint.LbEndpoint{lbEndpoint("10.0.0.3")}},
+	)
+
+	originalHash, err := ClusterHash(original)
+	g.Expect(err).NotTo(HaveOccurred())
+	reorderedHash, err := ClusterHash(reordered)
+	g.Expect(err).NotTo(HaveOccurred())
+	changedHash, err := ClusterHash(changed)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(reorderedHash).To(Equal(originalHash))
+	g.Expect(changedHash).NotTo(Equal(originalHash))
+	// Hashing leaves the order of the cluster itself alone.
+	g.Expect(util.LocalityToString(reordered.LoadAssignment.Endpoints[0].Locality)).To(Equal("region2/zone1"))
+}
+
+func TestAddSourceLabelsToMetadata(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	newClusters := func() []*apiv2.Cluster {
+		return []*apiv2.Cluster{
+			{Name: "outbound|8080||foo.example.org"},
+			{
+				Name:     "outbound|8080|v1|foo.example.org",
+				Metadata: util.AddSubsetToMetadata(util.BuildConfigInfoMetadata(model.ConfigMeta{Name: "acme", Namespace: "default"}), "v1"),
+			},
+		}
+	}
+	withLabels := &model.Proxy{Metadata: &model.NodeMetadata{Labels: map[string]string{"app": "productpage", "version": "v1"}}}
+	withoutLabels := &model.Proxy{Metadata: &model.NodeMetadata{}}
+
+	// Disabled by default.
+	clusters := newClusters()
+	addSourceLabelsToMetadata(withLabels, clusters)
+	g.Expect(clusters[0].Metadata).To(BeNil())
+
+	_ = os.Setenv(features.EnableSourceLabelsClusterMetadata.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableSourceLabelsClusterMetadata.Name) }()
+
+	clusters = newClusters()
+	addSourceLabelsToMetadata(withLabels, clusters)
+	for _, c := range clusters {
+		sourceLabels := c.Metadata.FilterMetadata[util.IstioMetadataKey].Fields["sourceLabels"].GetStructValue()
+		g.Expect(sourceLabels).NotTo(BeNil(), c.Name)
+		g.Expect(sourceLabels.Fields["app"].GetStringValue()).To(Equal("productpage"))
+		g.Expect(sourceLabels.Fields["version"].GetStringValue()).To(Equal("v1"))
+	}
+	// The metadata the cluster already has is kept.
+	g.Expect(clusters[1].Metadata.FilterMetadata[util.IstioMetadataKey].Fields["subset"].GetStringValue()).To(Equal("v1"))
+
+	clusters = newClusters()
+	addSourceLabelsToMetadata(withoutLabels, clusters)
+	g.Expect(clusters[0].Metadata).To(BeNil())
+	g.Expect(clusters[1].Metadata.FilterMetadata[util.IstioMetadataKey].Fields).NotTo(HaveKey("sourceLabels"))
+}
+
+func TestSidecarLocalityLB(t *testing.T) {
+	g := NewGomegaWithT(t)
+	// Distribute locality loadbalancing setting
+	testMesh.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*":        50,
+					"region2/zone1/subzone1": 50,
+				},
+			},
+		},
+	}
+
+	clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
+		&core.Locality{
+			Region:  "region1",
+			Zone:    "zone1",
+			SubZone: "subzone1",
+		}, testMesh,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				OutlierDetection: &networking.OutlierDetection{
+					ConsecutiveErrors: 5,
+					MinHealthPercent:  10,
+				},
+			},
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	if clusters[0].CommonLbConfig == nil {
+		t.Fatalf("CommonLbConfig should be set for cluster %+v", clusters[0])
+	}
+	g.Expect(clusters[0].CommonLbConfig.HealthyPanicThreshold.GetValue()).To(Equal(float64(10)))
+
+	g.Expect(len(clusters[0].LoadAssignment.Endpoints)).To(Equal(3))
+	for _, localityLbEndpoint := range clusters[0].LoadAssignment.Endpoints {
+		locality := localityLbEndpoint.Locality
+		if locality.Region == "region1" && locality.SubZone == "subzone1" {
+			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(34)))
+			g.Expect(localityLbEndpoint.LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(40)))
+		} else if locality.Region == "region1" && locality.SubZone == "subzone2" {
+			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(17)))
+			g.Expect(localityLbEndpoint.LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(20)))
+		} else if locality.Region == "region2" {
+			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(50)))
+			g.Expect(len(localityLbEndpoint.LbEndpoints)).To(Equal(1))
+			g.Expect(localityLbEndpoint.LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(40)))
+		}
+	}
+
+	// Test failover
+	// Distribute locality loadbalancing setting
+	testMesh.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{}
+
+	clusters, err = buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy,
+		&core.Locality{
+			Region:  "region1",
+			Zone:    "zone1",
+			SubZone: "subzone1",
+		}, testMesh,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				OutlierDetection: &networking.OutlierDetection{
+					ConsecutiveErrors: 5,
+					MinHealthPercent:  10,
+				},
+			},
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+	if clusters[0].CommonLbConfig == nil {
+		t.Fatalf("CommonLbConfig should be set for cluster %+v", clusters[0])
+	}
+	g.Expect(clusters[0].CommonLbConfig.HealthyPanicThreshold.GetValue()).To(Equal(float64(10)))
+
+	g.Expect(len(clusters[0].LoadAssignment.Endpoints)).To(Equal(3))
+	for _, localityLbEndpoint := range clusters[0].LoadAssignment.Endpoints {
+		locality := localityLbEndpoint.Locality
+		if locality.Region == "region1" && locality.Zone == "zone1" && locality.SubZone == "subzone1" {
+			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(0)))
+		} else if locality.Region == "region1" && locality.Zone == "zone1" && locality.SubZone == "subzone2" {
+			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(1)))
+		} else if locality.Region == "region2" {
+			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(2)))
+		}
+	}
+}
+
+func TestLocalityLBFailoverForServiceEntry(t *testing.T) {
+	g := NewGomegaWithT(t)
+	m := testMesh
+	m.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{}
+
+	// The endpoints of a ServiceEntry keep the locality declared for them, so external services are prioritized
+	// the same way as services in the mesh.
+	clusters, err := buildTestClustersWithAuthnPolicy("*.example.org", model.DNSLB, true, model.SidecarProxy,
+		&core.Locality{
+			Region:  "region1",
+			Zone:    "zone1",
+			SubZone: "subzone1",
+		}, m,
+		&networking.DestinationRule{
+			Host: "*.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				OutlierDetection: &networking.OutlierDetection{
+					ConsecutiveErrors: 5,
+				},
+			},
+		}, nil, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(len(clusters[0].LoadAssignment.Endpoints)).To(Equal(3))
+	for _, localityLbEndpoint := range clusters[0].LoadAssignment.Endpoints {
+		locality := localityLbEndpoint.Locality
+		switch {
+		case locality.Region == "region1" && locality.SubZone == "subzone1":
+			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(0)))
+		case locality.Region == "region1" && locality.SubZone == "subzone2":
+			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(1)))
+		case locality.Region == "region2":
+			g.Expect(localityLbEndpoint.Priority).To(Equal(uint32(2)))
+		}
+	}
+}
+
+func TestLocalityLBDestinationRuleOverride(t *testing.T) {
+	g := NewGomegaWithT(t)
+	// Distribute locality loadbalancing setting
+	testMesh.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*":        50,
+					"region2/zone1/subzone1": 50,
 				},
 			},
 		},
@@ -1508,7 +2643,7 @@ func TestBuildLocalityLbEndpoints(t *testing.T) {
 	configStore := &fakes.IstioConfigStore{}
 	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
 
-	localityLbEndpoints := buildLocalityLbEndpoints(env.PushContext, model.GetNetworkView(nil), service, 8080, nil)
+	localityLbEndpoints := buildLocalityLbEndpoints(env.PushContext, model.GetNetworkView(nil), service, 8080, nil, nil)
 	g.Expect(len(localityLbEndpoints)).To(Equal(2))
 	for _, ep := range localityLbEndpoints {
 		if ep.Locality.Region == "region1" {
@@ -1519,6 +2654,112 @@ func TestBuildLocalityLbEndpoints(t *testing.T) {
 	}
 }
 
+func TestBuildLocalityLbEndpointsWithAddedEndpoint(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	port := &model.Port{Name: "tcp", Port: 3306, Protocol: protocol.TCP}
+	service := &model.Service{
+		Hostname:   "db.example.org",
+		Address:    "192.168.10.1",
+		Ports:      model.PortList{port},
+		Resolution: model.ClientSideLB,
+	}
+	newInstance := func(address, locality string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:      address,
+				EndpointPort: 3306,
+				Locality:     model.Locality{Label: locality},
+			},
+		}
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	push := model.NewPushContext()
+	push.ServiceDiscovery = serviceDiscovery
+
+	endpointsByLocality := func() map[string][]string {
+		out := make(map[string][]string)
+		localities := make([]string, 0)
+		for _, llb := range buildLocalityLbEndpoints(push, map[string]bool{"": true}, service, port.Port, nil, nil) {
+			locality := util.LocalityToString(llb.Locality)
+			localities = append(localities, locality)
+			for _, lb := range llb.LbEndpoints {
+				out[locality] = append(out[locality], lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+			}
+		}
+		// The localities are built in a stable order.
+		g.Expect(sort.StringsAreSorted(localities)).To(BeTrue())
+		return out
+	}
+
+	serviceDiscovery.InstancesByPortReturns([]*model.ServiceInstance{
+		newInstance("10.0.0.1", "region2/zone1/subzone1"),
+		newInstance("10.0.0.2", "region1/zone1/subzone1"),
+	}, nil)
+	g.Expect(endpointsByLocality()).To(Equal(map[string][]string{
+		"region1/zone1/subzone1": {"10.0.0.2"},
+		"region2/zone1/subzone1": {"10.0.0.1"},
+	}))
+
+	// The load assignment is rebuilt with the added endpoint.
+	serviceDiscovery.InstancesByPortReturns([]*model.ServiceInstance{
+		newInstance("10.0.0.1", "region2/zone1/subzone1"),
+		newInstance("10.0.0.2", "region1/zone1/subzone1"),
+		newInstance("10.0.0.3", "region1/zone1/subzone1"),
+	}, nil)
+	g.Expect(endpointsByLocality()).To(Equal(map[string][]string{
+		"region1/zone1/subzone1": {"10.0.0.2", "10.0.0.3"},
+		"region2/zone1/subzone1": {"10.0.0.1"},
+	}))
+}
+
+func TestBuildLocalityLbEndpointsWithWeightedServiceEntryEndpoints(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	port := &model.Port{Name: "http", Port: 80, Protocol: protocol.HTTP}
+	service := &model.Service{
+		Hostname:     "weighted.example.org",
+		Ports:        model.PortList{port},
+		Resolution:   model.DNSLB,
+		MeshExternal: true,
+	}
+	newInstance := func(address string, weight uint32) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:      address,
+				EndpointPort: 80,
+				LbWeight:     weight,
+			},
+		}
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.InstancesByPortReturns([]*model.ServiceInstance{
+		newInstance("10.0.0.1", 70),
+		newInstance("10.0.0.2", 30),
+	}, nil)
+	push := model.NewPushContext()
+	push.ServiceDiscovery = serviceDiscovery
+
+	localityLbEndpoints := buildLocalityLbEndpoints(push, map[string]bool{"": true}, service, port.Port, nil, nil)
+	g.Expect(localityLbEndpoints).To(HaveLen(1))
+	weights := make(map[string]uint32)
+	for _, ep := range localityLbEndpoints[0].LbEndpoints {
+		weights[ep.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = ep.GetLoadBalancingWeight().GetValue()
+	}
+	g.Expect(weights).To(Equal(map[string]uint32{"10.0.0.1": 70, "10.0.0.2": 30}))
+	g.Expect(localityLbEndpoints[0].GetLoadBalancingWeight().GetValue()).To(Equal(uint32(100)))
+
+	// Envoy only honors endpoint weights with the round robin and least request load balancers, so the default
+	// must stay one of them.
+	cluster := &apiv2.Cluster{Name: "outbound|80||weighted.example.org", ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_STRICT_DNS}}
+	applyLoadBalancer(cluster, nil, port, &model.Proxy{Metadata: &model.NodeMetadata{}}, &testMesh)
+	g.Expect(cluster.LbPolicy).To(Equal(apiv2.Cluster_ROUND_ROBIN))
+}
+
 func TestFindServiceInstanceForIngressListener(t *testing.T) {
 	servicePort := &model.Port{
 		Name:     "default",
@@ -1612,35 +2853,250 @@ func TestClusterDiscoveryTypeAndLbPolicyPassthrough(t *testing.T) {
 			},
 		})
 
-	g.Expect(err).NotTo(HaveOccurred())
-	g.Expect(clusters[0].LbPolicy).To(Equal(apiv2.Cluster_CLUSTER_PROVIDED))
-	g.Expect(clusters[0].GetClusterDiscoveryType()).To(Equal(&apiv2.Cluster_Type{Type: apiv2.Cluster_ORIGINAL_DST}))
-	g.Expect(clusters[0].EdsClusterConfig).To(BeNil())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(clusters[0].LbPolicy).To(Equal(apiv2.Cluster_CLUSTER_PROVIDED))
+	g.Expect(clusters[0].GetClusterDiscoveryType()).To(Equal(&apiv2.Cluster_Type{Type: apiv2.Cluster_ORIGINAL_DST}))
+	g.Expect(clusters[0].EdsClusterConfig).To(BeNil())
+}
+
+func TestBuildClustersDefaultCircuitBreakerThresholds(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	configgen := NewConfigGenerator([]plugin.Plugin{})
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	configStore := &fakes.IstioConfigStore{}
+	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+	proxy := &model.Proxy{Metadata: &model.NodeMetadata{}}
+
+	clusters := configgen.BuildClusters(proxy, env.PushContext)
+	g.Expect(len(clusters)).ShouldNot(Equal(0))
+
+	for _, cluster := range clusters {
+		if cluster.Name != "BlackHoleCluster" {
+			g.Expect(cluster.CircuitBreakers).NotTo(BeNil())
+			g.Expect(cluster.CircuitBreakers.Thresholds[0]).To(Equal(getDefaultCircuitBreakerThresholds()))
+		}
+	}
+}
+
+func TestBuildClustersDefaultCircuitBreakerMaxRetries(t *testing.T) {
+	_ = os.Setenv(features.DefaultCircuitBreakerMaxRetries.Name, "10")
+	defer func() {
+		_ = os.Unsetenv(features.DefaultCircuitBreakerMaxRetries.Name)
+	}()
+
+	cases := []struct {
+		name     string
+		settings *networking.ConnectionPoolSettings
+		expected uint32
+	}{
+		{
+			name:     "mesh wide default",
+			settings: nil,
+			expected: 10,
+		},
+		{
+			name: "destination rule override",
+			settings: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{
+					MaxRetries: 5,
+				},
+			},
+			expected: 5,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			clusters, err := buildTestClusters("*.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
+				&networking.DestinationRule{
+					Host: "*.example.org",
+					TrafficPolicy: &networking.TrafficPolicy{
+						ConnectionPool: tt.settings,
+					},
+				})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			for _, cluster := range clusters {
+				if strings.HasPrefix(cluster.Name, "outbound|8080|") {
+					g.Expect(cluster.CircuitBreakers.Thresholds[0].MaxRetries.Value).To(Equal(tt.expected))
+				}
+			}
+		})
+	}
+}
+
+func TestBuildClustersDefaultCircuitBreakerMaxPendingRequests(t *testing.T) {
+	_ = os.Setenv(features.DefaultCircuitBreakerMaxPendingRequests.Name, "64")
+	defer func() {
+		_ = os.Unsetenv(features.DefaultCircuitBreakerMaxPendingRequests.Name)
+	}()
+
+	cases := []struct {
+		name     string
+		settings *networking.ConnectionPoolSettings
+		expected uint32
+	}{
+		{
+			name:     "mesh wide default",
+			settings: nil,
+			expected: 64,
+		},
+		{
+			name: "destination rule override",
+			settings: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{
+					Http1MaxPendingRequests: 16,
+				},
+			},
+			expected: 16,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			clusters, err := buildTestClusters("*.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
+				&networking.DestinationRule{
+					Host: "*.example.org",
+					TrafficPolicy: &networking.TrafficPolicy{
+						ConnectionPool: tt.settings,
+					},
+				})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			for _, cluster := range clusters {
+				if strings.HasPrefix(cluster.Name, "outbound|8080|") {
+					g.Expect(cluster.CircuitBreakers.Thresholds[0].MaxPendingRequests.Value).To(Equal(tt.expected))
+				}
+			}
+		})
+	}
+}
+
+func TestBuildOutboundPassthroughClusterUseHTTPHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata *model.NodeMetadata
+		expected *apiv2.Cluster_OriginalDstLbConfig
+	}{
+		{
+			name:     "default",
+			metadata: &model.NodeMetadata{},
+			expected: nil,
+		},
+		{
+			name:     "use http header",
+			metadata: &model.NodeMetadata{PassthroughUseHTTPHeader: true},
+			expected: &apiv2.Cluster_OriginalDstLbConfig{UseHttpHeader: true},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			env := newTestEnvironment(&fakes.ServiceDiscovery{}, testMesh, &fakes.IstioConfigStore{})
+			proxy := &model.Proxy{Metadata: tt.metadata}
+
+			cluster := NewClusterBuilder(proxy, env.PushContext).buildOutboundPassthroughCluster()
+			g.Expect(cluster.GetType()).To(Equal(apiv2.Cluster_ORIGINAL_DST))
+			if tt.expected == nil {
+				g.Expect(cluster.LbConfig).To(BeNil())
+			} else {
+				g.Expect(cluster.GetOriginalDstLbConfig()).To(Equal(tt.expected))
+			}
+		})
+	}
+}
+
+func TestBuildClustersForIPv6OnlyProxy(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	env := newTestEnvironment(&fakes.ServiceDiscovery{}, testMesh, &fakes.IstioConfigStore{})
+	proxy := &model.Proxy{
+		Type:        model.SidecarProxy,
+		IPAddresses: []string{"2001:db8::1"},
+		Metadata:    &model.NodeMetadata{},
+	}
+	proxy.SetSidecarScope(env.PushContext)
+	proxy.DiscoverIPVersions()
+
+	clusters := NewConfigGenerator([]plugin.Plugin{}).BuildClusters(proxy, env.PushContext)
+	names := make(map[string]*apiv2.Cluster, len(clusters))
+	for _, cluster := range clusters {
+		names[cluster.Name] = cluster
+	}
+
+	g.Expect(names).NotTo(HaveKey(util.InboundPassthroughClusterIpv4))
+	g.Expect(names).To(HaveKey(util.InboundPassthroughClusterIpv6))
+	bindAddress := names[util.InboundPassthroughClusterIpv6].UpstreamBindConfig.SourceAddress.Address
+	g.Expect(bindAddress).To(Equal(util.InboundPassthroughBindIpv6))
+
+	// The outbound passthrough cluster connects to the original destination, so it works for either family.
+	g.Expect(names).To(HaveKey(util.PassthroughCluster))
+	g.Expect(names[util.PassthroughCluster].UpstreamBindConfig).To(BeNil())
 }
 
-func TestBuildClustersDefaultCircuitBreakerThresholds(t *testing.T) {
+func TestBuildInboundClustersDefaultCircuitBreakerThresholds(t *testing.T) {
 	g := NewGomegaWithT(t)
 
 	configgen := NewConfigGenerator([]plugin.Plugin{})
 	serviceDiscovery := &fakes.ServiceDiscovery{}
 	configStore := &fakes.IstioConfigStore{}
 	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
-	proxy := &model.Proxy{Metadata: &model.NodeMetadata{}}
 
-	clusters := configgen.BuildClusters(proxy, env.PushContext)
+	proxy := &model.Proxy{
+		Metadata:     &model.NodeMetadata{},
+		SidecarScope: &model.SidecarScope{},
+	}
+
+	servicePort := &model.Port{
+		Name:     "default",
+		Port:     80,
+		Protocol: protocol.HTTP,
+	}
+
+	service := &model.Service{
+		Hostname:    host.Name("backend.default.svc.cluster.local"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports:       model.PortList{servicePort},
+		Resolution:  model.Passthrough,
+	}
+
+	instances := []*model.ServiceInstance{
+		{
+			Service:     service,
+			ServicePort: servicePort,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "192.168.1.1",
+				EndpointPort: 10001,
+			},
+		},
+	}
+
+	clusters := configgen.buildInboundClusters(proxy, env.PushContext, instances, []*model.Port{servicePort})
 	g.Expect(len(clusters)).ShouldNot(Equal(0))
 
 	for _, cluster := range clusters {
-		if cluster.Name != "BlackHoleCluster" {
-			g.Expect(cluster.CircuitBreakers).NotTo(BeNil())
-			g.Expect(cluster.CircuitBreakers.Thresholds[0]).To(Equal(getDefaultCircuitBreakerThresholds()))
-		}
+		g.Expect(cluster.CircuitBreakers).NotTo(BeNil())
+		g.Expect(cluster.CircuitBreakers.Thresholds[0]).To(Equal(getDefaultCircuitBreakerThresholds()))
 	}
 }
 
-func TestBuildInboundClustersDefaultCircuitBreakerThresholds(t *testing.T) {
+func TestBuildClustersInboundDefaultCircuitBreakers(t *testing.T) {
 	g := NewGomegaWithT(t)
 
+	_ = os.Setenv(features.InboundDefaultMaxConnections.Name, "100")
+	_ = os.Setenv(features.InboundDefaultMaxRequests.Name, "200")
+	defer func() {
+		_ = os.Unsetenv(features.InboundDefaultMaxConnections.Name)
+		_ = os.Unsetenv(features.InboundDefaultMaxRequests.Name)
+	}()
+
 	configgen := NewConfigGenerator([]plugin.Plugin{})
 	serviceDiscovery := &fakes.ServiceDiscovery{}
 	configStore := &fakes.IstioConfigStore{}
@@ -1676,15 +3132,182 @@ func TestBuildInboundClustersDefaultCircuitBreakerThresholds(t *testing.T) {
 		},
 	}
 
-	clusters := configgen.buildInboundClusters(proxy, env.PushContext, instances, []*model.Port{servicePort})
-	g.Expect(len(clusters)).ShouldNot(Equal(0))
-
-	for _, cluster := range clusters {
+	inbound := configgen.buildInboundClusters(proxy, env.PushContext, instances, []*model.Port{servicePort})
+	g.Expect(len(inbound)).ShouldNot(Equal(0))
+	for _, cluster := range inbound {
 		g.Expect(cluster.CircuitBreakers).NotTo(BeNil())
+		thresholds := cluster.CircuitBreakers.Thresholds[0]
+		g.Expect(thresholds.MaxConnections.GetValue()).To(Equal(uint32(100)))
+		g.Expect(thresholds.MaxRequests.GetValue()).To(Equal(uint32(200)))
+	}
+
+	outbound, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy, nil, testMesh, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	for _, cluster := range outbound {
+		if cluster.CircuitBreakers == nil {
+			continue
+		}
 		g.Expect(cluster.CircuitBreakers.Thresholds[0]).To(Equal(getDefaultCircuitBreakerThresholds()))
 	}
 }
 
+func TestBuildInboundClustersWithSidecarProtocolOverride(t *testing.T) {
+	servicePort := &model.Port{
+		Name:     "auto",
+		Port:     9080,
+		Protocol: protocol.Unsupported,
+	}
+	service := &model.Service{
+		Hostname:    host.Name("backend.default.svc.cluster.local"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports:       model.PortList{servicePort},
+		Resolution:  model.ClientSideLB,
+		Attributes:  model.ServiceAttributes{Namespace: "default"},
+	}
+
+	cases := []struct {
+		name                      string
+		ingressProtocol           string
+		expectHTTP2               bool
+		expectedProtocolSelection apiv2.Cluster_ClusterProtocolSelection
+	}{
+		{
+			name:                      "auto port without override",
+			expectHTTP2:               true,
+			expectedProtocolSelection: apiv2.Cluster_USE_DOWNSTREAM_PROTOCOL,
+		},
+		{
+			name:                      "http overriding auto port",
+			ingressProtocol:           "HTTP",
+			expectHTTP2:               false,
+			expectedProtocolSelection: apiv2.Cluster_USE_CONFIGURED_PROTOCOL,
+		},
+		{
+			name:                      "http2 overriding auto port",
+			ingressProtocol:           "HTTP2",
+			expectHTTP2:               true,
+			expectedProtocolSelection: apiv2.Cluster_USE_CONFIGURED_PROTOCOL,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			env := newTestEnvironment(&fakes.ServiceDiscovery{}, testMesh, &fakes.IstioConfigStore{})
+			proxy := &model.Proxy{
+				Type:            model.SidecarProxy,
+				IPAddresses:     []string{"192.168.1.1"},
+				ConfigNamespace: "default",
+				Metadata:        &model.NodeMetadata{},
+			}
+			if tt.ingressProtocol == "" {
+				proxy.SidecarScope = &model.SidecarScope{}
+			} else {
+				proxy.SidecarScope = model.ConvertToSidecarScope(env.PushContext, &model.Config{
+					ConfigMeta: model.ConfigMeta{Name: "sidecar", Namespace: "default"},
+					Spec: &networking.Sidecar{
+						Ingress: []*networking.IstioIngressListener{
+							{
+								Port: &networking.Port{
+									Number:   9080,
+									Name:     "auto",
+									Protocol: tt.ingressProtocol,
+								},
+								DefaultEndpoint: "127.0.0.1:9080",
+							},
+						},
+					},
+				}, "default")
+			}
+			instances := []*model.ServiceInstance{
+				{
+					Service:     service,
+					ServicePort: servicePort,
+					Endpoint: &model.IstioEndpoint{
+						Address:      "192.168.1.1",
+						EndpointPort: 9080,
+					},
+				},
+			}
+
+			clusters := NewConfigGenerator([]plugin.Plugin{}).buildInboundClusters(proxy, env.PushContext, instances, nil)
+			g.Expect(clusters).To(HaveLen(1))
+			g.Expect(clusters[0].Name).To(Equal("inbound|9080|auto|backend.default.svc.cluster.local"))
+			g.Expect(clusters[0].Http2ProtocolOptions != nil).To(Equal(tt.expectHTTP2))
+			g.Expect(clusters[0].ProtocolSelection).To(Equal(tt.expectedProtocolSelection))
+		})
+	}
+}
+
+func TestBuildInboundClustersWithInboundClusterAddress(t *testing.T) {
+	servicePort := &model.Port{
+		Name:     "default",
+		Port:     80,
+		Protocol: protocol.HTTP,
+	}
+	service := &model.Service{
+		Hostname:    host.Name("backend.default.svc.cluster.local"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports:       model.PortList{servicePort},
+		Resolution:  model.ClientSideLB,
+	}
+	instances := []*model.ServiceInstance{
+		{
+			Service:     service,
+			ServicePort: servicePort,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "192.168.1.1",
+				EndpointPort: 10001,
+			},
+		},
+	}
+
+	cases := []struct {
+		name            string
+		address         string
+		expectedAddress string
+	}{
+		{
+			name:            "default",
+			expectedAddress: "127.0.0.1",
+		},
+		{
+			name:            "pod IP",
+			address:         "192.168.1.1",
+			expectedAddress: "192.168.1.1",
+		},
+		{
+			name:            "invalid address",
+			address:         "pod-ip",
+			expectedAddress: "127.0.0.1",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			env := newTestEnvironment(&fakes.ServiceDiscovery{}, testMesh, &fakes.IstioConfigStore{})
+			proxy := &model.Proxy{
+				IPAddresses:  []string{"192.168.1.1"},
+				Metadata:     &model.NodeMetadata{InboundClusterAddress: tt.address},
+				SidecarScope: &model.SidecarScope{},
+			}
+
+			clusters := NewConfigGenerator([]plugin.Plugin{}).buildInboundClusters(proxy, env.PushContext, instances, nil)
+			g.Expect(clusters).To(HaveLen(1))
+			lbEndpoints := clusters[0].LoadAssignment.Endpoints[0].LbEndpoints
+			g.Expect(lbEndpoints).To(HaveLen(1))
+			address := lbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress()
+			g.Expect(address.GetAddress()).To(Equal(tt.expectedAddress))
+			g.Expect(address.GetPortValue()).To(Equal(uint32(10001)))
+		})
+	}
+}
+
 func TestRedisProtocolWithPassThroughResolutionAtGateway(t *testing.T) {
 	g := NewGomegaWithT(t)
 
@@ -1765,6 +3388,54 @@ func TestRedisProtocolClusterAtGateway(t *testing.T) {
 	}
 }
 
+func TestUpstreamProtocolClusterAtGateway(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	configgen := NewConfigGenerator([]plugin.Plugin{})
+	configStore := &fakes.IstioConfigStore{}
+	proxy := &model.Proxy{Type: model.Router, Metadata: &model.NodeMetadata{}}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+
+	service := &model.Service{
+		Hostname:    host.Name("backend.com"),
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports: model.PortList{
+			{Name: "http-web", Port: 8080, Protocol: protocol.HTTP},
+			{Name: "grpc-api", Port: 9090, Protocol: protocol.GRPC},
+			{Name: "unnamed", Port: 9999, Protocol: protocol.Unsupported},
+		},
+		Resolution: model.ClientSideLB,
+	}
+	serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+
+	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+	// The HTTP listener of a gateway may serve HTTP/1.1 downstreams, the upstream protocol is selected by the
+	// protocol declared for the backend port instead of the downstream connection.
+	clusters := configgen.BuildClusters(proxy, env.PushContext)
+	byName := make(map[string]*apiv2.Cluster, len(clusters))
+	for _, cluster := range clusters {
+		byName[cluster.Name] = cluster
+	}
+
+	http1Cluster := byName["outbound|8080||backend.com"]
+	g.Expect(http1Cluster).NotTo(BeNil())
+	g.Expect(http1Cluster.Http2ProtocolOptions).To(BeNil())
+	g.Expect(http1Cluster.ProtocolSelection).To(Equal(apiv2.Cluster_USE_CONFIGURED_PROTOCOL))
+
+	http2Cluster := byName["outbound|9090||backend.com"]
+	g.Expect(http2Cluster).NotTo(BeNil())
+	g.Expect(http2Cluster.Http2ProtocolOptions).NotTo(BeNil())
+	g.Expect(http2Cluster.ProtocolSelection).To(Equal(apiv2.Cluster_USE_CONFIGURED_PROTOCOL))
+
+	// Gateways do not sniff the protocol, so undeclared ports do not follow the downstream protocol either.
+	unnamedCluster := byName["outbound|9999||backend.com"]
+	g.Expect(unnamedCluster).NotTo(BeNil())
+	g.Expect(unnamedCluster.Http2ProtocolOptions).To(BeNil())
+	g.Expect(unnamedCluster.ProtocolSelection).To(Equal(apiv2.Cluster_USE_CONFIGURED_PROTOCOL))
+}
+
 func TestAutoMTLSClusterPlaintextMode(t *testing.T) {
 	g := NewGomegaWithT(t)
 
@@ -2062,36 +3733,157 @@ func TestAutoMTLSClusterIgnoreWorkloadLevelPeerAuthn(t *testing.T) {
 		},
 	}
 
-	// This workload-level beta policy doesn't affect CDS (yet).
-	peerAuthn := &authn_beta.PeerAuthentication{
-		Selector: &selectorpb.WorkloadSelector{
-			MatchLabels: map[string]string{
-				"version": "v1",
-			},
-		},
-		Mtls: &authn_beta.PeerAuthentication_MutualTLS{
-			Mode: authn_beta.PeerAuthentication_MutualTLS_STRICT,
-		},
-	}
-
-	testMesh.EnableAutoMtls.Value = true
-
-	clusters, err := buildTestClustersWithAuthnPolicy(TestServiceNHostname, 0, false, model.SidecarProxy, nil, testMesh, destRule, nil, peerAuthn)
-	g.Expect(err).NotTo(HaveOccurred())
-
-	// No policy visible, auto-mTLS should set to PERMISSIVE.
-	// For port 8080, (m)TLS settings is automatically added, thus its cluster should have TLS context.
-	// TlsContext is nil because we use socket match instead
-	g.Expect(getTLSContext(t, clusters[0])).To(BeNil())
-	g.Expect(clusters[0].TransportSocketMatches).To(HaveLen(2))
-
-	// For 9090, use the TLS settings are explicitly specified in DR (which disable TLS)
-	g.Expect(getTLSContext(t, clusters[1])).To(BeNil())
-
-	// Sanity check: make sure TLS is not accidentally added to other clusters.
-	for i := 2; i < len(clusters); i++ {
-		cluster := clusters[i]
-		g.Expect(getTLSContext(t, cluster)).To(BeNil())
+	// This workload-level beta policy doesn't affect CDS (yet).
+	peerAuthn := &authn_beta.PeerAuthentication{
+		Selector: &selectorpb.WorkloadSelector{
+			MatchLabels: map[string]string{
+				"version": "v1",
+			},
+		},
+		Mtls: &authn_beta.PeerAuthentication_MutualTLS{
+			Mode: authn_beta.PeerAuthentication_MutualTLS_STRICT,
+		},
+	}
+
+	testMesh.EnableAutoMtls.Value = true
+
+	clusters, err := buildTestClustersWithAuthnPolicy(TestServiceNHostname, 0, false, model.SidecarProxy, nil, testMesh, destRule, nil, peerAuthn)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// No policy visible, auto-mTLS should set to PERMISSIVE.
+	// For port 8080, (m)TLS settings is automatically added, thus its cluster should have TLS context.
+	// TlsContext is nil because we use socket match instead
+	g.Expect(getTLSContext(t, clusters[0])).To(BeNil())
+	g.Expect(clusters[0].TransportSocketMatches).To(HaveLen(2))
+
+	// For 9090, use the TLS settings are explicitly specified in DR (which disable TLS)
+	g.Expect(getTLSContext(t, clusters[1])).To(BeNil())
+
+	// Sanity check: make sure TLS is not accidentally added to other clusters.
+	for i := 2; i < len(clusters); i++ {
+		cluster := clusters[i]
+		g.Expect(getTLSContext(t, cluster)).To(BeNil())
+	}
+}
+
+func TestBuildClustersWithMeshDefaultH2Upgrade(t *testing.T) {
+	_ = os.Setenv(features.DefaultH2UpgradePolicy.Name, networking.ConnectionPoolSettings_HTTPSettings_UPGRADE.String())
+	defer func() { _ = os.Unsetenv(features.DefaultH2UpgradePolicy.Name) }()
+
+	cases := []struct {
+		name          string
+		destRule      *networking.DestinationRule
+		expectUpgrade bool
+	}{
+		{
+			name:          "no destination rule",
+			expectUpgrade: true,
+		},
+		{
+			name: "destination rule without h2 upgrade policy",
+			destRule: &networking.DestinationRule{
+				Host: "*.example.org",
+				TrafficPolicy: &networking.TrafficPolicy{
+					ConnectionPool: &networking.ConnectionPoolSettings{
+						Http: &networking.ConnectionPoolSettings_HTTPSettings{MaxRetries: 3},
+					},
+				},
+			},
+			expectUpgrade: true,
+		},
+		{
+			name: "destination rule opting out of the upgrade",
+			destRule: &networking.DestinationRule{
+				Host: "*.example.org",
+				TrafficPolicy: &networking.TrafficPolicy{
+					ConnectionPool: &networking.ConnectionPoolSettings{
+						Http: &networking.ConnectionPoolSettings_HTTPSettings{
+							H2UpgradePolicy: networking.ConnectionPoolSettings_HTTPSettings_DO_NOT_UPGRADE,
+						},
+					},
+				},
+			},
+			expectUpgrade: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			var destRule proto.Message
+			if tt.destRule != nil {
+				destRule = tt.destRule
+			}
+			clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy, nil, testMesh, destRule)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			for _, cluster := range clusters {
+				if cluster.Name == "outbound|8080||*.example.org" {
+					g.Expect(cluster.Http2ProtocolOptions != nil).To(Equal(tt.expectUpgrade))
+				}
+			}
+		})
+	}
+}
+
+func TestBuildClustersWithMeshDefaultLbPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_ = os.Setenv(features.DefaultLbPolicy.Name, networking.LoadBalancerSettings_LEAST_CONN.String())
+	defer func() { _ = os.Unsetenv(features.DefaultLbPolicy.Name) }()
+
+	cases := []struct {
+		name             string
+		destRule         *networking.DestinationRule
+		expectedLbPolicy apiv2.Cluster_LbPolicy
+	}{
+		{
+			name:             "no destination rule",
+			expectedLbPolicy: apiv2.Cluster_LEAST_REQUEST,
+		},
+		{
+			name: "destination rule without load balancer",
+			destRule: &networking.DestinationRule{
+				Host: "*.example.org",
+				TrafficPolicy: &networking.TrafficPolicy{
+					ConnectionPool: &networking.ConnectionPoolSettings{
+						Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+					},
+				},
+			},
+			expectedLbPolicy: apiv2.Cluster_LEAST_REQUEST,
+		},
+		{
+			name: "destination rule overriding the mesh default",
+			destRule: &networking.DestinationRule{
+				Host: "*.example.org",
+				TrafficPolicy: &networking.TrafficPolicy{
+					LoadBalancer: &networking.LoadBalancerSettings{
+						LbPolicy: &networking.LoadBalancerSettings_Simple{
+							Simple: networking.LoadBalancerSettings_RANDOM,
+						},
+					},
+				},
+			},
+			expectedLbPolicy: apiv2.Cluster_RANDOM,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var destRule proto.Message
+			if tt.destRule != nil {
+				destRule = tt.destRule
+			}
+			clusters, err := buildTestClusters("*.example.org", model.DNSLB, model.SidecarProxy, nil, testMesh, destRule)
+			g.Expect(err).NotTo(HaveOccurred())
+			for _, cluster := range clusters {
+				if strings.HasPrefix(cluster.Name, "outbound|") {
+					g.Expect(cluster.LbPolicy).To(Equal(tt.expectedLbPolicy), cluster.Name)
+				}
+			}
+		})
 	}
 }
 
@@ -2198,34 +3990,500 @@ func TestApplyUpstreamTLSSettings(t *testing.T) {
 
 	proxy := &model.Proxy{
 		Type:         model.SidecarProxy,
-		Metadata:     &model.NodeMetadata{},
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &buildClusterOpts{
+				cluster: &apiv2.Cluster{
+					ClusterDiscoveryType: &apiv2.Cluster_Type{Type: test.discoveryType},
+				},
+				proxy: proxy,
+				push:  push,
+			}
+			applyUpstreamTLSSettings(opts, test.tls, test.mtlsCtx, proxy)
+
+			if test.expectTransportSocket && opts.cluster.TransportSocket == nil ||
+				!test.expectTransportSocket && opts.cluster.TransportSocket != nil {
+				t.Errorf("Expected TransportSocket %v", test.expectTransportSocket)
+			}
+			if test.expectTransportSocketMatch && opts.cluster.TransportSocketMatches == nil ||
+				!test.expectTransportSocketMatch && opts.cluster.TransportSocketMatches != nil {
+				t.Errorf("Expected TransportSocketMatch %v", test.expectTransportSocketMatch)
+			}
+		})
+	}
+
+}
+
+func TestApplyUpstreamTLSSettingsWithPlaintextFallback(t *testing.T) {
+	tlsSettings := &networking.TLSSettings{
+		Mode: networking.TLSSettings_ISTIO_MUTUAL,
+	}
+
+	tests := []struct {
+		name            string
+		serviceMTLSMode model.MutualTLSMode
+		expectFallback  bool
+	}{
+		{
+			name:            "permissive service",
+			serviceMTLSMode: model.MTLSPermissive,
+			expectFallback:  true,
+		},
+		{
+			name:            "strict service",
+			serviceMTLSMode: model.MTLSStrict,
+			expectFallback:  false,
+		},
+	}
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			opts := &buildClusterOpts{
+				cluster: &apiv2.Cluster{
+					ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+				},
+				proxy:             proxy,
+				push:              push,
+				serviceMTLSMode:   test.serviceMTLSMode,
+				plaintextFallback: true,
+			}
+			applyUpstreamTLSSettings(opts, tlsSettings, userSupplied, proxy)
+
+			if !test.expectFallback {
+				g.Expect(opts.cluster.TransportSocket.GetName()).To(Equal(util.EnvoyTLSSocketName))
+				g.Expect(opts.cluster.TransportSocketMatches).To(BeNil())
+				return
+			}
+			g.Expect(opts.cluster.TransportSocket).To(BeNil())
+			matches := opts.cluster.TransportSocketMatches
+			g.Expect(matches).To(HaveLen(2))
+			g.Expect(matches[0].Name).To(Equal("tlsMode-istio"))
+			g.Expect(matches[0].Match.Fields[model.TLSModeLabelShortname].GetStringValue()).To(Equal(model.IstioMutualTLSModeLabel))
+			g.Expect(matches[0].TransportSocket.GetName()).To(Equal(util.EnvoyTLSSocketName))
+			g.Expect(matches[1].Name).To(Equal("tlsMode-disabled"))
+			g.Expect(matches[1].Match.Fields).To(BeEmpty())
+			g.Expect(matches[1].TransportSocket.GetName()).To(Equal(util.EnvoyRawBufferSocketName))
+		})
+	}
+}
+
+func TestApplyUpstreamTLSSettingsPeerExchangeALPN(t *testing.T) {
+	tlsSettings := &networking.TLSSettings{
+		Mode: networking.TLSSettings_ISTIO_MUTUAL,
+	}
+
+	tests := []struct {
+		name                    string
+		http2                   bool
+		disableMetadataExchange bool
+		expectedAlpn            []string
+	}{
+		{
+			name:         "tcp cluster",
+			expectedAlpn: []string{"istio-peer-exchange", "istio"},
+		},
+		{
+			name:         "http2 cluster",
+			http2:        true,
+			expectedAlpn: []string{"istio-peer-exchange", "istio", "h2"},
+		},
+		{
+			name:                    "tcp cluster with metadata exchange disabled",
+			disableMetadataExchange: true,
+			expectedAlpn:            []string{"istio"},
+		},
+		{
+			name:                    "http2 cluster with metadata exchange disabled",
+			http2:                   true,
+			disableMetadataExchange: true,
+			expectedAlpn:            []string{"istio", "h2"},
+		},
+	}
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			if test.disableMetadataExchange {
+				_ = os.Setenv(features.EnableTCPMetadataExchange.Name, "false")
+				defer func() { _ = os.Unsetenv(features.EnableTCPMetadataExchange.Name) }()
+			}
+
+			opts := &buildClusterOpts{
+				cluster: &apiv2.Cluster{
+					ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+				},
+				proxy: proxy,
+				push:  push,
+			}
+			if test.http2 {
+				opts.cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+			}
+			applyUpstreamTLSSettings(opts, tlsSettings, userSupplied, proxy)
+
+			g.Expect(getTLSContext(t, opts.cluster).CommonTlsContext.AlpnProtocols).To(Equal(test.expectedAlpn))
+		})
+	}
+}
+
+func TestApplyUpstreamTLSSettingsEnforceStrictMTLS(t *testing.T) {
+	tlsSettings := &networking.TLSSettings{
+		Mode: networking.TLSSettings_DISABLE,
+	}
+
+	tests := []struct {
+		name            string
+		serviceMTLSMode model.MutualTLSMode
+		enforce         bool
+		expectMTLS      bool
+	}{
+		{
+			name:            "strict service",
+			serviceMTLSMode: model.MTLSStrict,
+			enforce:         true,
+			expectMTLS:      true,
+		},
+		{
+			name:            "permissive service",
+			serviceMTLSMode: model.MTLSPermissive,
+			enforce:         true,
+			expectMTLS:      false,
+		},
+		{
+			name:            "strict service without enforcement",
+			serviceMTLSMode: model.MTLSStrict,
+			enforce:         false,
+			expectMTLS:      false,
+		},
+	}
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			if test.enforce {
+				_ = os.Setenv(features.EnforceStrictMTLSForClusters.Name, "true")
+				defer func() { _ = os.Unsetenv(features.EnforceStrictMTLSForClusters.Name) }()
+			}
+
+			opts := &buildClusterOpts{
+				cluster: &apiv2.Cluster{
+					Name:                 "outbound|8080||foo.example.org",
+					ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+				},
+				proxy:           proxy,
+				push:            push,
+				serviceAccounts: []string{"spiffe://cluster.local/ns/default/sa/foo"},
+				istioMtlsSni:    "outbound_.8080_._.foo.example.org",
+				serviceMTLSMode: test.serviceMTLSMode,
+			}
+			applyUpstreamTLSSettings(opts, tlsSettings, userSupplied, proxy)
+
+			if !test.expectMTLS {
+				g.Expect(opts.cluster.TransportSocket).To(BeNil())
+				return
+			}
+			tlsContext := getTLSContext(t, opts.cluster)
+			g.Expect(tlsContext).NotTo(BeNil())
+			g.Expect(tlsContext.Sni).To(Equal("outbound_.8080_._.foo.example.org"))
+			g.Expect(tlsContext.CommonTlsContext.AlpnProtocols).To(Equal(util.ALPNInMeshWithMxc))
+			g.Expect(tlsContext.CommonTlsContext.TlsCertificates).To(HaveLen(1))
+		})
+	}
+}
+
+func TestApplyUpstreamTLSSettingsTrustDomainAliases(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	defer spiffe.SetTrustDomain(spiffe.GetTrustDomain())
+	spiffe.SetTrustDomain("cluster.local")
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
+	}
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{TrustDomainAliases: []string{"old.example.org"}}
+
+	opts := &buildClusterOpts{
+		cluster: &apiv2.Cluster{
+			Name:                 "outbound|8080||foo.example.org",
+			ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+		},
+		proxy: proxy,
+		push:  push,
+	}
+	tlsSettings := buildIstioMutualTLS([]string{"spiffe://cluster.local/ns/default/sa/foo", "spiffe://other.org/ns/default/sa/bar"},
+		"outbound_.8080_._.foo.example.org", proxy)
+	applyUpstreamTLSSettings(opts, tlsSettings, autoDetected, proxy)
+
+	tlsContext := getTLSContext(t, opts.cluster)
+	g.Expect(tlsContext).NotTo(BeNil())
+	g.Expect(tlsContext.CommonTlsContext.GetValidationContext().GetVerifySubjectAltName()).To(Equal([]string{
+		"spiffe://cluster.local/ns/default/sa/foo",
+		"spiffe://other.org/ns/default/sa/bar",
+		"spiffe://old.example.org/ns/default/sa/foo",
+	}))
+	// The settings shared with other clusters are left unchanged.
+	g.Expect(tlsSettings.SubjectAltNames).To(HaveLen(2))
+}
+
+func TestBuildClustersWithPortLevelTLSDisabled(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// The metrics port 9090 is plaintext, while the other ports of the service use Istio mTLS.
+	clusters, err := buildTestClusters("foo.example.org", model.ClientSideLB, model.SidecarProxy, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "foo.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				Tls: &networking.TLSSettings{Mode: networking.TLSSettings_ISTIO_MUTUAL},
+				PortLevelSettings: []*networking.TrafficPolicy_PortTrafficPolicy{
+					{
+						Port: &networking.PortSelector{Number: 9090},
+						Tls:  &networking.TLSSettings{Mode: networking.TLSSettings_DISABLE},
+					},
+				},
+			},
+		})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	byName := make(map[string]*apiv2.Cluster, len(clusters))
+	for _, cluster := range clusters {
+		byName[cluster.Name] = cluster
+	}
+	mtlsCluster := byName["outbound|8080||foo.example.org"]
+	g.Expect(mtlsCluster).NotTo(BeNil())
+	g.Expect(mtlsCluster.TransportSocket).NotTo(BeNil())
+	g.Expect(getTLSContext(t, mtlsCluster).Sni).To(Equal("outbound_.8080_._.foo.example.org"))
+
+	plaintextCluster := byName["outbound|9090||foo.example.org"]
+	g.Expect(plaintextCluster).NotTo(BeNil())
+	g.Expect(plaintextCluster.TransportSocket).To(BeNil())
+	g.Expect(plaintextCluster.TransportSocketMatches).To(BeNil())
+}
+
+func TestBuildEgressClustersWithUpstreamTLSParams(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_ = os.Setenv(features.UpstreamTLSMinProtocolVersion.Name, "TLSV1_2")
+	_ = os.Setenv(features.UpstreamTLSMaxProtocolVersion.Name, "TLSV1_3")
+	_ = os.Setenv(features.UpstreamTLSCipherSuites.Name, "ECDHE-ECDSA-AES256-GCM-SHA384, not-a-cipher,[AES128-SHA|AES256-SHA]")
+	_ = os.Setenv(features.UpstreamTLSEcdhCurves.Name, "X25519,P-256")
+	defer func() {
+		_ = os.Unsetenv(features.UpstreamTLSMinProtocolVersion.Name)
+		_ = os.Unsetenv(features.UpstreamTLSMaxProtocolVersion.Name)
+		_ = os.Unsetenv(features.UpstreamTLSCipherSuites.Name)
+		_ = os.Unsetenv(features.UpstreamTLSEcdhCurves.Name)
+	}()
+
+	clusters, err := buildTestClustersWithAuthnPolicy("foo.example.org", model.ClientSideLB, true, model.SidecarProxy, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "foo.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				Tls: &networking.TLSSettings{
+					Mode: networking.TLSSettings_SIMPLE,
+				},
+			},
+		}, nil, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tlsContext := getTLSContext(t, clusters[0])
+	g.Expect(tlsContext).NotTo(BeNil())
+	g.Expect(tlsContext.CommonTlsContext.TlsParams).To(Equal(&envoy_api_v2_auth.TlsParameters{
+		TlsMinimumProtocolVersion: envoy_api_v2_auth.TlsParameters_TLSv1_2,
+		TlsMaximumProtocolVersion: envoy_api_v2_auth.TlsParameters_TLSv1_3,
+		CipherSuites:              []string{"ECDHE-ECDSA-AES256-GCM-SHA384", "[AES128-SHA|AES256-SHA]"},
+		EcdhCurves:                []string{"X25519", "P-256"},
+	}))
+}
+
+func TestBuildEgressClustersWithTLSRenegotiationDisabled(t *testing.T) {
+	cases := []struct {
+		name string
+		tls  *networking.TLSSettings
+	}{
+		{
+			name: "simple",
+			tls:  &networking.TLSSettings{Mode: networking.TLSSettings_SIMPLE},
+		},
+		{
+			name: "mutual",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				CaCertificates:    "root-cert.pem",
+				ClientCertificate: "cert-chain.pem",
+				PrivateKey:        "key.pem",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			clusters, err := buildTestClustersWithAuthnPolicy("foo.example.org", model.ClientSideLB, true, model.SidecarProxy, nil, testMesh,
+				&networking.DestinationRule{
+					Host:          "foo.example.org",
+					TrafficPolicy: &networking.TrafficPolicy{Tls: tt.tls},
+				}, nil, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			tlsContext := getTLSContext(t, clusters[0])
+			g.Expect(tlsContext).NotTo(BeNil())
+			// Envoy rejects renegotiation requests of the upstream unless it is allowed explicitly.
+			g.Expect(tlsContext.AllowRenegotiation).To(BeFalse())
+		})
+	}
+}
+
+func TestBuildEgressGatewayClustersWithSimpleTLSOrigination(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// The TLS settings of a Gateway server configure the connections the gateway accepts. The TLS the egress gateway
+	// originates towards the external service is configured by the destination rule for it.
+	clusters, err := buildTestClustersWithAuthnPolicy("foo.example.org", model.DNSLB, true, model.Router, nil, testMesh,
+		&networking.DestinationRule{
+			Host: "foo.example.org",
+			TrafficPolicy: &networking.TrafficPolicy{
+				Tls: &networking.TLSSettings{
+					Mode:           networking.TLSSettings_SIMPLE,
+					CaCertificates: "/etc/certs/root-cert.pem",
+					Sni:            "foo.example.org",
+				},
+			},
+		}, nil, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	outbound := 0
+	for _, cluster := range clusters {
+		if !strings.HasPrefix(cluster.Name, "outbound|") {
+			continue
+		}
+		outbound++
+		tlsContext := getTLSContext(t, cluster)
+		g.Expect(tlsContext).NotTo(BeNil(), cluster.Name)
+		g.Expect(tlsContext.Sni).To(Equal("foo.example.org"))
+		g.Expect(tlsContext.CommonTlsContext.TlsCertificates).To(BeEmpty())
+		g.Expect(tlsContext.CommonTlsContext.GetValidationContext().GetTrustedCa().GetFilename()).
+			To(Equal("/etc/certs/root-cert.pem"))
+	}
+	g.Expect(outbound).To(BeNumerically(">", 0))
+}
+
+func TestApplyUpstreamTLSSettingsWithClientCredentialName(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	tlsSettings := &networking.TLSSettings{
+		Mode: networking.TLSSettings_MUTUAL,
+		Sni:  "foo.example.org",
+	}
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{UserSds: true},
 		IstioVersion: &model.IstioVersion{Major: 1, Minor: 5},
 	}
 	push := model.NewPushContext()
-	push.Mesh = &meshconfig.MeshConfig{}
+	push.Mesh = &meshconfig.MeshConfig{SdsUdsPath: "unix:/var/run/sds/uds_path"}
 
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			opts := &buildClusterOpts{
-				cluster: &apiv2.Cluster{
-					ClusterDiscoveryType: &apiv2.Cluster_Type{Type: test.discoveryType},
-				},
-				proxy: proxy,
-				push:  push,
-			}
-			applyUpstreamTLSSettings(opts, test.tls, test.mtlsCtx, proxy)
+	build := func() *apiv2.Cluster {
+		opts := &buildClusterOpts{
+			cluster: &apiv2.Cluster{
+				Name:                 "outbound|443||foo.example.org",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+			},
+			proxy:                proxy,
+			push:                 push,
+			clientCredentialName: "foo-client-cert",
+		}
+		applyUpstreamTLSSettings(opts, tlsSettings, userSupplied, proxy)
+		return opts.cluster
+	}
 
-			if test.expectTransportSocket && opts.cluster.TransportSocket == nil ||
-				!test.expectTransportSocket && opts.cluster.TransportSocket != nil {
-				t.Errorf("Expected TransportSocket %v", test.expectTransportSocket)
-			}
-			if test.expectTransportSocketMatch && opts.cluster.TransportSocketMatches == nil ||
-				!test.expectTransportSocketMatch && opts.cluster.TransportSocketMatches != nil {
-				t.Errorf("Expected TransportSocketMatch %v", test.expectTransportSocketMatch)
-			}
-		})
+	cluster := build()
+	tlsContext := getTLSContext(t, cluster)
+	g.Expect(tlsContext).NotTo(BeNil())
+	g.Expect(tlsContext.CommonTlsContext.TlsCertificates).To(BeEmpty())
+	sdsConfigs := tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs
+	g.Expect(sdsConfigs).To(HaveLen(1))
+	g.Expect(sdsConfigs[0].Name).To(Equal("foo-client-cert"))
+	g.Expect(tlsContext.CommonTlsContext.GetCombinedValidationContext().GetValidationContextSdsSecretConfig().GetName()).
+		To(Equal("foo-client-cert-cacert"))
+
+	// A rotated certificate is served under the same resource name, so the cluster itself does not change.
+	g.Expect(build().TransportSocket).To(Equal(cluster.TransportSocket))
+}
+
+func TestApplyUpstreamTLSSettingsWithAlpnProtocols(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	proxy := &model.Proxy{
+		Type:         model.SidecarProxy,
+		Metadata:     &model.NodeMetadata{},
+		IstioVersion: &model.IstioVersion{Major: 1, Minor: 4},
+	}
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{}
+
+	build := func(tls *networking.TLSSettings) *envoy_api_v2_auth.UpstreamTlsContext {
+		opts := &buildClusterOpts{
+			cluster: &apiv2.Cluster{
+				Name:                 "outbound|443||foo.example.org",
+				ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
+				Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+			},
+			proxy:           proxy,
+			push:            push,
+			serviceAccounts: []string{"spiffe://cluster.local/ns/default/sa/foo"},
+			alpnProtocols:   splitCommaSeparated("h2, http/1.1"),
+		}
+		applyUpstreamTLSSettings(opts, tls, userSupplied, proxy)
+		return getTLSContext(t, opts.cluster)
 	}
 
+	simple := build(&networking.TLSSettings{Mode: networking.TLSSettings_SIMPLE, Sni: "foo.example.org"})
+	g.Expect(simple.CommonTlsContext.AlpnProtocols).To(Equal([]string{"h2", "http/1.1"}))
+
+	mutual := build(&networking.TLSSettings{
+		Mode:              networking.TLSSettings_MUTUAL,
+		ClientCertificate: "/etc/certs/cert.pem",
+		PrivateKey:        "/etc/certs/key.pem",
+	})
+	g.Expect(mutual.CommonTlsContext.AlpnProtocols).To(Equal([]string{"h2", "http/1.1"}))
+
+	// The in-mesh ALPN is kept for ISTIO_MUTUAL.
+	istioMutual := build(&networking.TLSSettings{Mode: networking.TLSSettings_ISTIO_MUTUAL})
+	g.Expect(istioMutual.CommonTlsContext.AlpnProtocols).To(Equal(util.ALPNInMeshH2))
 }
 
 // Helper function to extract TLS context from a cluster
@@ -2285,3 +4543,501 @@ func TestBuildStaticClusterWithNoEndPoint(t *testing.T) {
 	// Expect to ignore STRICT_DNS cluster without endpoints.
 	g.Expect(len(clusters)).To(Equal(2))
 }
+
+func TestBuildClustersWithSidecarEgressHosts(t *testing.T) {
+	newService := func(hostname host.Name, namespace string) *model.Service {
+		return &model.Service{
+			Hostname:    hostname,
+			Address:     "1.1.1.1",
+			ClusterVIPs: make(map[string]string),
+			Ports: []*model.Port{
+				{
+					Name:     "default",
+					Port:     8080,
+					Protocol: protocol.HTTP,
+				},
+			},
+			Resolution: model.ClientSideLB,
+			Attributes: model.ServiceAttributes{
+				Namespace: namespace,
+			},
+		}
+	}
+	services := []*model.Service{
+		newService("a.ns1.svc.cluster.local", "ns1"),
+		newService("b.ns2.svc.cluster.local", "ns2"),
+	}
+
+	cases := []struct {
+		name     string
+		sidecar  *networking.Sidecar
+		expected []string
+	}{
+		{
+			name:     "no sidecar",
+			expected: []string{"outbound|8080||a.ns1.svc.cluster.local", "outbound|8080||b.ns2.svc.cluster.local"},
+		},
+		{
+			name: "sidecar restricted to own namespace",
+			sidecar: &networking.Sidecar{
+				Egress: []*networking.IstioEgressListener{
+					{
+						Hosts: []string{"./*"},
+					},
+				},
+			},
+			expected: []string{"outbound|8080||a.ns1.svc.cluster.local"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			serviceDiscovery := &fakes.ServiceDiscovery{}
+			serviceDiscovery.ServicesReturns(services, nil)
+
+			configStore := &fakes.IstioConfigStore{
+				ListStub: func(typ resource.GroupVersionKind, namespace string) ([]model.Config, error) {
+					if typ == collections.IstioNetworkingV1Alpha3Sidecars.Resource().GroupVersionKind() && tt.sidecar != nil {
+						return []model.Config{
+							{ConfigMeta: model.ConfigMeta{
+								Type:      collections.IstioNetworkingV1Alpha3Sidecars.Resource().Kind(),
+								Version:   collections.IstioNetworkingV1Alpha3Sidecars.Resource().Version(),
+								Name:      "default",
+								Namespace: "ns1",
+							},
+								Spec: tt.sidecar,
+							}}, nil
+					}
+					return nil, nil
+				},
+			}
+			env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+			proxy := &model.Proxy{
+				ClusterID:       "some-cluster-id",
+				Type:            model.SidecarProxy,
+				IPAddresses:     []string{"6.6.6.6"},
+				DNSDomain:       "ns1.svc.cluster.local",
+				ConfigNamespace: "ns1",
+				Metadata:        &model.NodeMetadata{},
+			}
+			proxy.SetSidecarScope(env.PushContext)
+
+			clusters := NewConfigGenerator([]plugin.Plugin{}).BuildClusters(proxy, env.PushContext)
+
+			var outbound []string
+			for _, c := range clusters {
+				if strings.HasPrefix(c.Name, "outbound") {
+					outbound = append(outbound, c.Name)
+				}
+			}
+			g.Expect(outbound).To(ConsistOf(tt.expected))
+		})
+	}
+}
+
+func TestBuildClustersForServicesSharingVIP(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	newService := func(hostname host.Name, port int) *model.Service {
+		return &model.Service{
+			Hostname:    hostname,
+			Address:     "10.0.0.1",
+			ClusterVIPs: map[string]string{"some-cluster-id": "10.0.0.1"},
+			Ports: []*model.Port{
+				{
+					Name:     "http",
+					Port:     port,
+					Protocol: protocol.HTTP,
+				},
+			},
+			Resolution: model.ClientSideLB,
+			Attributes: model.ServiceAttributes{
+				Namespace: TestServiceNamespace,
+			},
+		}
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.ServicesReturns([]*model.Service{
+		newService("a.example.org", 8080),
+		newService("b.example.org", 8080),
+		newService("c.example.org", 9090),
+	}, nil)
+	env := newTestEnvironment(serviceDiscovery, testMesh, &fakes.IstioConfigStore{})
+
+	proxy := &model.Proxy{
+		ClusterID:   "some-cluster-id",
+		Type:        model.SidecarProxy,
+		IPAddresses: []string{"6.6.6.6"},
+		DNSDomain:   "com",
+		Metadata:    &model.NodeMetadata{},
+	}
+	proxy.SetSidecarScope(env.PushContext)
+
+	clusters := NewConfigGenerator([]plugin.Plugin{}).BuildClusters(proxy, env.PushContext)
+	g.Expect(env.PushContext.ProxyStatus[model.DuplicatedClusters.Name()]).To(BeEmpty())
+
+	var outbound []string
+	for _, c := range clusters {
+		if strings.HasPrefix(c.Name, "outbound") {
+			outbound = append(outbound, c.Name)
+		}
+	}
+	g.Expect(outbound).To(ConsistOf(
+		"outbound|8080||a.example.org",
+		"outbound|8080||b.example.org",
+		"outbound|9090||c.example.org",
+	))
+}
+
+func TestBuildClustersWithSidecarConnectionPool(t *testing.T) {
+	service := &model.Service{
+		Hostname:    "a.ns1.svc.cluster.local",
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports: []*model.Port{
+			{
+				Name:     "default",
+				Port:     8080,
+				Protocol: protocol.HTTP,
+			},
+		},
+		Resolution: model.ClientSideLB,
+		Attributes: model.ServiceAttributes{
+			Namespace: "ns1",
+		},
+	}
+	sidecar := model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Type:      collections.IstioNetworkingV1Alpha3Sidecars.Resource().Kind(),
+			Version:   collections.IstioNetworkingV1Alpha3Sidecars.Resource().Version(),
+			Name:      "default",
+			Namespace: "ns1",
+			Annotations: map[string]string{
+				model.SidecarOutboundConnectionPoolAnnotation: `{"tcp": {"maxConnections": 7}}`,
+			},
+		},
+		Spec: &networking.Sidecar{
+			Egress: []*networking.IstioEgressListener{
+				{
+					Hosts: []string{"./*"},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		destRule *networking.DestinationRule
+		expected uint32
+	}{
+		{
+			name: "no destination rule",
+			destRule: &networking.DestinationRule{
+				Host: "other.ns1.svc.cluster.local",
+			},
+			expected: 7,
+		},
+		{
+			name: "destination rule without connection pool",
+			destRule: &networking.DestinationRule{
+				Host: "a.ns1.svc.cluster.local",
+				TrafficPolicy: &networking.TrafficPolicy{
+					OutlierDetection: &networking.OutlierDetection{
+						ConsecutiveErrors: 5,
+					},
+				},
+			},
+			expected: 7,
+		},
+		{
+			name: "destination rule with connection pool",
+			destRule: &networking.DestinationRule{
+				Host: "a.ns1.svc.cluster.local",
+				TrafficPolicy: &networking.TrafficPolicy{
+					ConnectionPool: &networking.ConnectionPoolSettings{
+						Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+							MaxConnections: 3,
+						},
+					},
+				},
+			},
+			expected: 3,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			serviceDiscovery := &fakes.ServiceDiscovery{}
+			serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+
+			configStore := &fakes.IstioConfigStore{
+				ListStub: func(typ resource.GroupVersionKind, namespace string) ([]model.Config, error) {
+					switch typ {
+					case collections.IstioNetworkingV1Alpha3Sidecars.Resource().GroupVersionKind():
+						return []model.Config{sidecar}, nil
+					case collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind():
+						return []model.Config{
+							{ConfigMeta: model.ConfigMeta{
+								Type:      collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+								Version:   collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+								Name:      "acme",
+								Namespace: "ns1",
+							},
+								Spec: tt.destRule,
+							}}, nil
+					}
+					return nil, nil
+				},
+			}
+			env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+			proxy := &model.Proxy{
+				ClusterID:       "some-cluster-id",
+				Type:            model.SidecarProxy,
+				IPAddresses:     []string{"6.6.6.6"},
+				DNSDomain:       "ns1.svc.cluster.local",
+				ConfigNamespace: "ns1",
+				Metadata:        &model.NodeMetadata{},
+			}
+			proxy.SetSidecarScope(env.PushContext)
+
+			clusters := NewConfigGenerator([]plugin.Plugin{}).BuildClusters(proxy, env.PushContext)
+
+			var cluster *apiv2.Cluster
+			for _, c := range clusters {
+				if c.Name == "outbound|8080||a.ns1.svc.cluster.local" {
+					cluster = c
+				}
+			}
+			g.Expect(cluster).NotTo(BeNil())
+			g.Expect(cluster.CircuitBreakers.Thresholds[0].MaxConnections.GetValue()).To(Equal(tt.expected))
+		})
+	}
+}
+
+func TestBuildClustersWithSidecarConnectTimeout(t *testing.T) {
+	service := &model.Service{
+		Hostname:    "a.ns1.svc.cluster.local",
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports: []*model.Port{
+			{
+				Name:     "default",
+				Port:     8080,
+				Protocol: protocol.HTTP,
+			},
+		},
+		Resolution: model.ClientSideLB,
+		Attributes: model.ServiceAttributes{
+			Namespace: "ns1",
+		},
+	}
+	sidecar := model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Type:      collections.IstioNetworkingV1Alpha3Sidecars.Resource().Kind(),
+			Version:   collections.IstioNetworkingV1Alpha3Sidecars.Resource().Version(),
+			Name:      "default",
+			Namespace: "ns1",
+			Annotations: map[string]string{
+				model.SidecarOutboundConnectTimeoutAnnotation: "2s",
+			},
+		},
+		Spec: &networking.Sidecar{
+			Egress: []*networking.IstioEgressListener{
+				{
+					Hosts: []string{"./*"},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		destRule *networking.DestinationRule
+		expected time.Duration
+	}{
+		{
+			name: "no destination rule",
+			destRule: &networking.DestinationRule{
+				Host: "other.ns1.svc.cluster.local",
+			},
+			expected: 2 * time.Second,
+		},
+		{
+			name: "destination rule without connect timeout",
+			destRule: &networking.DestinationRule{
+				Host: "a.ns1.svc.cluster.local",
+				TrafficPolicy: &networking.TrafficPolicy{
+					ConnectionPool: &networking.ConnectionPoolSettings{
+						Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+							MaxConnections: 3,
+						},
+					},
+				},
+			},
+			expected: 2 * time.Second,
+		},
+		{
+			name: "destination rule with connect timeout",
+			destRule: &networking.DestinationRule{
+				Host: "a.ns1.svc.cluster.local",
+				TrafficPolicy: &networking.TrafficPolicy{
+					ConnectionPool: &networking.ConnectionPoolSettings{
+						Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+							ConnectTimeout: &types.Duration{Seconds: 5},
+						},
+					},
+				},
+			},
+			expected: 5 * time.Second,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			serviceDiscovery := &fakes.ServiceDiscovery{}
+			serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+
+			configStore := &fakes.IstioConfigStore{
+				ListStub: func(typ resource.GroupVersionKind, namespace string) ([]model.Config, error) {
+					switch typ {
+					case collections.IstioNetworkingV1Alpha3Sidecars.Resource().GroupVersionKind():
+						return []model.Config{sidecar}, nil
+					case collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind():
+						return []model.Config{
+							{ConfigMeta: model.ConfigMeta{
+								Type:      collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+								Version:   collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+								Name:      "acme",
+								Namespace: "ns1",
+							},
+								Spec: tt.destRule,
+							}}, nil
+					}
+					return nil, nil
+				},
+			}
+			env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+			proxy := &model.Proxy{
+				ClusterID:       "some-cluster-id",
+				Type:            model.SidecarProxy,
+				IPAddresses:     []string{"6.6.6.6"},
+				DNSDomain:       "ns1.svc.cluster.local",
+				ConfigNamespace: "ns1",
+				Metadata:        &model.NodeMetadata{},
+			}
+			proxy.SetSidecarScope(env.PushContext)
+
+			clusters := NewConfigGenerator([]plugin.Plugin{}).BuildClusters(proxy, env.PushContext)
+
+			var cluster *apiv2.Cluster
+			for _, c := range clusters {
+				if c.Name == "outbound|8080||a.ns1.svc.cluster.local" {
+					cluster = c
+				}
+			}
+			g.Expect(cluster).NotTo(BeNil())
+			g.Expect(cluster.ConnectTimeout).To(Equal(ptypes.DurationProto(tt.expected)))
+		})
+	}
+}
+
+func TestBuildClustersForMixedProtocolPorts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	service := &model.Service{
+		Hostname:    "mixed.default.svc.cluster.local",
+		Address:     "1.1.1.1",
+		ClusterVIPs: make(map[string]string),
+		Ports: model.PortList{
+			{Name: "http", Port: 8080, Protocol: protocol.HTTP},
+			{Name: "tcp", Port: 3306, Protocol: protocol.TCP},
+			{Name: "auto", Port: 9090, Protocol: protocol.Unsupported},
+			{Name: "grpc", Port: 7070, Protocol: protocol.GRPC},
+		},
+		Resolution: model.ClientSideLB,
+		Attributes: model.ServiceAttributes{
+			Namespace: "default",
+		},
+	}
+	serviceDiscovery := &fakes.ServiceDiscovery{}
+	serviceDiscovery.ServicesReturns([]*model.Service{service}, nil)
+
+	destRule := &networking.DestinationRule{
+		Host: "mixed.default.svc.cluster.local",
+		TrafficPolicy: &networking.TrafficPolicy{
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{
+					MaxRequestsPerConnection: 1,
+					IdleTimeout:              &types.Duration{Seconds: 30},
+				},
+			},
+		},
+	}
+	configStore := &fakes.IstioConfigStore{
+		ListStub: func(typ resource.GroupVersionKind, namespace string) ([]model.Config, error) {
+			if typ == collections.IstioNetworkingV1Alpha3Destinationrules.Resource().GroupVersionKind() {
+				return []model.Config{
+					{ConfigMeta: model.ConfigMeta{
+						Type:      collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+						Version:   collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+						Name:      "mixed",
+						Namespace: "default",
+					},
+						Spec: destRule,
+					}}, nil
+			}
+			return nil, nil
+		},
+	}
+	env := newTestEnvironment(serviceDiscovery, testMesh, configStore)
+
+	proxy := &model.Proxy{
+		ClusterID:       "some-cluster-id",
+		Type:            model.SidecarProxy,
+		IPAddresses:     []string{"6.6.6.6"},
+		DNSDomain:       "default.svc.cluster.local",
+		ConfigNamespace: "default",
+		Metadata:        &model.NodeMetadata{},
+	}
+	proxy.SetSidecarScope(env.PushContext)
+
+	clusters := make(map[string]*apiv2.Cluster)
+	for _, c := range NewConfigGenerator([]plugin.Plugin{}).BuildClusters(proxy, env.PushContext) {
+		clusters[c.Name] = c
+	}
+
+	httpCluster := clusters["outbound|8080||mixed.default.svc.cluster.local"]
+	g.Expect(httpCluster).NotTo(BeNil())
+	g.Expect(httpCluster.MaxRequestsPerConnection.GetValue()).To(Equal(uint32(1)))
+	g.Expect(httpCluster.CommonHttpProtocolOptions.GetIdleTimeout()).To(Equal(ptypes.DurationProto(30 * time.Second)))
+	g.Expect(httpCluster.Http2ProtocolOptions).To(BeNil())
+	g.Expect(httpCluster.CircuitBreakers.Thresholds[0].MaxConnections.GetValue()).To(Equal(uint32(10)))
+
+	tcpCluster := clusters["outbound|3306||mixed.default.svc.cluster.local"]
+	g.Expect(tcpCluster).NotTo(BeNil())
+	g.Expect(tcpCluster.MaxRequestsPerConnection).To(BeNil())
+	g.Expect(tcpCluster.CommonHttpProtocolOptions).To(BeNil())
+	g.Expect(tcpCluster.Http2ProtocolOptions).To(BeNil())
+	g.Expect(tcpCluster.CircuitBreakers.Thresholds[0].MaxConnections.GetValue()).To(Equal(uint32(10)))
+
+	autoCluster := clusters["outbound|9090||mixed.default.svc.cluster.local"]
+	g.Expect(autoCluster).NotTo(BeNil())
+	g.Expect(autoCluster.Http2ProtocolOptions).NotTo(BeNil())
+	g.Expect(autoCluster.ProtocolSelection).To(Equal(apiv2.Cluster_USE_DOWNSTREAM_PROTOCOL))
+	g.Expect(autoCluster.MaxRequestsPerConnection.GetValue()).To(Equal(uint32(1)))
+
+	grpcCluster := clusters["outbound|7070||mixed.default.svc.cluster.local"]
+	g.Expect(grpcCluster).NotTo(BeNil())
+	g.Expect(grpcCluster.Http2ProtocolOptions).NotTo(BeNil())
+	g.Expect(grpcCluster.ProtocolSelection).To(Equal(apiv2.Cluster_USE_CONFIGURED_PROTOCOL))
+}
@@ -184,4 +184,18 @@ func applyLocalityFailover(
 		}
 	}
 
+	// 3. order the LocalityLbEndpoints by priority, then by locality, for a stable and readable output.
+	sort.SliceStable(loadAssignment.Endpoints, func(i, j int) bool {
+		a, b := loadAssignment.Endpoints[i], loadAssignment.Endpoints[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Locality.GetRegion() != b.Locality.GetRegion() {
+			return a.Locality.GetRegion() < b.Locality.GetRegion()
+		}
+		if a.Locality.GetZone() != b.Locality.GetZone() {
+			return a.Locality.GetZone() < b.Locality.GetZone()
+		}
+		return a.Locality.GetSubZone() < b.Locality.GetSubZone()
+	})
 }
@@ -15,6 +15,7 @@
 package loadbalancer
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -22,6 +23,7 @@ import (
 	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
 	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	. "github.com/onsi/gomega"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
@@ -29,6 +31,7 @@ import (
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/fakes"
+	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pkg/config/mesh"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/schema/collections"
@@ -130,6 +133,31 @@ func TestApplyLocalitySetting(t *testing.T) {
 		}
 	})
 
+	t.Run("Failover: sorted by priority and locality", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		env := buildEnvForClustersWithFailover()
+		loadAssignment := &apiv2.ClusterLoadAssignment{}
+		for _, l := range []string{"region3", "region1/zone2", "region1/zone1/subzone3", "region2", "region1/zone1/subzone2",
+			"region1/zone1/subzone1"} {
+			loadAssignment.Endpoints = append(loadAssignment.Endpoints, &endpoint.LocalityLbEndpoints{
+				Locality: util.ConvertLocality(l),
+			})
+		}
+		ApplyLocalityLBSetting(locality, loadAssignment, env.Mesh().LocalityLbSetting, true)
+		got := make([]string, 0, len(loadAssignment.Endpoints))
+		for _, localityEndpoint := range loadAssignment.Endpoints {
+			got = append(got, fmt.Sprintf("%d:%s", localityEndpoint.Priority, util.LocalityToString(localityEndpoint.Locality)))
+		}
+		g.Expect(got).To(Equal([]string{
+			"0:region1/zone1/subzone1",
+			"1:region1/zone1/subzone2",
+			"1:region1/zone1/subzone3",
+			"2:region1/zone2",
+			"3:region2",
+			"4:region3",
+		}))
+	})
+
 	t.Run("Failover: priorities with some nil localities", func(t *testing.T) {
 		g := NewGomegaWithT(t)
 		env := buildEnvForClustersWithFailover()
@@ -158,6 +186,45 @@ func TestApplyLocalitySetting(t *testing.T) {
 	})
 }
 
+func TestApplyLocalityWeightWithEndpointWeights(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	lbEndpoint := func(weight uint32) *endpoint.LbEndpoint {
+		return &endpoint.LbEndpoint{LoadBalancingWeight: &wrappers.UInt32Value{Value: weight}}
+	}
+	loadAssignment := &apiv2.ClusterLoadAssignment{
+		Endpoints: []*endpoint.LocalityLbEndpoints{
+			{
+				Locality:            &envoycore.Locality{Region: "region1", Zone: "zone1"},
+				LbEndpoints:         []*endpoint.LbEndpoint{lbEndpoint(2), lbEndpoint(1)},
+				LoadBalancingWeight: &wrappers.UInt32Value{Value: 3},
+			},
+			{
+				Locality:            &envoycore.Locality{Region: "region2", Zone: "zone1"},
+				LbEndpoints:         []*endpoint.LbEndpoint{lbEndpoint(1)},
+				LoadBalancingWeight: &wrappers.UInt32Value{Value: 1},
+			},
+		},
+	}
+	applyLocalityWeight(&envoycore.Locality{Region: "region1", Zone: "zone1"}, loadAssignment,
+		[]*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/zone1/*": 20,
+				},
+			},
+		})
+
+	// Envoy picks a locality by the locality weights, then an endpoint by the endpoint weights within the locality.
+	// The endpoint weights are kept, so the endpoint of weight 2 gets 2/3 of the 80% of the first locality.
+	g.Expect(loadAssignment.Endpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(80)))
+	g.Expect(loadAssignment.Endpoints[1].LoadBalancingWeight.GetValue()).To(Equal(uint32(20)))
+	g.Expect(loadAssignment.Endpoints[0].LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(2)))
+	g.Expect(loadAssignment.Endpoints[0].LbEndpoints[1].LoadBalancingWeight.GetValue()).To(Equal(uint32(1)))
+}
+
 func TestGetLocalityLbSetting(t *testing.T) {
 	// dummy config for test
 	failover := []*networking.LocalityLoadBalancerSetting_Failover{nil}
@@ -249,6 +249,20 @@ func GetDestinationCluster(destination *networking.Destination, service *model.S
 	return model.BuildSubsetKey(model.TrafficDirectionOutbound, destination.Subset, host.Name(destination.Host), port)
 }
 
+// hasSubset reports whether a destination rule of the service defines the subset.
+func hasSubset(push *model.PushContext, node *model.Proxy, service *model.Service, subset string) bool {
+	destRule := push.DestinationRule(node, service)
+	if destRule == nil {
+		return false
+	}
+	for _, s := range destRule.Spec.(*networking.DestinationRule).Subsets {
+		if s.Name == subset {
+			return true
+		}
+	}
+	return false
+}
+
 // BuildHTTPRoutesForVirtualService creates data plane HTTP routes from the virtual service spec.
 // The rule should be adapted to destination names (outbound clusters).
 // Each rule is guarded by source labels.
@@ -390,10 +404,13 @@ func translateRoute(push *model.PushContext, node *model.Proxy, in *networking.H
 			RetryPolicy: retry.ConvertPolicy(in.Retries),
 		}
 
-		// Configure timeouts specified by Virtual Service if they are provided, otherwise set it to defaults.
+		// Configure timeouts specified by Virtual Service if they are provided, otherwise use the default of the
+		// destination if it has one, or the global default.
 		var d *duration.Duration
 		if in.Timeout != nil {
 			d = gogo.DurationToProtoDuration(in.Timeout)
+		} else if timeout := getDestinationDefaultTimeout(push, node, in.Route, serviceRegistry); timeout != nil {
+			d = timeout
 		} else {
 			d = features.DefaultRequestTimeout()
 		}
@@ -401,6 +418,11 @@ func translateRoute(push *model.PushContext, node *model.Proxy, in *networking.H
 		action.Timeout = d
 		action.MaxGrpcTimeout = d
 
+		// Retries without a per try timeout of the Virtual Service use the default of the destination, if it has one.
+		if action.RetryPolicy != nil && action.RetryPolicy.PerTryTimeout == nil {
+			action.RetryPolicy.PerTryTimeout = getDestinationDefaultPerTryTimeout(push, node, in.Route, serviceRegistry)
+		}
+
 		out.Action = &route.Route_Route{Route: action}
 
 		if rewrite := in.Rewrite; rewrite != nil {
@@ -458,6 +480,15 @@ func translateRoute(push *model.PushContext, node *model.Proxy, in *networking.H
 
 			hostname := host.Name(dst.GetDestination().GetHost())
 			n := GetDestinationCluster(dst.Destination, serviceRegistry[hostname], port)
+			if subset := dst.GetDestination().GetSubset(); subset != "" && push != nil && serviceRegistry[hostname] != nil &&
+				!hasSubset(push, node, serviceRegistry[hostname], subset) {
+				push.AddMetric(model.MissingSubsets, n, node,
+					fmt.Sprintf("subset %s of %s is not defined by a destination rule", subset, hostname))
+				if features.FallbackForMissingSubsets.Get() {
+					n = GetDestinationCluster(&networking.Destination{Host: dst.Destination.Host, Port: dst.Destination.Port},
+						serviceRegistry[hostname], port)
+				}
+			}
 
 			clusterWeight := &route.WeightedCluster_ClusterWeight{
 				Name:                    n,
@@ -1004,6 +1035,46 @@ func getHashPolicyByService(node *model.Proxy, push *model.PushContext, svc *mod
 	return consistentHashToHashPolicy(consistentHash)
 }
 
+// getDestinationDefaultTimeout returns the default request timeout set by the destination rule of the first
+// destination of the route, if any.
+func getDestinationDefaultTimeout(push *model.PushContext, node *model.Proxy, destinations []*networking.HTTPRouteDestination,
+	serviceRegistry map[host.Name]*model.Service) *duration.Duration {
+	destRule := getFirstDestinationRule(push, node, destinations, serviceRegistry)
+	if timeout := model.GetDestinationRuleAnnotations(destRule).DefaultRequestTimeout; timeout > 0 {
+		return ptypes.DurationProto(timeout)
+	}
+	return nil
+}
+
+// getDestinationDefaultPerTryTimeout returns the default per try timeout set by the destination rule of the first
+// destination of the route, if any.
+func getDestinationDefaultPerTryTimeout(push *model.PushContext, node *model.Proxy, destinations []*networking.HTTPRouteDestination,
+	serviceRegistry map[host.Name]*model.Service) *duration.Duration {
+	destRule := getFirstDestinationRule(push, node, destinations, serviceRegistry)
+	if timeout := model.GetDestinationRuleAnnotations(destRule).DefaultPerTryTimeout; timeout > 0 {
+		return ptypes.DurationProto(timeout)
+	}
+	return nil
+}
+
+// getFirstDestinationRule returns the destination rule of the first destination of the route, if any.
+func getFirstDestinationRule(push *model.PushContext, node *model.Proxy, destinations []*networking.HTTPRouteDestination,
+	serviceRegistry map[host.Name]*model.Service) *model.Config {
+	if push == nil || len(destinations) == 0 {
+		return nil
+	}
+	hostname := host.Name(destinations[0].GetDestination().GetHost())
+	var configNamespace string
+	if serviceRegistry[hostname] != nil {
+		configNamespace = serviceRegistry[hostname].Attributes.Namespace
+	}
+	return push.DestinationRule(node,
+		&model.Service{
+			Hostname:   hostname,
+			Attributes: model.ServiceAttributes{Namespace: configNamespace},
+		})
+}
+
 func getHashPolicy(push *model.PushContext, node *model.Proxy, dst *networking.HTTPRouteDestination,
 	configNamespace string) *route.RouteAction_HashPolicy {
 	if push == nil {
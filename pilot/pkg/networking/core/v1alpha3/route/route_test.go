@@ -27,6 +27,7 @@ import (
 
 	networking "istio.io/api/networking/v1alpha3"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/route"
 	"istio.io/istio/pkg/config/host"
@@ -251,6 +252,86 @@ func TestBuildHTTPRoutes(t *testing.T) {
 		g.Expect(routes[0].GetName()).To(gomega.Equal("bar"))
 	})
 
+	t.Run("for virtual service with destination rule default timeout", func(t *testing.T) {
+		g := gomega.NewGomegaWithT(t)
+
+		meshConfig := mesh.DefaultMeshConfig()
+		push := &model.PushContext{
+			Mesh: &meshConfig,
+		}
+		push.SetDestinationRules([]model.Config{
+			{
+				ConfigMeta: model.ConfigMeta{
+					Type:        collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+					Version:     collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+					Name:        "acme",
+					Annotations: map[string]string{model.DefaultRequestTimeoutAnnotation: "5s"},
+				},
+				Spec: &networking.DestinationRule{
+					Host: "*.example.org",
+				},
+			},
+		})
+
+		routes, err := route.BuildHTTPRoutesForVirtualService(node, push, virtualServicePlain, serviceRegistry, 8080, gatewayNames)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(len(routes)).To(gomega.Equal(1))
+		g.Expect(routes[0].GetRoute().GetTimeout()).To(gomega.Equal(gogo.DurationToProtoDuration(&types.Duration{Seconds: 5})))
+
+		// A timeout on the route wins over the default of the destination.
+		routes, err = route.BuildHTTPRoutesForVirtualService(node, push, virtualServiceWithTimeout, serviceRegistry, 8080, gatewayNames)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(len(routes)).To(gomega.Equal(1))
+		g.Expect(routes[0].GetRoute().GetTimeout()).To(gomega.Equal(gogo.DurationToProtoDuration(&types.Duration{Seconds: 10})))
+	})
+
+	t.Run("for virtual service with destination rule default per try timeout", func(t *testing.T) {
+		g := gomega.NewGomegaWithT(t)
+
+		meshConfig := mesh.DefaultMeshConfig()
+		push := &model.PushContext{
+			Mesh: &meshConfig,
+		}
+		push.SetDestinationRules([]model.Config{
+			{
+				ConfigMeta: model.ConfigMeta{
+					Type:        collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+					Version:     collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+					Name:        "acme",
+					Annotations: map[string]string{model.DefaultPerTryTimeoutAnnotation: "2s"},
+				},
+				Spec: &networking.DestinationRule{
+					Host: "*.example.org",
+				},
+			},
+		})
+
+		routes, err := route.BuildHTTPRoutesForVirtualService(node, push, virtualServicePlain, serviceRegistry, 8080, gatewayNames)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(len(routes)).To(gomega.Equal(1))
+		g.Expect(routes[0].GetRoute().GetRetryPolicy().GetPerTryTimeout()).To(gomega.Equal(gogo.DurationToProtoDuration(&types.Duration{Seconds: 2})))
+
+		// A per try timeout on the route wins over the default of the destination.
+		virtualServiceWithPerTryTimeout := virtualServicePlain
+		virtualServiceWithPerTryTimeout.Spec = &networking.VirtualService{
+			Hosts:    []string{},
+			Gateways: []string{"some-gateway"},
+			Http: []*networking.HTTPRoute{
+				{
+					Route: virtualServicePlain.Spec.(*networking.VirtualService).Http[0].Route,
+					Retries: &networking.HTTPRetry{
+						Attempts:      3,
+						PerTryTimeout: &types.Duration{Seconds: 1},
+					},
+				},
+			},
+		}
+		routes, err = route.BuildHTTPRoutesForVirtualService(node, push, virtualServiceWithPerTryTimeout, serviceRegistry, 8080, gatewayNames)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(len(routes)).To(gomega.Equal(1))
+		g.Expect(routes[0].GetRoute().GetRetryPolicy().GetPerTryTimeout()).To(gomega.Equal(gogo.DurationToProtoDuration(&types.Duration{Seconds: 1})))
+	})
+
 	t.Run("for virtual service with ring hash", func(t *testing.T) {
 		g := gomega.NewGomegaWithT(t)
 
@@ -391,6 +472,68 @@ func TestBuildHTTPRoutes(t *testing.T) {
 		g.Expect(routes[0].GetRoute().GetHashPolicy()).To(gomega.ConsistOf(hashPolicy))
 	})
 
+	t.Run("for virtual service with subset missing from destination rule", func(t *testing.T) {
+		virtualService := model.Config{
+			ConfigMeta: model.ConfigMeta{
+				Type:    collections.IstioNetworkingV1Alpha3Virtualservices.Resource().Kind(),
+				Version: collections.IstioNetworkingV1Alpha3Virtualservices.Resource().Version(),
+				Name:    "acme",
+			},
+			Spec: virtualServiceWithSubset,
+		}
+
+		cases := []struct {
+			name            string
+			fallback        bool
+			expectedCluster string
+		}{
+			{
+				name:            "without fallback",
+				expectedCluster: "outbound|65000|some-subset|*.example.org",
+			},
+			{
+				name:            "with fallback",
+				fallback:        true,
+				expectedCluster: "outbound|65000||*.example.org",
+			},
+		}
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				g := gomega.NewGomegaWithT(t)
+				if tt.fallback {
+					_ = os.Setenv(features.FallbackForMissingSubsets.Name, "true")
+					defer func() { _ = os.Unsetenv(features.FallbackForMissingSubsets.Name) }()
+				}
+
+				meshConfig := mesh.DefaultMeshConfig()
+				push := model.NewPushContext()
+				push.Mesh = &meshConfig
+				push.SetDestinationRules([]model.Config{
+					{
+						ConfigMeta: model.ConfigMeta{
+							Type:    collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Kind(),
+							Version: collections.IstioNetworkingV1Alpha3Destinationrules.Resource().Version(),
+							Name:    "acme",
+						},
+						Spec: &networking.DestinationRule{
+							Host:    "*.example.org",
+							Subsets: []*networking.Subset{{Name: "other-subset"}},
+						},
+					},
+				})
+
+				routes, err := route.BuildHTTPRoutesForVirtualService(node, push, virtualService, serviceRegistry, 8080, gatewayNames)
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+				g.Expect(len(routes)).To(gomega.Equal(1))
+				g.Expect(routes[0].GetRoute().GetCluster()).To(gomega.Equal(tt.expectedCluster))
+
+				// The missing subset is reported in the push status either way.
+				g.Expect(push.ProxyStatus[model.MissingSubsets.Name()]).To(
+					gomega.HaveKey("outbound|65000|some-subset|*.example.org"))
+			})
+		}
+	})
+
 	t.Run("for virtual service with subsets with port level settings with ring hash", func(t *testing.T) {
 		g := gomega.NewGomegaWithT(t)
 
@@ -77,10 +77,22 @@ const (
 	// regarding the virtual service or destination rule used for each
 	IstioMetadataKey = "istio"
 
+	// DebugMetadataKey is the key under which debugging metadata, such as the workload UID, is added to an endpoint
+	// when endpoint debug metadata is enabled.
+	DebugMetadataKey = "istio.debug"
+
+	// HealthCheckPortLabel is the label of a workload holding the port that its endpoints are health checked on, for
+	// workloads whose health check port differs from the port they serve on.
+	HealthCheckPortLabel = "networking.istio.io/healthCheckPort"
+
 	// EnvoyTransportSocketMetadataKey is the key under which metadata is added to an endpoint
 	// which determines the endpoint level transport socket configuration.
 	EnvoyTransportSocketMetadataKey = "envoy.transport_socket_match"
 
+	// EnvoyLbMetadataKey is the key under which the labels of an endpoint are added to its metadata, for the subset
+	// load balancer of its cluster to select it by.
+	EnvoyLbMetadataKey = "envoy.lb"
+
 	// EnvoyRawBufferSocketName matched with hardcoded built-in Envoy transport name which determines
 	// endpoint level plantext transport socket configuration
 	EnvoyRawBufferSocketName = "envoy.transport_sockets.raw_buffer"
@@ -105,6 +117,10 @@ var ALPNH2Only = []string{"h2"}
 // Once Envoy supports client-side ALPN negotiation, this should be {"istio", "h2", "http/1.1"}.
 var ALPNInMeshH2 = []string{"istio", "h2"}
 
+// ALPNInMeshH2WithMxc advertises that Proxy is going to use HTTP/2 when talking to the in-mesh cluster and has metadata
+// exchange enabled. The custom "istio-peer-exchange" value indicates, metadata exchange is enabled.
+var ALPNInMeshH2WithMxc = []string{"istio-peer-exchange", "istio", "h2"}
+
 // ALPNInMesh advertises that Proxy is going to talk to the in-mesh cluster.
 // The custom "istio" value indicates in-mesh traffic and it's going to be used for routing decisions.
 var ALPNInMesh = []string{"istio"}
@@ -346,8 +362,14 @@ func LocalityMatch(proxyLocality *core.Locality, ruleLocality string) bool {
 	return false
 }
 
+// SplitLocality splits a '/' separated locality string into its region, zone and subzone. Missing parts are empty,
+// and any parts after the subzone are ignored. Surrounding whitespace and trailing slashes are dropped, so that a
+// locality like "region/zone/" has an empty subzone rather than failing to match the endpoints of its zone.
 func SplitLocality(locality string) (region, zone, subzone string) {
-	items := strings.Split(locality, "/")
+	items := strings.Split(strings.TrimRight(strings.TrimSpace(locality), "/"), "/")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
 	switch len(items) {
 	case 1:
 		return items[0], "", ""
@@ -413,6 +435,122 @@ func cloneLocalityLbEndpoints(endpoints []*endpoint.LocalityLbEndpoints) []*endp
 	return out
 }
 
+// WithLbEndpointsPort returns a copy of the locality endpoints with the socket addresses of all endpoints using the
+// given port. The endpoints themselves are copied as well, as they may be shared with other load assignments.
+func WithLbEndpointsPort(localityLbEndpoints []*endpoint.LocalityLbEndpoints, port uint32) []*endpoint.LocalityLbEndpoints {
+	out := cloneLocalityLbEndpoints(localityLbEndpoints)
+	for _, llb := range out {
+		lbEndpoints := make([]*endpoint.LbEndpoint, 0, len(llb.LbEndpoints))
+		for _, lbEndpoint := range llb.LbEndpoints {
+			socketAddress := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+			if socketAddress == nil {
+				lbEndpoints = append(lbEndpoints, lbEndpoint)
+				continue
+			}
+			ep := *lbEndpoint.GetEndpoint()
+			ep.Address = BuildAddress(socketAddress.Address, port)
+			clone := *lbEndpoint
+			clone.HostIdentifier = &endpoint.LbEndpoint_Endpoint{Endpoint: &ep}
+			lbEndpoints = append(lbEndpoints, &clone)
+		}
+		llb.LbEndpoints = lbEndpoints
+	}
+	return out
+}
+
+// WithLbEndpointsHealthCheckHostname returns a copy of the locality endpoints with all endpoints sending the given
+// host in their HTTP health checks. The endpoints themselves are copied as well, as they may be shared with other load
+// assignments.
+func WithLbEndpointsHealthCheckHostname(localityLbEndpoints []*endpoint.LocalityLbEndpoints,
+	hostname string) []*endpoint.LocalityLbEndpoints {
+	out := cloneLocalityLbEndpoints(localityLbEndpoints)
+	for _, llb := range out {
+		lbEndpoints := make([]*endpoint.LbEndpoint, 0, len(llb.LbEndpoints))
+		for _, lbEndpoint := range llb.LbEndpoints {
+			if lbEndpoint.GetEndpoint() == nil {
+				lbEndpoints = append(lbEndpoints, lbEndpoint)
+				continue
+			}
+			ep := *lbEndpoint.GetEndpoint()
+			healthCheckConfig := endpoint.Endpoint_HealthCheckConfig{}
+			if ep.HealthCheckConfig != nil {
+				healthCheckConfig = *ep.HealthCheckConfig
+			}
+			healthCheckConfig.Hostname = hostname
+			ep.HealthCheckConfig = &healthCheckConfig
+			clone := *lbEndpoint
+			clone.HostIdentifier = &endpoint.LbEndpoint_Endpoint{Endpoint: &ep}
+			lbEndpoints = append(lbEndpoints, &clone)
+		}
+		llb.LbEndpoints = lbEndpoints
+	}
+	return out
+}
+
+// MarkLbEndpointDraining marks the endpoint as draining and reduces its load balancing weight to the minimum, so
+// that the workload behind it can shut down gracefully.
+func MarkLbEndpointDraining(ep *endpoint.LbEndpoint) {
+	ep.HealthStatus = core.HealthStatus_DRAINING
+	ep.LoadBalancingWeight = &wrappers.UInt32Value{Value: 1}
+}
+
+// ApplyLbEndpointHealthCheckPort makes Envoy health check the endpoint on the port of the health check port label of
+// its workload. Endpoints without a valid port in the label are health checked on their own port.
+func ApplyLbEndpointHealthCheckPort(ep *endpoint.LbEndpoint, endpointLabels map[string]string) {
+	value, ok := endpointLabels[HealthCheckPortLabel]
+	if !ok || ep.GetEndpoint() == nil {
+		return
+	}
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		log.Warnf("ignoring invalid %s label %q of endpoint %v", HealthCheckPortLabel, value, ep.GetEndpoint().Address)
+		return
+	}
+	ep.GetEndpoint().HealthCheckConfig = &endpoint.Endpoint_HealthCheckConfig{PortValue: uint32(port)}
+}
+
+// WithLbEndpointSubsetLabels returns a copy of the endpoint holding the values of the given labels of its workload in
+// its load balancing metadata. The endpoint itself is returned if its workload has none of the labels.
+func WithLbEndpointSubsetLabels(ep *endpoint.LbEndpoint, endpointLabels map[string]string, keys []string) *endpoint.LbEndpoint {
+	fields := make(map[string]*pstruct.Value)
+	for _, k := range keys {
+		if v, ok := endpointLabels[k]; ok {
+			fields[k] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: v}}
+		}
+	}
+	if len(fields) == 0 {
+		return ep
+	}
+	clone := *ep
+	clone.Metadata = &core.Metadata{FilterMetadata: map[string]*pstruct.Struct{}}
+	for k, v := range ep.GetMetadata().GetFilterMetadata() {
+		clone.Metadata.FilterMetadata[k] = v
+	}
+	clone.Metadata.FilterMetadata[EnvoyLbMetadataKey] = &pstruct.Struct{Fields: fields}
+	return &clone
+}
+
+// DefaultSubsetLabelKeys returns the sorted label keys of the subsets of the destination rule, if it has a default
+// subset. The endpoints of its host carry the values of these labels in their load balancing metadata, so that the
+// default cluster can select them by subset.
+func DefaultSubsetLabelKeys(destRule *model.Config) []string {
+	if destRule == nil || model.GetDestinationRuleAnnotations(destRule).DefaultSubset == "" {
+		return nil
+	}
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, subset := range destRule.Spec.(*networking.DestinationRule).Subsets {
+		for k := range subset.Labels {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // return a shallow copy LbEndpoint
 func CloneLbEndpoint(endpoint *endpoint.LbEndpoint) *endpoint.LbEndpoint {
 	if endpoint == nil {
@@ -468,6 +606,97 @@ func AddSubsetToMetadata(md *core.Metadata, subset string) *core.Metadata {
 	return updatedMeta
 }
 
+// AddConfigSourceToMetadata will build a new core.Metadata struct recording the service and, if present,
+// the resource version of the config that an Envoy resource was generated from. This is used to correlate
+// Envoy config dumps with the Istio config. Services outside of the mesh are flagged as external, so that
+// telemetry can tell external traffic apart. A new core.Metadata is created to prevent modification to
+// shared base Metadata across subsets, etc.
+func AddConfigSourceToMetadata(md *core.Metadata, service *model.Service, config *model.ConfigMeta) *core.Metadata {
+	updatedMeta := &core.Metadata{}
+	if md != nil {
+		proto.Merge(updatedMeta, md)
+	}
+	if updatedMeta.FilterMetadata == nil {
+		updatedMeta.FilterMetadata = map[string]*pstruct.Struct{}
+	}
+	istioMeta, ok := updatedMeta.FilterMetadata[IstioMetadataKey]
+	if !ok {
+		istioMeta = &pstruct.Struct{Fields: map[string]*pstruct.Value{}}
+		updatedMeta.FilterMetadata[IstioMetadataKey] = istioMeta
+	}
+	if service != nil {
+		istioMeta.Fields["service"] = &pstruct.Value{
+			Kind: &pstruct.Value_StringValue{
+				StringValue: string(service.Hostname),
+			},
+		}
+		if service.Attributes.Namespace != "" {
+			istioMeta.Fields["serviceNamespace"] = &pstruct.Value{
+				Kind: &pstruct.Value_StringValue{
+					StringValue: service.Attributes.Namespace,
+				},
+			}
+		}
+		if service.MeshExternal {
+			istioMeta.Fields["external"] = &pstruct.Value{
+				Kind: &pstruct.Value_BoolValue{
+					BoolValue: true,
+				},
+			}
+		}
+	}
+	if config != nil && config.ResourceVersion != "" {
+		istioMeta.Fields["configResourceVersion"] = &pstruct.Value{
+			Kind: &pstruct.Value_StringValue{
+				StringValue: config.ResourceVersion,
+			},
+		}
+	}
+	return updatedMeta
+}
+
+// AddCanonicalServiceToMetadata will build a new core.Metadata struct recording the Istio canonical service name
+// and revision of the workloads selected by the given labels. Workloads lacking the canonical service labels fall
+// back to the app and version labels, and finally to the service name and the "latest" revision.
+func AddCanonicalServiceToMetadata(md *core.Metadata, service *model.Service, labels map[string]string) *core.Metadata {
+	updatedMeta := &core.Metadata{}
+	proto.Merge(updatedMeta, md)
+	if istioMeta, ok := updatedMeta.FilterMetadata[IstioMetadataKey]; ok {
+		istioMeta.Fields[model.IstioCanonicalServiceLabelName] = &pstruct.Value{
+			Kind: &pstruct.Value_StringValue{
+				StringValue: canonicalServiceName(service, labels),
+			},
+		}
+		istioMeta.Fields[model.IstioCanonicalServiceRevisionLabelName] = &pstruct.Value{
+			Kind: &pstruct.Value_StringValue{
+				StringValue: canonicalServiceRevision(labels),
+			},
+		}
+	}
+	return updatedMeta
+}
+
+func canonicalServiceName(service *model.Service, labels map[string]string) string {
+	for _, name := range []string{model.IstioCanonicalServiceLabelName, "app.kubernetes.io/name", "app"} {
+		if svc, ok := labels[name]; ok {
+			return svc
+		}
+	}
+	if service.Attributes.Name != "" {
+		return service.Attributes.Name
+	}
+	return string(service.Hostname)
+}
+
+func canonicalServiceRevision(labels map[string]string) string {
+	for _, name := range []string{model.IstioCanonicalServiceRevisionLabelName, "app.kubernetes.io/version", "version"} {
+		if rev, ok := labels[name]; ok {
+			return rev
+		}
+	}
+	return "latest"
+}
+
 // IsHTTPFilterChain returns true if the filter chain contains a HTTP connection manager filter
 func IsHTTPFilterChain(filterChain *listener.FilterChain) bool {
 	for _, f := range filterChain.Filters {
@@ -538,13 +767,20 @@ func MergeAnyWithAny(dst *any.Any, src *any.Any) (*any.Any, error) {
 }
 
 // BuildLbEndpointMetadata adds metadata values to a lb endpoint
-func BuildLbEndpointMetadata(uid string, network string, tlsMode string, push *model.PushContext) *core.Metadata {
-	if !push.IsMixerEnabled() {
-		// Only use UIDs when Mixer is enabled.
+func BuildLbEndpointMetadata(uid string, serviceAccount string, network string, tlsMode string, push *model.PushContext) *core.Metadata {
+	debugUID := ""
+	if features.EnableEndpointDebugMetadata.Get() {
+		debugUID = uid
+	}
+	if !push.IsMixerEnabled() || features.StripEndpointMetadata.Get() {
+		// Only use UIDs when Mixer is enabled, and never when only the required metadata should be sent.
 		uid = ""
 	}
+	if !features.EnableEndpointServiceAccountMetadata.Get() || features.StripEndpointMetadata.Get() {
+		serviceAccount = ""
+	}
 
-	if uid == "" && network == "" && tlsMode == model.DisabledTLSModeLabel {
+	if uid == "" && serviceAccount == "" && network == "" && tlsMode == model.DisabledTLSModeLabel && debugUID == "" {
 		return nil
 	}
 
@@ -552,7 +788,7 @@ func BuildLbEndpointMetadata(uid string, network string, tlsMode string, push *m
 		FilterMetadata: map[string]*pstruct.Struct{},
 	}
 
-	if uid != "" || network != "" {
+	if uid != "" || serviceAccount != "" || network != "" {
 		metadata.FilterMetadata[IstioMetadataKey] = &pstruct.Struct{
 			Fields: map[string]*pstruct.Value{},
 		}
@@ -561,6 +797,10 @@ func BuildLbEndpointMetadata(uid string, network string, tlsMode string, push *m
 			metadata.FilterMetadata[IstioMetadataKey].Fields["uid"] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: uid}}
 		}
 
+		if serviceAccount != "" {
+			metadata.FilterMetadata[IstioMetadataKey].Fields["serviceAccount"] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: serviceAccount}}
+		}
+
 		if network != "" {
 			metadata.FilterMetadata[IstioMetadataKey].Fields["network"] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: network}}
 		}
@@ -574,6 +814,14 @@ func BuildLbEndpointMetadata(uid string, network string, tlsMode string, push *m
 		}
 	}
 
+	if debugUID != "" {
+		metadata.FilterMetadata[DebugMetadataKey] = &pstruct.Struct{
+			Fields: map[string]*pstruct.Value{
+				"uid": {Kind: &pstruct.Value_StringValue{StringValue: debugUID}},
+			},
+		}
+	}
+
 	return metadata
 }
 
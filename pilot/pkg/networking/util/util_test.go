@@ -15,6 +15,7 @@
 package util
 
 import (
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -35,6 +36,7 @@ import (
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"gopkg.in/d4l3k/messagediff.v1"
 
+	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
 
 	"istio.io/istio/pilot/pkg/features"
@@ -162,6 +164,42 @@ func TestConvertLocality(t *testing.T) {
 			},
 			reverse: "region/zone/subzone",
 		},
+		{
+			name:     "locality with trailing slash",
+			locality: "region/zone/",
+			want: &core.Locality{
+				Region: "region",
+				Zone:   "zone",
+			},
+			reverse: "region/zone",
+		},
+		{
+			name:     "locality with surrounding whitespace",
+			locality: " region / zone / subzone ",
+			want: &core.Locality{
+				Region:  "region",
+				Zone:    "zone",
+				SubZone: "subzone",
+			},
+			reverse: "region/zone/subzone",
+		},
+		{
+			name:     "locality with empty zone",
+			locality: "region//subzone",
+			want: &core.Locality{
+				Region:  "region",
+				SubZone: "subzone",
+			},
+			reverse: "region",
+		},
+		{
+			name:     "region with trailing slashes",
+			locality: "region//",
+			want: &core.Locality{
+				Region: "region",
+			},
+			reverse: "region",
+		},
 	}
 
 	for _, tt := range tests {
@@ -360,6 +398,154 @@ func TestBuildConfigInfoMetadata(t *testing.T) {
 	}
 }
 
+func TestAddConfigSourceToMetadata(t *testing.T) {
+	service := &model.Service{
+		Hostname:   "foo.default.svc.cluster.local",
+		Attributes: model.ServiceAttributes{Namespace: "default"},
+	}
+	cases := []struct {
+		name    string
+		in      *core.Metadata
+		service *model.Service
+		config  *model.ConfigMeta
+		want    *core.Metadata
+	}{
+		{
+			"service only",
+			nil,
+			service,
+			nil,
+			&core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					IstioMetadataKey: {
+						Fields: map[string]*structpb.Value{
+							"service": {
+								Kind: &structpb.Value_StringValue{
+									StringValue: "foo.default.svc.cluster.local",
+								},
+							},
+							"serviceNamespace": {
+								Kind: &structpb.Value_StringValue{
+									StringValue: "default",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"service and destination rule",
+			&core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					IstioMetadataKey: {
+						Fields: map[string]*structpb.Value{
+							"config": {
+								Kind: &structpb.Value_StringValue{
+									StringValue: "/apis/networking.istio.io/v1alpha3/namespaces/default/destination-rule/svcA",
+								},
+							},
+						},
+					},
+				},
+			},
+			service,
+			&model.ConfigMeta{Name: "svcA", Namespace: "default", ResourceVersion: "12345"},
+			&core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					IstioMetadataKey: {
+						Fields: map[string]*structpb.Value{
+							"config": {
+								Kind: &structpb.Value_StringValue{
+									StringValue: "/apis/networking.istio.io/v1alpha3/namespaces/default/destination-rule/svcA",
+								},
+							},
+							"configResourceVersion": {
+								Kind: &structpb.Value_StringValue{
+									StringValue: "12345",
+								},
+							},
+							"service": {
+								Kind: &structpb.Value_StringValue{
+									StringValue: "foo.default.svc.cluster.local",
+								},
+							},
+							"serviceNamespace": {
+								Kind: &structpb.Value_StringValue{
+									StringValue: "default",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, v := range cases {
+		t.Run(v.name, func(tt *testing.T) {
+			got := AddConfigSourceToMetadata(v.in, v.service, v.config)
+			if diff, equal := messagediff.PrettyDiff(got, v.want); !equal {
+				tt.Errorf("AddConfigSourceToMetadata(%v) produced incorrect result:\ngot: %v\nwant: %v\nDiff: %s", v.in, got, v.want, diff)
+			}
+		})
+	}
+}
+
+func TestAddCanonicalServiceToMetadata(t *testing.T) {
+	service := &model.Service{
+		Hostname:   "foo.default.svc.cluster.local",
+		Attributes: model.ServiceAttributes{Name: "foo", Namespace: "default"},
+	}
+	cases := []struct {
+		name         string
+		labels       map[string]string
+		wantName     string
+		wantRevision string
+	}{
+		{
+			"canonical labels",
+			map[string]string{
+				model.IstioCanonicalServiceLabelName:         "bar",
+				model.IstioCanonicalServiceRevisionLabelName: "v2",
+				"app":     "baz",
+				"version": "v1",
+			},
+			"bar",
+			"v2",
+		},
+		{
+			"app and version labels",
+			map[string]string{"app": "baz", "version": "v1"},
+			"baz",
+			"v1",
+		},
+		{
+			"no labels",
+			nil,
+			"foo",
+			"latest",
+		},
+	}
+
+	for _, v := range cases {
+		t.Run(v.name, func(tt *testing.T) {
+			in := AddConfigSourceToMetadata(nil, service, nil)
+			got := AddCanonicalServiceToMetadata(in, service, v.labels)
+			fields := got.FilterMetadata[IstioMetadataKey].Fields
+			if name := fields[model.IstioCanonicalServiceLabelName].GetStringValue(); name != v.wantName {
+				tt.Errorf("got canonical name %q, want %q", name, v.wantName)
+			}
+			if rev := fields[model.IstioCanonicalServiceRevisionLabelName].GetStringValue(); rev != v.wantRevision {
+				tt.Errorf("got canonical revision %q, want %q", rev, v.wantRevision)
+			}
+			if _, ok := in.FilterMetadata[IstioMetadataKey].Fields[model.IstioCanonicalServiceLabelName]; ok {
+				tt.Errorf("input metadata was modified")
+			}
+		})
+	}
+}
+
 func TestAddSubsetToMetadata(t *testing.T) {
 	cases := []struct {
 		name   string
@@ -1028,3 +1214,201 @@ func TestBuildAddress(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildLbEndpointMetadataStripped(t *testing.T) {
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{MixerCheckServer: "istio-policy:9091"}
+
+	md := BuildLbEndpointMetadata("kubernetes://pod.default", "", "network1", model.IstioMutualTLSModeLabel, push)
+	if uid := md.FilterMetadata[IstioMetadataKey].Fields["uid"].GetStringValue(); uid != "kubernetes://pod.default" {
+		t.Fatalf("expected uid metadata, got %v", md)
+	}
+
+	_ = os.Setenv(features.StripEndpointMetadata.Name, "true")
+	defer func() { _ = os.Unsetenv(features.StripEndpointMetadata.Name) }()
+
+	md = BuildLbEndpointMetadata("kubernetes://pod.default", "", "network1", model.IstioMutualTLSModeLabel, push)
+	want := &core.Metadata{
+		FilterMetadata: map[string]*structpb.Struct{
+			IstioMetadataKey: {
+				Fields: map[string]*structpb.Value{
+					"network": {Kind: &structpb.Value_StringValue{StringValue: "network1"}},
+				},
+			},
+			EnvoyTransportSocketMetadataKey: {
+				Fields: map[string]*structpb.Value{
+					model.TLSModeLabelShortname: {Kind: &structpb.Value_StringValue{StringValue: model.IstioMutualTLSModeLabel}},
+				},
+			},
+		},
+	}
+	if !proto.Equal(md, want) {
+		t.Errorf("expected stripped metadata %v, got %v", want, md)
+	}
+
+	if md = BuildLbEndpointMetadata("kubernetes://pod.default", "", "", model.DisabledTLSModeLabel, push); md != nil {
+		t.Errorf("expected no metadata, got %v", md)
+	}
+}
+
+func TestBuildLbEndpointMetadataDebug(t *testing.T) {
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{}
+
+	md := BuildLbEndpointMetadata("kubernetes://pod.default", "", "", model.IstioMutualTLSModeLabel, push)
+	if _, ok := md.FilterMetadata[DebugMetadataKey]; ok {
+		t.Fatalf("expected no debug metadata by default, got %v", md)
+	}
+
+	_ = os.Setenv(features.EnableEndpointDebugMetadata.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableEndpointDebugMetadata.Name) }()
+
+	md = BuildLbEndpointMetadata("kubernetes://pod.default", "", "", model.DisabledTLSModeLabel, push)
+	if uid := md.GetFilterMetadata()[DebugMetadataKey].GetFields()["uid"].GetStringValue(); uid != "kubernetes://pod.default" {
+		t.Errorf("expected debug uid metadata, got %v", md)
+	}
+	// The UID used by Mixer is still only sent when Mixer is enabled.
+	if _, ok := md.GetFilterMetadata()[IstioMetadataKey]; ok {
+		t.Errorf("expected no istio metadata, got %v", md)
+	}
+}
+
+func TestApplyLbEndpointHealthCheckPort(t *testing.T) {
+	cases := []struct {
+		name     string
+		labels   map[string]string
+		expected *endpoint.Endpoint_HealthCheckConfig
+	}{
+		{
+			name:     "no override",
+			labels:   map[string]string{"app": "foo"},
+			expected: nil,
+		},
+		{
+			name:     "health check port",
+			labels:   map[string]string{HealthCheckPortLabel: "8081"},
+			expected: &endpoint.Endpoint_HealthCheckConfig{PortValue: 8081},
+		},
+		{
+			name:     "invalid health check port",
+			labels:   map[string]string{HealthCheckPortLabel: "http"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := &endpoint.LbEndpoint{
+				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+					Endpoint: &endpoint.Endpoint{Address: BuildAddress("10.0.0.1", 8080)},
+				},
+			}
+			ApplyLbEndpointHealthCheckPort(ep, tt.labels)
+			if got := ep.GetEndpoint().HealthCheckConfig; !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Unexpected health check config, want %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestWithLbEndpointsHealthCheckHostname(t *testing.T) {
+	ep := &endpoint.LbEndpoint{
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address:           BuildAddress("10.0.0.1", 8080),
+				HealthCheckConfig: &endpoint.Endpoint_HealthCheckConfig{PortValue: 15021},
+			},
+		},
+	}
+	localityLbEndpoints := []*endpoint.LocalityLbEndpoints{{LbEndpoints: []*endpoint.LbEndpoint{ep}}}
+
+	got := WithLbEndpointsHealthCheckHostname(localityLbEndpoints, "backend.example.org")
+	expected := &endpoint.Endpoint_HealthCheckConfig{PortValue: 15021, Hostname: "backend.example.org"}
+	if hc := got[0].LbEndpoints[0].GetEndpoint().HealthCheckConfig; !reflect.DeepEqual(hc, expected) {
+		t.Errorf("Unexpected health check config, want %v, got %v", expected, hc)
+	}
+	if hostname := ep.GetEndpoint().HealthCheckConfig.Hostname; hostname != "" {
+		t.Errorf("Unexpected change of the original endpoint health check host to %q", hostname)
+	}
+}
+
+func TestWithLbEndpointSubsetLabels(t *testing.T) {
+	tlsMetadata := &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			model.TLSModeLabelShortname: {Kind: &structpb.Value_StringValue{StringValue: model.IstioMutualTLSModeLabel}},
+		},
+	}
+	ep := &endpoint.LbEndpoint{
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{Address: BuildAddress("10.0.0.1", 8080)},
+		},
+		Metadata: &core.Metadata{
+			FilterMetadata: map[string]*structpb.Struct{EnvoyTransportSocketMetadataKey: tlsMetadata},
+		},
+	}
+
+	if got := WithLbEndpointSubsetLabels(ep, map[string]string{"app": "foo"}, []string{"version"}); got != ep {
+		t.Errorf("Expected the endpoint itself without any of the labels, got %v", got)
+	}
+
+	got := WithLbEndpointSubsetLabels(ep, map[string]string{"app": "foo", "version": "v1"}, []string{"version"})
+	expected := &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			"version": {Kind: &structpb.Value_StringValue{StringValue: "v1"}},
+		},
+	}
+	if !reflect.DeepEqual(got.Metadata.FilterMetadata[EnvoyLbMetadataKey], expected) {
+		t.Errorf("Unexpected lb metadata, want %v, got %v", expected, got.Metadata.FilterMetadata[EnvoyLbMetadataKey])
+	}
+	if got.Metadata.FilterMetadata[EnvoyTransportSocketMetadataKey] != tlsMetadata {
+		t.Errorf("Expected the transport socket metadata to be kept")
+	}
+	if _, f := ep.Metadata.FilterMetadata[EnvoyLbMetadataKey]; f {
+		t.Errorf("Expected the original endpoint to be left alone")
+	}
+}
+
+func TestDefaultSubsetLabelKeys(t *testing.T) {
+	destRule := &model.Config{
+		ConfigMeta: model.ConfigMeta{Name: "acme"},
+		Spec: &networking.DestinationRule{
+			Host: "foo.example.org",
+			Subsets: []*networking.Subset{
+				{Name: "v1", Labels: map[string]string{"version": "v1", "track": "stable"}},
+				{Name: "v2", Labels: map[string]string{"version": "v2"}},
+			},
+		},
+	}
+	if got := DefaultSubsetLabelKeys(destRule); got != nil {
+		t.Errorf("Expected no label keys without a default subset, got %v", got)
+	}
+
+	destRule.Annotations = map[string]string{model.DefaultSubsetAnnotation: "v1"}
+	if got := DefaultSubsetLabelKeys(destRule); !reflect.DeepEqual(got, []string{"track", "version"}) {
+		t.Errorf("Unexpected label keys, want [track version], got %v", got)
+	}
+}
+
+func TestBuildLbEndpointMetadataServiceAccount(t *testing.T) {
+	push := model.NewPushContext()
+	push.Mesh = &meshconfig.MeshConfig{}
+
+	sa := "spiffe://cluster.local/ns/default/sa/foo"
+	md := BuildLbEndpointMetadata("", sa, "", model.DisabledTLSModeLabel, push)
+	if md != nil {
+		t.Fatalf("expected no service account metadata by default, got %v", md)
+	}
+
+	_ = os.Setenv(features.EnableEndpointServiceAccountMetadata.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableEndpointServiceAccountMetadata.Name) }()
+
+	md = BuildLbEndpointMetadata("", sa, "", model.DisabledTLSModeLabel, push)
+	if got := md.GetFilterMetadata()[IstioMetadataKey].GetFields()["serviceAccount"].GetStringValue(); got != sa {
+		t.Errorf("expected service account metadata %q, got %v", sa, md)
+	}
+
+	// Endpoints without a service account have no principal to match.
+	if md = BuildLbEndpointMetadata("", "", "", model.DisabledTLSModeLabel, push); md != nil {
+		t.Errorf("expected no metadata, got %v", md)
+	}
+}
@@ -308,3 +308,45 @@ func TestDebounce(t *testing.T) {
 		})
 	}
 }
+
+func TestDebounceEDSUpdates(t *testing.T) {
+	debounceAfter = time.Millisecond * 50
+	debounceMax = debounceAfter * 2
+	enableEDSDebounce = true
+	defer func() { enableEDSDebounce = false }()
+
+	stopCh := make(chan struct{})
+	updateCh := make(chan *model.PushRequest)
+	pushes := make(chan *model.PushRequest, 10)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		debounce(updateCh, stopCh, func(req *model.PushRequest) { pushes <- req })
+		wg.Done()
+	}()
+
+	// A burst of endpoint changes within the debounce window results in a single push of all updated services.
+	services := []string{"a.example.org", "b.example.org", "c.example.org", "a.example.org", "d.example.org"}
+	for _, svc := range services {
+		updateCh <- &model.PushRequest{Full: false, EdsUpdates: map[string]struct{}{svc: {}}}
+	}
+
+	select {
+	case req := <-pushes:
+		want := map[string]struct{}{"a.example.org": {}, "b.example.org": {}, "c.example.org": {}, "d.example.org": {}}
+		if req.Full || !reflect.DeepEqual(req.EdsUpdates, want) {
+			t.Errorf("got push full=%v of %v, expected a partial push of %v", req.Full, req.EdsUpdates, want)
+		}
+	case <-time.After(debounceMax * 4):
+		t.Fatal("timed out waiting for the push")
+	}
+	select {
+	case req := <-pushes:
+		t.Errorf("got unexpected second push of %v", req.EdsUpdates)
+	case <-time.After(debounceAfter * 2):
+	}
+
+	close(stopCh)
+	wg.Wait()
+}
@@ -91,7 +91,11 @@ func buildEnvoyLbEndpoint(e *model.IstioEndpoint, push *model.PushContext) *endp
 	// Istio telemetry depends on the metadata value being set for endpoints in the mesh.
 	// Istio endpoint level tls transport socket configuration depends on this logic
 	// Do not remove
-	ep.Metadata = util.BuildLbEndpointMetadata(e.UID, e.Network, e.TLSMode, push)
+	ep.Metadata = util.BuildLbEndpointMetadata(e.UID, e.ServiceAccount, e.Network, e.TLSMode, push)
+	util.ApplyLbEndpointHealthCheckPort(ep, e.Labels)
+	if e.Draining {
+		util.MarkLbEndpointDraining(ep)
+	}
 
 	return ep
 }
@@ -365,7 +369,24 @@ func (s *DiscoveryServer) loadAssignmentsForClusterIsolated(proxy *model.Proxy,
 		return buildEmptyClusterLoadAssignment(clusterName)
 	}
 
-	locEps := buildLocalityLbEndpointsFromShards(se, svcPort, subsetLabels, clusterName, push)
+	destRule := push.DestinationRule(proxy, svc)
+	// The default cluster selects endpoints by the subset labels of the destination rule, if it has a default subset.
+	var subsetLabelKeys []string
+	if subsetName == "" {
+		subsetLabelKeys = util.DefaultSubsetLabelKeys(destRule)
+	}
+
+	locEps := buildLocalityLbEndpointsFromShards(se, svcPort, subsetLabels, subsetLabelKeys, clusterName, push)
+
+	// Remap the endpoint ports and set the health check host if the destination rule asks for it. The endpoints are
+	// shared with other proxies, so they are copied first.
+	annotations := model.GetDestinationRuleAnnotations(destRule)
+	if endpointPort, ok := annotations.EndpointPorts[port]; ok {
+		locEps = util.WithLbEndpointsPort(locEps, endpointPort)
+	}
+	if annotations.HealthCheckHost != "" {
+		locEps = util.WithLbEndpointsHealthCheckHostname(locEps, annotations.HealthCheckHost)
+	}
 
 	return &xdsapi.ClusterLoadAssignment{
 		ClusterName: clusterName,
@@ -532,6 +553,7 @@ func buildLocalityLbEndpointsFromShards(
 	shards *EndpointShards,
 	svcPort *model.Port,
 	epLabels labels.Collection,
+	subsetLabelKeys []string,
 	clusterName string,
 	push *model.PushContext) []*endpoint.LocalityLbEndpoints {
 	localityEpMap := make(map[string]*endpoint.LocalityLbEndpoints)
@@ -560,7 +582,8 @@ func buildLocalityLbEndpointsFromShards(
 			if ep.EnvoyEndpoint == nil {
 				ep.EnvoyEndpoint = buildEnvoyLbEndpoint(ep, push)
 			}
-			locLbEps.LbEndpoints = append(locLbEps.LbEndpoints, ep.EnvoyEndpoint)
+			// The cached endpoint is shared by all clusters, so the subset labels are added to a copy.
+			locLbEps.LbEndpoints = append(locLbEps.LbEndpoints, util.WithLbEndpointSubsetLabels(ep.EnvoyEndpoint, ep.Labels, subsetLabelKeys))
 
 		}
 	}
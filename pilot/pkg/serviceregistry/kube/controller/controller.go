@@ -36,6 +36,7 @@ import (
 	"istio.io/pkg/log"
 	"istio.io/pkg/monitoring"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pilot/pkg/serviceregistry"
@@ -180,6 +181,10 @@ type Controller struct {
 
 	// Network name for the registry as specified by the MeshNetworks configmap
 	networkForRegistry string
+
+	drainingMutex sync.Mutex
+	// drainingTimers stores pod key ==> timer updating the endpoints of the pod when its draining grace period ends
+	drainingTimers map[string]*time.Timer
 }
 
 // NewController creates a new Kubernetes controller
@@ -199,6 +204,7 @@ func NewController(client kubernetes.Interface, options Options) *Controller {
 		externalNameSvcInstanceMap: make(map[host.Name][]*model.ServiceInstance),
 		networksWatcher:            options.NetworksWatcher,
 		metrics:                    options.Metrics,
+		drainingTimers:             make(map[string]*time.Timer),
 	}
 
 	sharedInformers := informers.NewSharedInformerFactoryWithOptions(client, options.ResyncPeriod, informers.WithNamespace(options.WatchedNamespace))
@@ -219,6 +225,7 @@ func NewController(client kubernetes.Interface, options Options) *Controller {
 	podInformer := sharedInformers.Core().V1().Pods().Informer()
 	c.pods = newPodCache(podInformer, c)
 	registerHandlers(podInformer, c.queue, "Pods", c.pods.onEvent)
+	registerPodDrainingHandler(podInformer, c)
 
 	return c
 }
@@ -424,6 +431,9 @@ func (c *Controller) getPodLocality(pod *v1.Pod) string {
 	region := getLabelValue(node.(*v1.Node), NodeRegionLabel, NodeRegionLabelGA)
 	zone := getLabelValue(node.(*v1.Node), NodeZoneLabel, NodeZoneLabelGA)
 	subzone := getLabelValue(node.(*v1.Node), IstioSubzoneLabel, "")
+	if subzone == "" && features.NodeNameAsSubzone.Get() {
+		subzone = pod.Spec.NodeName
+	}
 
 	if region == "" && zone == "" && subzone == "" {
 		return ""
@@ -834,6 +844,9 @@ func (c *Controller) updateEDS(ep *v1.Endpoints, event model.Event) {
 				}
 
 				builder := NewEndpointBuilder(c, pod)
+				if builder.drained {
+					continue
+				}
 
 				// EDS and ServiceEntry use name for service port - ADS will need to
 				// map to numbers.
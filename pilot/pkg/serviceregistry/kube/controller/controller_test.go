@@ -16,6 +16,7 @@ package controller
 
 import (
 	"fmt"
+	"os"
 	"reflect"
 	"sort"
 	"sync"
@@ -36,6 +37,7 @@ import (
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/pkg/log"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
@@ -79,6 +81,9 @@ type XdsEvent struct {
 
 	// The id of the event
 	ID string
+
+	// The endpoints associated with an EDS push if any
+	Endpoints []*model.IstioEndpoint
 }
 
 // NewFakeXDS creates a XdsUpdater reporting events via a channel.
@@ -91,7 +96,7 @@ func NewFakeXDS() *FakeXdsUpdater {
 func (fx *FakeXdsUpdater) EDSUpdate(_, hostname string, _ string, entry []*model.IstioEndpoint) error {
 	if len(entry) > 0 {
 		select {
-		case fx.Events <- XdsEvent{Type: "eds", ID: hostname}:
+		case fx.Events <- XdsEvent{Type: "eds", ID: hostname, Endpoints: entry}:
 		default:
 		}
 
@@ -308,6 +313,34 @@ func makeService(n, ns string, cl kubernetes.Interface, t *testing.T) {
 	log.Infof("Created service %s", n)
 }
 
+func TestController_GetPodLocalityNodeNameAsSubzone(t *testing.T) {
+	_ = os.Setenv(features.NodeNameAsSubzone.Name, "true")
+	defer func() { _ = os.Unsetenv(features.NodeNameAsSubzone.Name) }()
+
+	pod1 := generatePod("128.0.1.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+	pod2 := generatePod("128.0.1.2", "pod2", "nsB", "", "node2", map[string]string{"app": "prod-app"}, map[string]string{})
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: EndpointsOnly})
+	defer controller.Stop()
+	addNodes(t, controller,
+		generateNode("node1", map[string]string{NodeZoneLabel: "zone1", NodeRegionLabel: "region1"}),
+		generateNode("node2", map[string]string{NodeZoneLabel: "zone1", NodeRegionLabel: "region1", IstioSubzoneLabel: "subzone2"}))
+	addPods(t, controller, pod1, pod2)
+	for _, pod := range []*coreV1.Pod{pod1, pod2} {
+		if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+			t.Fatalf("wait for pod err: %v", err)
+		}
+		fx.Wait("xds")
+	}
+
+	// The node name is used as subzone, unless the node has a subzone label.
+	if az := controller.getPodLocality(pod1); az != "region1/zone1/node1" {
+		t.Errorf("Wanted az: region1/zone1/node1, got: %s", az)
+	}
+	if az := controller.getPodLocality(pod2); az != "region1/zone1/subzone2" {
+		t.Errorf("Wanted az: region1/zone1/subzone2, got: %s", az)
+	}
+}
+
 func TestController_GetPodLocality(t *testing.T) {
 	pod1 := generatePod("128.0.1.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
 	pod2 := generatePod("128.0.1.2", "pod2", "nsB", "", "node2", map[string]string{"app": "prod-app"}, map[string]string{})
@@ -1703,6 +1736,99 @@ func addNodes(t *testing.T, controller *Controller, nodes ...*coreV1.Node) {
 	}
 }
 
+func TestEndpointUpdateDrainingPod(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "pod1", "nsa", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+
+			createService(controller, "svc1", "nsa", nil,
+				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsa", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 1 || ev.Endpoints[0].Draining {
+				t.Fatalf("expected one active endpoint, got %v", ev.Endpoints)
+			}
+
+			// Labeling the pod as draining updates its endpoints.
+			pod = generatePod("128.0.0.1", "pod1", "nsa", "", "node1",
+				map[string]string{"app": "prod-app", model.DrainingLabel: "true"}, map[string]string{})
+			addPods(t, controller, pod)
+			ev = fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 1 || !ev.Endpoints[0].Draining {
+				t.Fatalf("expected one draining endpoint, got %v", ev.Endpoints)
+			}
+		})
+	}
+}
+
+func TestEndpointUpdateDrainedPod(t *testing.T) {
+	_ = os.Setenv(features.EndpointDrainingGracePeriod.Name, "2s")
+	defer func() { _ = os.Unsetenv(features.EndpointDrainingGracePeriod.Name) }()
+
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			pod1 := generatePod("128.0.0.1", "pod1", "nsa", "", "node1",
+				map[string]string{"app": "prod-app", model.DrainingSinceLabel: fmt.Sprint(time.Now().Unix())}, map[string]string{})
+			pod2 := generatePod("128.0.0.2", "pod2", "nsa", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod1, pod2)
+			for _, pod := range []*coreV1.Pod{pod1, pod2} {
+				if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+					t.Fatalf("wait for pod err: %v", err)
+				}
+			}
+
+			createService(controller, "svc1", "nsa", nil,
+				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsa", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 2 {
+				t.Fatalf("expected two endpoints, got %v", ev.Endpoints)
+			}
+			for _, ep := range ev.Endpoints {
+				if ep.Draining != (ep.Address == "128.0.0.1") {
+					t.Errorf("unexpected draining state of endpoint %s: %v", ep.Address, ep.Draining)
+				}
+			}
+
+			// The draining pod is removed once its grace period has passed.
+			ev = fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.2" {
+				t.Fatalf("expected only the endpoint of pod2, got %v", ev.Endpoints)
+			}
+		})
+	}
+}
+
 func TestEndpointUpdate(t *testing.T) {
 	for mode, name := range EndpointModeNames {
 		mode := mode
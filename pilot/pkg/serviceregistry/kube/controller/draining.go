@@ -0,0 +1,102 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+// podDrainingState returns the current draining state of the pod, and the time left until it is drained.
+func podDrainingState(pod *v1.Pod) (model.EndpointDrainingState, time.Duration) {
+	return model.DrainingState(pod.Labels, time.Now(), features.EndpointDrainingGracePeriod.Get())
+}
+
+// drainingLabelsChanged returns true if the draining labels of the pods differ.
+func drainingLabelsChanged(a, b *v1.Pod) bool {
+	return a.Labels[model.DrainingLabel] != b.Labels[model.DrainingLabel] ||
+		a.Labels[model.DrainingSinceLabel] != b.Labels[model.DrainingSinceLabel]
+}
+
+// registerPodDrainingHandler updates the endpoints of pods whose draining labels change, and of draining pods when
+// their grace period ends. Kubernetes does not update endpoints on pod label changes, so they would otherwise keep
+// their draining state until the next endpoints event.
+func registerPodDrainingHandler(informer cache.SharedIndexInformer, c *Controller) {
+	informer.AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if pod, ok := obj.(*v1.Pod); ok {
+					c.scheduleDrainedUpdate(pod)
+				}
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				oldPod, ok := old.(*v1.Pod)
+				if !ok {
+					return
+				}
+				curPod, ok := cur.(*v1.Pod)
+				if !ok {
+					return
+				}
+				if drainingLabelsChanged(oldPod, curPod) {
+					c.scheduleDrainedUpdate(curPod)
+					c.queue.Push(func() error {
+						return c.endpoints.updatePodEndpoints(curPod)
+					})
+				}
+			},
+		})
+}
+
+// scheduleDrainedUpdate replaces the timer updating the endpoints of the pod at the end of its grace period, if it
+// is draining for one.
+func (c *Controller) scheduleDrainedUpdate(pod *v1.Pod) {
+	key := kube.KeyFunc(pod.Name, pod.Namespace)
+	state, remaining := podDrainingState(pod)
+
+	c.drainingMutex.Lock()
+	defer c.drainingMutex.Unlock()
+	if timer, f := c.drainingTimers[key]; f {
+		timer.Stop()
+		delete(c.drainingTimers, key)
+	}
+	if state != model.EndpointDraining || remaining <= 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(remaining, func() {
+		c.drainingMutex.Lock()
+		if c.drainingTimers[key] == timer {
+			delete(c.drainingTimers, key)
+		}
+		c.drainingMutex.Unlock()
+
+		c.queue.Push(func() error {
+			item, exists, err := c.pods.informer.GetStore().GetByKey(key)
+			if err != nil || !exists {
+				return err
+			}
+			return c.endpoints.updatePodEndpoints(item.(*v1.Pod))
+		})
+	})
+	c.drainingTimers[key] = timer
+}
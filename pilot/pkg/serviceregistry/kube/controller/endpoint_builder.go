@@ -31,12 +31,16 @@ type EndpointBuilder struct {
 	serviceAccount string
 	locality       model.Locality
 	tlsMode        string
+	draining       bool
+	drained        bool
 }
 
 func NewEndpointBuilder(c *Controller, pod *v1.Pod) *EndpointBuilder {
 	locality, sa, uid := "", "", ""
 	var podLabels labels.Instance
+	drainingState := model.EndpointActive
 	if pod != nil {
+		drainingState, _ = podDrainingState(pod)
 		locality = c.getPodLocality(pod)
 		sa = kube.SecureNamingSAN(pod)
 		uid = createUID(pod.Name, pod.Namespace)
@@ -52,7 +56,9 @@ func NewEndpointBuilder(c *Controller, pod *v1.Pod) *EndpointBuilder {
 			Label:     locality,
 			ClusterID: c.clusterID,
 		},
-		tlsMode: kube.PodTLSMode(pod),
+		tlsMode:  kube.PodTLSMode(pod),
+		draining: drainingState == model.EndpointDraining,
+		drained:  drainingState == model.EndpointDrained,
 	}
 }
 
@@ -74,5 +80,6 @@ func (b *EndpointBuilder) buildIstioEndpoint(
 		EndpointPort:    uint32(endpointPort),
 		ServicePortName: svcPortName,
 		Network:         b.controller.endpointNetwork(endpointAddress),
+		Draining:        b.draining,
 	}
 }
@@ -83,6 +83,24 @@ func (e *endpointsController) registerEndpointsHandler() {
 		})
 }
 
+func (e *endpointsController) updatePodEndpoints(pod *v1.Pod) error {
+	eps, err := listerv1.NewEndpointsLister(e.informer.GetIndexer()).Endpoints(pod.Namespace).List(klabels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		for _, ss := range ep.Subsets {
+			if hasProxyIP(ss.Addresses, pod.Status.PodIP) {
+				if err := e.onEvent(ep, model.EventUpdate); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
 func (e *endpointsController) GetProxyServiceInstances(c *Controller, proxy *model.Proxy) []*model.ServiceInstance {
 	eps, err := listerv1.NewEndpointsLister(e.informer.GetIndexer()).Endpoints(proxy.Metadata.Namespace).List(klabels.Everything())
 	if err != nil {
@@ -174,6 +192,9 @@ func (e *endpointsController) InstancesByPort(c *Controller, svc *model.Service,
 			}
 
 			builder := NewEndpointBuilder(c, pod)
+			if builder.drained {
+				continue
+			}
 
 			// identify the port by name. K8S EndpointPort uses the service port name
 			for _, port := range ss.Ports {
@@ -37,6 +37,8 @@ type kubeEndpointsController interface {
 	InstancesByPort(c *Controller, svc *model.Service, reqSvcPort int,
 		labelsList labels.Collection) ([]*model.ServiceInstance, error)
 	GetProxyServiceInstances(c *Controller, proxy *model.Proxy) []*model.ServiceInstance
+	// updatePodEndpoints sends eds updates for the endpoints containing the pod.
+	updatePodEndpoints(pod *v1.Pod) error
 }
 
 // kubeEndpoints abstracts the common behavior across endpoint and endpoint slices.
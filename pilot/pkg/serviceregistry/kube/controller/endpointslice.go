@@ -92,6 +92,9 @@ func (esc *endpointSliceController) updateEDS(es interface{}, event model.Event)
 				}
 
 				builder := esc.newEndpointBuilder(pod, e)
+				if builder.drained {
+					continue
+				}
 				// EDS and ServiceEntry use name for service port - ADS will need to
 				// map to numbers.
 				for _, port := range slice.Ports {
@@ -142,6 +145,33 @@ func (esc *endpointSliceController) onEvent(curr interface{}, event model.Event)
 	})
 }
 
+func (esc *endpointSliceController) updatePodEndpoints(pod *v1.Pod) error {
+	slices, err := discoverylister.NewEndpointSliceLister(esc.informer.GetIndexer()).EndpointSlices(pod.Namespace).List(klabels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, slice := range slices {
+		if sliceHasAddress(slice, pod.Status.PodIP) {
+			if err := esc.onEvent(slice, model.EventUpdate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sliceHasAddress returns true if one of the endpoints of the slice has the address.
+func sliceHasAddress(slice *discoveryv1alpha1.EndpointSlice, address string) bool {
+	for _, e := range slice.Endpoints {
+		for _, a := range e.Addresses {
+			if a == address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (esc *endpointSliceController) GetProxyServiceInstances(c *Controller, proxy *model.Proxy) []*model.ServiceInstance {
 	eps, err := discoverylister.NewEndpointSliceLister(esc.informer.GetIndexer()).EndpointSlices(proxy.Metadata.Namespace).List(klabels.Everything())
 	if err != nil {
@@ -240,6 +270,9 @@ func (esc *endpointSliceController) InstancesByPort(c *Controller, svc *model.Se
 				}
 
 				builder := esc.newEndpointBuilder(pod, e)
+				if builder.drained {
+					continue
+				}
 				// identify the port by name. K8S EndpointPort uses the service port name
 				for _, port := range slice.Ports {
 					var portNum int32